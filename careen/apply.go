@@ -0,0 +1,185 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Computes the hash of file named patchPath and compares it with the expected hash
+func VerifyPatch(patch string, expectedHash string) (valid bool, err error) {
+	fileData, err := ioutil.ReadFile(patch)
+	if err != nil {
+		return false, err
+	}
+	fileLen := len(fileData)
+
+	fileHash := sha1.New()
+	io.WriteString(fileHash, string(fileData[:fileLen]))
+	computedHash := hex.EncodeToString(fileHash.Sum(nil))
+	if computedHash != expectedHash {
+		return false, fmt.Errorf("Computed hash %v does not equal expected hash %v", computedHash, expectedHash)
+	}
+
+	return true, nil
+}
+
+// Applies the patch file patchPath to the files in repoDir, as git apply
+// would, giving up after timeout or when ctx is cancelled. Nothing is changed
+// unless every file of the patch applies.
+func ApplyPatchFile(ctx context.Context, repoDir string, patchPath string, timeout time.Duration, log *Logger) error {
+	tree := NewPatchedTree(DirTree(repoDir))
+	if err := tree.ApplyFile(ctx, patchPath, timeout, log); err != nil {
+		return err
+	}
+	return tree.Write(repoDir)
+}
+
+// Applies the patches of the package in order, after checking the package and
+// each patch, resuming after the patches an interrupted run applied. Stops at
+// the first patch which fails. The pre_apply and post_apply hooks run before
+// and after, except in dry runs.
+func (w *Workspace) ApplyPackage(ctx context.Context, pkg *Package) (*Result, error) {
+	result := w.start(pkg, -1)
+	log := w.log().With(Fields{"package": pkg.Name})
+	log.Infof("Applying patches to package")
+	started := time.Now()
+	err := w.applyPackage(ctx, pkg, result, log)
+	if err == nil {
+		log.With(Fields{"duration": time.Since(started)}).Infof("Applied patches to package")
+	}
+	return w.finish(result, -1, err)
+}
+
+func (w *Workspace) applyPackage(ctx context.Context, pkg *Package, result *Result, log *Logger) error {
+	if err := checkInterrupted(ctx); err != nil {
+		return err
+	}
+	state, err := w.runState()
+	if err != nil {
+		log.Errorf("%v", err)
+		return err
+	}
+	repoDir, err := w.PackageDir(pkg)
+	if err == nil {
+		log = log.With(Fields{"repo": repoDir})
+		err = w.CheckPackage(pkg)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Refusing to patch package")
+		return err
+	}
+	if !w.DryRun {
+		if err := w.runHooks(ctx, HookPreApply, pkg, repoDir, result, log); err != nil {
+			return err
+		}
+	}
+	for i := range pkg.Patches {
+		if _, err := w.applyPatch(ctx, pkg, i, repoDir, log); err != nil {
+			if err == ErrInterrupted {
+				return err
+			}
+			return fmt.Errorf("Patch %v failed", pkg.Patches[i].Name)
+		}
+	}
+	if w.DryRun {
+		return nil
+	}
+	// Until FinishApply, a run which fails here resumes after the patches
+	// and runs the hook again
+	if err := w.runHooks(ctx, HookPostApply, pkg, repoDir, result, log); err != nil {
+		return err
+	}
+	if err := state.FinishApply(pkg.Name); err != nil {
+		log.Errorf("%v", err)
+		return err
+	}
+	return nil
+}
+
+// Applies one patch of the package, after checking the package and the patch
+func (w *Workspace) Apply(ctx context.Context, pkg *Package, patch *Patch) (*Result, error) {
+	i, err := patchIndex(pkg, patch)
+	if err != nil {
+		return nil, err
+	}
+	log := w.log().With(Fields{"package": pkg.Name})
+	repoDir, err := w.PackageDir(pkg)
+	if err == nil {
+		log = log.With(Fields{"repo": repoDir})
+		err = w.CheckPackage(pkg)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Refusing to patch package")
+		return w.finish(w.start(pkg, i), i, err)
+	}
+	return w.applyPatch(ctx, pkg, i, repoDir, log)
+}
+
+// Applies the i-th patch of the package in repoDir, unless an interrupted run
+// already did, and records it as applied. Dry runs apply it in memory only.
+func (w *Workspace) applyPatch(ctx context.Context, pkg *Package, i int, repoDir string, log *Logger) (*Result, error) {
+	result := w.start(pkg, i)
+	patch := &pkg.Patches[i]
+	if err := checkInterrupted(ctx); err != nil {
+		return w.finish(result, i, err)
+	}
+	state, err := w.runState()
+	if err != nil {
+		return w.finish(result, i, err)
+	}
+	patchName, err := w.PatchFilename(patch)
+	if err != nil {
+		log.Errorf("%v", err)
+		return w.finish(result, i, err)
+	}
+	result.File = patchName
+	log = log.With(Fields{"patch": patchName})
+	if state.PatchApplied(pkg.Name, i, patch.Hash) {
+		log.Infof("Patch was applied by an unfinished run, resuming after it")
+		result.Message = "Applied by an unfinished run"
+		return w.finish(result, i, nil)
+	}
+	log.Infof("Applying patch")
+	err = w.CheckPatch(patch)
+	if err != nil {
+		log.WithError(err).Errorf("Refusing to apply patch")
+		return w.finish(result, i, err)
+	}
+	if w.DryRun {
+		err = w.dryRun(pkg, repoDir).ApplyFile(ctx, patchName, w.ApplyTimeout, log)
+	} else {
+		err = w.git().Apply(ctx, repoDir, patchName, w.ApplyTimeout, log)
+		if err == nil {
+			err = state.ApplyPatch(pkg.Name, i, patch.Hash)
+		}
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Failed to apply patch")
+		return w.finish(result, i, err)
+	}
+	if w.DryRun {
+		log.Infof("Patch applies")
+		return w.finish(result, i, nil)
+	}
+	log.Infof("Applied patch")
+	return w.finish(result, i, nil)
+}
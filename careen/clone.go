@@ -0,0 +1,300 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func IsEmpty(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+func isEmptyOrMissing(name string) (bool, error) {
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return true, nil
+	}
+	return IsEmpty(name)
+}
+
+// Checks that the origin remote of the repo in repoDir is one of urls
+func VerifyRemote(git GitBackend, repoDir string, urls ...string) error {
+	originUrl, err := git.RemoteURL(repoDir, "origin")
+	if err != nil {
+		return err
+	}
+
+	for _, url := range urls {
+		if originUrl == url {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Repository %v has origin %v, expected %v", repoDir, originUrl, strings.Join(urls, " or "))
+}
+
+// Clones the package's repository into repoDir, unless already cloned, and checks out its tag,
+// submodules and LFS objects. The tag's signature is checked against keys before checkout when
+// the package asks.
+// Failed clones and fetches are retried as the workspace's retry policies allow.
+func (w *Workspace) cloneGit(ctx context.Context, pkg *Package, repoDir string, state *RunState, log *Logger) error {
+	repoUrl := RewriteURL(pkg.Repo, w.Rewrites)
+	if repoUrl != pkg.Repo {
+		log.With(Fields{"url": repoUrl, "manifest_url": pkg.Repo}).Infof("Using rewritten repository URL")
+	}
+	log.Debugf("Checking if repository directory is empty")
+	empty, err := isEmptyOrMissing(repoDir)
+	if err != nil {
+		return err
+	} else if empty {
+		log.With(Fields{"url": repoUrl}).Infof("Cloning repository")
+		err = w.Retries.Clone.Do(ctx, log, func() error {
+			return state.fillDir(pkg.Name, repoDir, log, func() error {
+				progress, done := w.transfer(pkg)
+				defer done()
+				return w.git().Clone(ctx, repoUrl, repoDir, progress)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		// Accept clones made before or without the rewrite as well
+		log.Infof("Verifying remote of existing repository")
+		err = VerifyRemote(w.git(), repoDir, repoUrl, pkg.Repo)
+		if err != nil {
+			return err
+		}
+		// Tags added to the repository since it was cloned are fetched
+		if _, err := w.git().ResolveRef(repoDir, pkg.Tag); err != nil {
+			log.With(Fields{"tag": pkg.Tag}).Infof("Tag not found, fetching repository")
+			err = w.Retries.Fetch.Do(ctx, log, func() error {
+				progress, done := w.transfer(pkg)
+				defer done()
+				return w.git().Fetch(ctx, repoDir, "origin", progress)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := checkInterrupted(ctx); err != nil {
+		return err
+	}
+	// Nothing of the tag is checked out unless it is signed as required
+	err = VerifyRevisionSignature(repoDir, pkg.Tag, pkg.VerifySignature, w.Keys, log)
+	if err != nil {
+		return err
+	}
+	log.With(Fields{"tag": pkg.Tag}).Infof("Checking out tag")
+	err = w.git().Checkout(ctx, repoDir, pkg.Tag)
+	if err != nil {
+		return err
+	}
+	commit, err := w.git().ResolveRef(repoDir, "HEAD")
+	if err != nil {
+		return err
+	}
+	log.With(Fields{"tag": pkg.Tag, "commit": commit}).Infof("Checked out tag")
+
+	if pkg.Submodules.Enabled() {
+		progress, done := w.transfer(pkg)
+		err = UpdateSubmodules(ctx, w.git(), repoDir, pkg.Submodules, w.Retries.Fetch, progress, log)
+		done()
+		if err != nil {
+			return err
+		}
+		err = VerifySubmodules(w.git(), repoDir, pkg.Submodules)
+		if err != nil {
+			return err
+		}
+		log.With(Fields{"submodules": pkg.Submodules.String()}).Infof("Checked out submodules")
+	}
+
+	if pkg.Lfs {
+		log.Infof("Fetching LFS objects")
+		_, done := w.transfer(pkg)
+		err = FetchLFSObjects(ctx, w.git(), repoDir, repoUrl, w.Retries.Fetch, log)
+		done()
+		if err != nil {
+			return err
+		}
+		err = VerifyLFSObjects(w.git(), repoDir)
+		if err != nil {
+			return err
+		}
+		log.Infof("Checked out LFS objects")
+	}
+
+	return nil
+}
+
+// Extracts the package's archive into repoDir after verifying its digest, unless already extracted
+func (w *Workspace) cloneArchive(ctx context.Context, pkg *Package, repoDir string, state *RunState, log *Logger) error {
+	log = log.With(Fields{"archive": pkg.Archive.Url})
+	empty, err := isEmptyOrMissing(repoDir)
+	if err != nil {
+		return err
+	} else if !empty {
+		log.Infof("Directory is not empty, not extracting archive")
+		return nil
+	}
+
+	format, err := archiveFormat(pkg.Archive.Url)
+	if err != nil {
+		return err
+	}
+
+	return w.Retries.Download.Do(ctx, log, func() error {
+		return state.fillDir(pkg.Name, repoDir, log, func() error {
+			return w.fetchAndExtractArchive(ctx, pkg, format, repoDir, log)
+		})
+	})
+}
+
+// Downloads the package's archive, checking its digest, and extracts it into repoDir
+func (w *Workspace) fetchAndExtractArchive(ctx context.Context, pkg *Package, format string, repoDir string, log *Logger) error {
+	log.Infof("Fetching archive")
+	_, done := w.transfer(pkg)
+	archivePath, err := fetchArchive(ctx, pkg.Archive)
+	done()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archivePath)
+
+	log.Infof("Extracting archive")
+	err = ExtractArchive(archivePath, format, repoDir, pkg.Archive.StripComponents)
+	if err != nil {
+		return err
+	}
+	log.Infof("Extracted archive")
+
+	return nil
+}
+
+// Copies or symlinks the package's local directory to repoDir, unless already done
+func (w *Workspace) cloneLocal(pkg *Package, repoDir string, state *RunState, log *Logger) error {
+	srcDir, err := filepath.Abs(pkg.Local.Path)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(srcDir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("Local path %v of package %v is not a directory", srcDir, pkg.Name)
+	}
+
+	if info, err := os.Lstat(repoDir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(repoDir)
+		if err != nil {
+			return err
+		}
+		if !pkg.Local.Symlink || target != srcDir {
+			return fmt.Errorf("Directory %v is a symlink to %v, expected the local path %v", repoDir, target, srcDir)
+		}
+		log.With(Fields{"local": srcDir}).Infof("Directory already links to local path")
+		return nil
+	}
+
+	empty, err := isEmptyOrMissing(repoDir)
+	if err != nil {
+		return err
+	} else if !empty {
+		log.With(Fields{"local": srcDir}).Infof("Directory is not empty, not copying local path")
+		return nil
+	}
+
+	if pkg.Local.Symlink {
+		log.With(Fields{"local": srcDir}).Infof("Linking directory to local path")
+		if err := os.RemoveAll(repoDir); err != nil {
+			return err
+		}
+		return os.Symlink(srcDir, repoDir)
+	}
+
+	log.With(Fields{"local": srcDir}).Infof("Copying local path")
+	return state.fillDir(pkg.Name, repoDir, log, func() error {
+		return CopyTree(srcDir, repoDir)
+	})
+}
+
+// Clones, downloads or copies the package into its directory, unless already
+// done, removing what an interrupted run left incomplete first. The pre_clone
+// and post_clone hooks run before and after, even when it was already done.
+func (w *Workspace) Clone(ctx context.Context, pkg *Package) (*Result, error) {
+	result := w.start(pkg, -1)
+	log := w.log().With(Fields{"package": pkg.Name})
+	started := time.Now()
+	err := w.clone(ctx, pkg, result, log)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to clone package")
+	} else {
+		log.With(Fields{"duration": time.Since(started)}).Infof("Cloned package")
+	}
+	return w.finish(result, -1, err)
+}
+
+func (w *Workspace) clone(ctx context.Context, pkg *Package, result *Result, log *Logger) error {
+	if err := checkInterrupted(ctx); err != nil {
+		return err
+	}
+	state, err := w.runState()
+	if err != nil {
+		return err
+	}
+	repoDir, err := w.PackageDir(pkg)
+	if err != nil {
+		return err
+	}
+	log = log.With(Fields{"repo": repoDir, "source": pkg.SourceType()})
+	if state.Cloning(pkg.Name) {
+		log.Warnf("Removing package directory left incomplete by an interrupted run")
+		if err := os.RemoveAll(repoDir); err != nil {
+			return err
+		}
+	}
+	if err := w.runHooks(ctx, HookPreClone, pkg, repoDir, result, log); err != nil {
+		return err
+	}
+	switch pkg.SourceType() {
+	case SourceArchive:
+		err = w.cloneArchive(ctx, pkg, repoDir, state, log)
+	case SourceLocal:
+		err = w.cloneLocal(pkg, repoDir, state, log)
+	default:
+		err = w.cloneGit(ctx, pkg, repoDir, state, log)
+	}
+	if err != nil {
+		return err
+	}
+	return w.runHooks(ctx, HookPostClone, pkg, repoDir, result, log)
+}
@@ -0,0 +1,148 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error of a command which failed, with what it wrote to stdout and stderr
+type CommandError struct {
+	Err    error
+	Output string
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+// Everything a command writes to stdout and stderr, in the order written
+type commandCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *commandCapture) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+// Writer logging each line of one of a command's streams as it is written,
+// and adding it to the capture
+type commandStream struct {
+	log     *Logger
+	level   LogLevel
+	capture *commandCapture
+	partial []byte
+}
+
+func (s *commandStream) Write(p []byte) (int, error) {
+	s.capture.mu.Lock()
+	s.capture.buf.Write(p)
+	s.capture.mu.Unlock()
+
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.logLine(s.partial[:i])
+		s.partial = s.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Logs what is left of an output not ending in a newline
+func (s *commandStream) flush() {
+	if len(s.partial) > 0 {
+		s.logLine(s.partial)
+		s.partial = nil
+	}
+}
+
+func (s *commandStream) logLine(line []byte) {
+	s.log.log(s.level, "%s", strings.TrimRight(string(line), "\r"))
+}
+
+// Runs cmd and kills it, and any processes it started, if timeout is reached
+// or ctx is cancelled. A timeout of zero means no timeout. Each line the
+// command writes is logged with the fields of log, stdout at info and stderr
+// at warn level, and a failed command returns a CommandError. Returns
+// everything it wrote whether it failed or not, naming it description in
+// errors.
+func runCommand(ctx context.Context, log *Logger, cmd *exec.Cmd, description string, timeout time.Duration) (string, error) {
+	cmdLog := log.With(Fields{"command": strings.Join(cmd.Args, " ")})
+	cmdLog.Debugf("Running command")
+	capture := &commandCapture{}
+	stdout := &commandStream{log: log.With(Fields{"stream": "stdout"}), level: LogInfo, capture: capture}
+	stderr := &commandStream{log: log.With(Fields{"stream": "stderr"}), level: LogWarn, capture: capture}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	kill := func() {
+		if killErr := killProcessGroup(cmd); killErr != nil {
+			cmdLog.WithError(killErr).Errorf("Failed to kill command")
+		}
+		<-done
+	}
+
+	select {
+	case <-expired:
+		kill()
+		err = fmt.Errorf("Command %v timed out after %v", description, timeout)
+	case <-ctx.Done():
+		kill()
+		err = ErrInterrupted
+	case err = <-done:
+	}
+	stdout.flush()
+	stderr.flush()
+
+	if err == ErrInterrupted {
+		return capture.String(), err
+	} else if err != nil {
+		cmdLog.WithError(err).Errorf("Command failed")
+		return capture.String(), &CommandError{Err: err, Output: capture.String()}
+	}
+	cmdLog.Debugf("Command completed successfully")
+
+	return capture.String(), nil
+}
@@ -0,0 +1,35 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package careen
+
+import (
+	"os/exec"
+)
+
+// Windows has no process groups to kill, so only the command itself is killed
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// Returns a command running command with cmd.exe
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
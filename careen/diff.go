@@ -0,0 +1,280 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type ManifestDiff struct {
+	AddedPackages   []string      `json:"added_packages"`
+	RemovedPackages []string      `json:"removed_packages"`
+	ChangedPackages []PackageDiff `json:"changed_packages"`
+}
+
+type PackageDiff struct {
+	Name             string        `json:"name"`
+	Fields           []FieldChange `json:"fields,omitempty"`
+	AddedPatches     []string      `json:"added_patches,omitempty"`
+	RemovedPatches   []string      `json:"removed_patches,omitempty"`
+	ChangedPatches   []PatchDiff   `json:"changed_patches,omitempty"`
+	PatchesReordered bool          `json:"patches_reordered,omitempty"`
+}
+
+type PatchDiff struct {
+	Name   string        `json:"name"`
+	Fields []FieldChange `json:"fields"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+func (d *ManifestDiff) Empty() bool {
+	return len(d.AddedPackages) == 0 && len(d.RemovedPackages) == 0 && len(d.ChangedPackages) == 0
+}
+
+func appendFieldChange(changes []FieldChange, field string, old string, new string) []FieldChange {
+	if old == new {
+		return changes
+	}
+	return append(changes, FieldChange{Field: field, Old: old, New: new})
+}
+
+// Compares two manifests by package and patch name
+func DiffManifests(old *Manifest, new *Manifest) *ManifestDiff {
+	diff := &ManifestDiff{
+		AddedPackages:   []string{},
+		RemovedPackages: []string{},
+		ChangedPackages: []PackageDiff{},
+	}
+
+	oldPackages := map[string]Package{}
+	for _, pkg := range old.Packages {
+		oldPackages[pkg.Name] = pkg
+	}
+	newPackages := map[string]Package{}
+	for _, pkg := range new.Packages {
+		newPackages[pkg.Name] = pkg
+	}
+
+	for _, pkg := range old.Packages {
+		if _, ok := newPackages[pkg.Name]; !ok {
+			diff.RemovedPackages = append(diff.RemovedPackages, pkg.Name)
+		}
+	}
+	for _, pkg := range new.Packages {
+		oldPkg, ok := oldPackages[pkg.Name]
+		if !ok {
+			diff.AddedPackages = append(diff.AddedPackages, pkg.Name)
+			continue
+		}
+		if pkgDiff := diffPackages(&oldPkg, &pkg); pkgDiff != nil {
+			diff.ChangedPackages = append(diff.ChangedPackages, *pkgDiff)
+		}
+	}
+
+	return diff
+}
+
+// Returns nil if the packages are the same
+func diffPackages(old *Package, new *Package) *PackageDiff {
+	diff := PackageDiff{Name: new.Name}
+
+	diff.Fields = appendFieldChange(diff.Fields, "repo", old.Repo, new.Repo)
+	diff.Fields = appendFieldChange(diff.Fields, "revision", old.Revision, new.Revision)
+	diff.Fields = appendFieldChange(diff.Fields, "tag", old.Tag, new.Tag)
+	diff.Fields = appendFieldChange(diff.Fields, "submodules", old.Submodules.String(), new.Submodules.String())
+	diff.Fields = appendFieldChange(diff.Fields, "lfs", fmt.Sprint(old.Lfs), fmt.Sprint(new.Lfs))
+	diff.Fields = appendFieldChange(diff.Fields, "verify_signature", old.VerifySignature, new.VerifySignature)
+	diff.Fields = appendFieldChange(diff.Fields, "source", old.SourceType(), new.SourceType())
+	if old.Archive != nil || new.Archive != nil {
+		oldArchive, newArchive := ArchiveSource{}, ArchiveSource{}
+		if old.Archive != nil {
+			oldArchive = *old.Archive
+		}
+		if new.Archive != nil {
+			newArchive = *new.Archive
+		}
+		diff.Fields = appendFieldChange(diff.Fields, "archive.url", oldArchive.Url, newArchive.Url)
+		diff.Fields = appendFieldChange(diff.Fields, "archive.digest", oldArchive.Digest, newArchive.Digest)
+	}
+	if old.Local != nil || new.Local != nil {
+		oldLocal, newLocal := LocalSource{}, LocalSource{}
+		if old.Local != nil {
+			oldLocal = *old.Local
+		}
+		if new.Local != nil {
+			newLocal = *new.Local
+		}
+		diff.Fields = appendFieldChange(diff.Fields, "local.path", oldLocal.Path, newLocal.Path)
+	}
+	diff.Fields = appendFieldChange(diff.Fields, "depends_on",
+		strings.Join(old.DependsOn, ", "), strings.Join(new.DependsOn, ", "))
+	for _, hook := range HookNames {
+		diff.Fields = appendFieldChange(diff.Fields, "hooks."+hook,
+			strings.Join(old.Hooks.Commands(hook), "; "), strings.Join(new.Hooks.Commands(hook), "; "))
+	}
+
+	oldPatches := map[string]Patch{}
+	for _, patch := range old.Patches {
+		oldPatches[patch.Name] = patch
+	}
+	newPatches := map[string]Patch{}
+	for _, patch := range new.Patches {
+		newPatches[patch.Name] = patch
+	}
+
+	// Order of the patches present in both, to detect reordering
+	oldOrder := []string{}
+	for _, patch := range old.Patches {
+		if _, ok := newPatches[patch.Name]; ok {
+			oldOrder = append(oldOrder, patch.Name)
+		} else {
+			diff.RemovedPatches = append(diff.RemovedPatches, patch.Name)
+		}
+	}
+	newOrder := []string{}
+	for _, patch := range new.Patches {
+		oldPatch, ok := oldPatches[patch.Name]
+		if !ok {
+			diff.AddedPatches = append(diff.AddedPatches, patch.Name)
+			continue
+		}
+		newOrder = append(newOrder, patch.Name)
+
+		var fields []FieldChange
+		fields = appendFieldChange(fields, "filename", oldPatch.Filename, patch.Filename)
+		fields = appendFieldChange(fields, "hash", oldPatch.Hash, patch.Hash)
+		if len(fields) > 0 {
+			diff.ChangedPatches = append(diff.ChangedPatches, PatchDiff{Name: patch.Name, Fields: fields})
+		}
+	}
+	for i := range oldOrder {
+		if oldOrder[i] != newOrder[i] {
+			diff.PatchesReordered = true
+			break
+		}
+	}
+
+	if len(diff.Fields) == 0 && len(diff.AddedPatches) == 0 && len(diff.RemovedPatches) == 0 &&
+		len(diff.ChangedPatches) == 0 && !diff.PatchesReordered {
+		return nil
+	}
+	return &diff
+}
+
+// Describes a patch change, calling a change of hash alone a rehash
+func describePatchDiff(patch PatchDiff) string {
+	if len(patch.Fields) == 1 && patch.Fields[0].Field == "hash" {
+		return fmt.Sprintf("rehashed %v -> %v", patch.Fields[0].Old, patch.Fields[0].New)
+	}
+	description := ""
+	for i, field := range patch.Fields {
+		if i > 0 {
+			description += ", "
+		}
+		description += fmt.Sprintf("%v %v -> %v", field.Field, field.Old, field.New)
+	}
+	return description
+}
+
+func (d *ManifestDiff) Text() string {
+	var buf bytes.Buffer
+	if d.Empty() {
+		buf.WriteString("No changes\n")
+		return buf.String()
+	}
+
+	for _, name := range d.AddedPackages {
+		fmt.Fprintf(&buf, "+ package %v\n", name)
+	}
+	for _, name := range d.RemovedPackages {
+		fmt.Fprintf(&buf, "- package %v\n", name)
+	}
+	for _, pkg := range d.ChangedPackages {
+		fmt.Fprintf(&buf, "~ package %v\n", pkg.Name)
+		for _, field := range pkg.Fields {
+			fmt.Fprintf(&buf, "    %v: %v -> %v\n", field.Field, field.Old, field.New)
+		}
+		for _, name := range pkg.AddedPatches {
+			fmt.Fprintf(&buf, "    + patch %q\n", name)
+		}
+		for _, name := range pkg.RemovedPatches {
+			fmt.Fprintf(&buf, "    - patch %q\n", name)
+		}
+		for _, patch := range pkg.ChangedPatches {
+			fmt.Fprintf(&buf, "    ~ patch %q: %v\n", patch.Name, describePatchDiff(patch))
+		}
+		if pkg.PatchesReordered {
+			fmt.Fprintf(&buf, "    ~ patches reordered\n")
+		}
+	}
+	return buf.String()
+}
+
+func (d *ManifestDiff) Markdown() string {
+	var buf bytes.Buffer
+	if d.Empty() {
+		buf.WriteString("No changes\n")
+		return buf.String()
+	}
+
+	if len(d.AddedPackages) > 0 {
+		buf.WriteString("### Added packages\n\n")
+		for _, name := range d.AddedPackages {
+			fmt.Fprintf(&buf, "- `%v`\n", name)
+		}
+		buf.WriteString("\n")
+	}
+	if len(d.RemovedPackages) > 0 {
+		buf.WriteString("### Removed packages\n\n")
+		for _, name := range d.RemovedPackages {
+			fmt.Fprintf(&buf, "- `%v`\n", name)
+		}
+		buf.WriteString("\n")
+	}
+	if len(d.ChangedPackages) > 0 {
+		buf.WriteString("### Changed packages\n\n")
+		for _, pkg := range d.ChangedPackages {
+			fmt.Fprintf(&buf, "#### `%v`\n\n", pkg.Name)
+			if len(pkg.Fields) > 0 {
+				buf.WriteString("| Field | Old | New |\n| --- | --- | --- |\n")
+				for _, field := range pkg.Fields {
+					fmt.Fprintf(&buf, "| %v | `%v` | `%v` |\n", field.Field, field.Old, field.New)
+				}
+				buf.WriteString("\n")
+			}
+			for _, name := range pkg.AddedPatches {
+				fmt.Fprintf(&buf, "- Added patch %v\n", name)
+			}
+			for _, name := range pkg.RemovedPatches {
+				fmt.Fprintf(&buf, "- Removed patch %v\n", name)
+			}
+			for _, patch := range pkg.ChangedPatches {
+				fmt.Fprintf(&buf, "- Changed patch %v: %v\n", patch.Name, describePatchDiff(patch))
+			}
+			if pkg.PatchesReordered {
+				buf.WriteString("- Patches reordered\n")
+			}
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,181 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func testDiffManifests() (*Manifest, *Manifest) {
+	old := &Manifest{Packages: []Package{
+		{Name: "kept", Repo: "https://example.com/kept.git", Revision: "v1"},
+		{Name: "gone", Repo: "https://example.com/gone.git", Revision: "v1"},
+		{
+			Name:     "changed",
+			Repo:     "https://example.com/changed.git",
+			Revision: "v1",
+			Patches: []Patch{
+				{Name: "first", Filename: "patches/first.patch", Hash: "aaa"},
+				{Name: "second", Filename: "patches/second.patch", Hash: "bbb"},
+				{Name: "third", Filename: "patches/third.patch", Hash: "ccc"},
+				{Name: "dropped", Filename: "patches/dropped.patch", Hash: "ddd"},
+			},
+		},
+	}}
+	new := &Manifest{Packages: []Package{
+		{Name: "kept", Repo: "https://example.com/kept.git", Revision: "v1"},
+		{
+			Name:     "changed",
+			Repo:     "https://example.com/changed.git",
+			Revision: "v2",
+			Patches: []Patch{
+				{Name: "second", Filename: "patches/second.patch", Hash: "bbb2"},
+				{Name: "first", Filename: "patches/first.patch", Hash: "aaa"},
+				{Name: "third", Filename: "patches/third-v2.patch", Hash: "ccc2"},
+				{Name: "added", Filename: "patches/added.patch", Hash: "eee"},
+			},
+		},
+		{Name: "new", Repo: "https://example.com/new.git", Revision: "v1"},
+	}}
+	return old, new
+}
+
+func TestManifestDiffText(t *testing.T) {
+	diff := DiffManifests(testDiffManifests())
+
+	want := `+ package new
+- package gone
+~ package changed
+    revision: v1 -> v2
+    + patch "added"
+    - patch "dropped"
+    ~ patch "second": rehashed bbb -> bbb2
+    ~ patch "third": filename patches/third.patch -> patches/third-v2.patch, hash ccc -> ccc2
+    ~ patches reordered
+`
+	if got := diff.Text(); got != want {
+		t.Errorf("Text() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestManifestDiffMarkdown(t *testing.T) {
+	diff := DiffManifests(testDiffManifests())
+
+	want := "### Added packages\n\n" +
+		"- `new`\n\n" +
+		"### Removed packages\n\n" +
+		"- `gone`\n\n" +
+		"### Changed packages\n\n" +
+		"#### `changed`\n\n" +
+		"| Field | Old | New |\n" +
+		"| --- | --- | --- |\n" +
+		"| revision | `v1` | `v2` |\n\n" +
+		"- Added patch added\n" +
+		"- Removed patch dropped\n" +
+		"- Changed patch second: rehashed bbb -> bbb2\n" +
+		"- Changed patch third: filename patches/third.patch -> patches/third-v2.patch, hash ccc -> ccc2\n" +
+		"- Patches reordered\n\n"
+	if got := diff.Markdown(); got != want {
+		t.Errorf("Markdown() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestManifestDiffJSON(t *testing.T) {
+	diff := DiffManifests(testDiffManifests())
+
+	want := `{
+  "added_packages": [
+    "new"
+  ],
+  "removed_packages": [
+    "gone"
+  ],
+  "changed_packages": [
+    {
+      "name": "changed",
+      "fields": [
+        {
+          "field": "revision",
+          "old": "v1",
+          "new": "v2"
+        }
+      ],
+      "added_patches": [
+        "added"
+      ],
+      "removed_patches": [
+        "dropped"
+      ],
+      "changed_patches": [
+        {
+          "name": "second",
+          "fields": [
+            {
+              "field": "hash",
+              "old": "bbb",
+              "new": "bbb2"
+            }
+          ]
+        },
+        {
+          "name": "third",
+          "fields": [
+            {
+              "field": "filename",
+              "old": "patches/third.patch",
+              "new": "patches/third-v2.patch"
+            },
+            {
+              "field": "hash",
+              "old": "ccc",
+              "new": "ccc2"
+            }
+          ]
+        }
+      ],
+      "patches_reordered": true
+    }
+  ]
+}`
+	out, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Errorf("JSON =\n%s\nwant\n%v", out, want)
+	}
+}
+
+func TestManifestDiffNoChanges(t *testing.T) {
+	old, _ := testDiffManifests()
+	diff := DiffManifests(old, old)
+	if !diff.Empty() {
+		t.Fatalf("diff of a manifest with itself is not empty: %+v", diff)
+	}
+	if got := diff.Text(); got != "No changes\n" {
+		t.Errorf("Text() = %q", got)
+	}
+	if got := diff.Markdown(); got != "No changes\n" {
+		t.Errorf("Markdown() = %q", got)
+	}
+	out, err := json.Marshal(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"added_packages":[],"removed_packages":[],"changed_packages":[]}`; string(out) != want {
+		t.Errorf("JSON = %s, want %v", out, want)
+	}
+}
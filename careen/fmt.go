@@ -0,0 +1,325 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Keys which can be written without quotes, including the merge key
+var plainKey = regexp.MustCompile(`^([A-Za-z0-9_][A-Za-z0-9_.-]*|<<)$`)
+
+type manifestFormatter struct {
+	buf          bytes.Buffer
+	sortPackages bool
+}
+
+// Rewrites a YAML manifest in canonical form: keys in the order of the
+// specification, two space indentation, block style collections, and string
+// values in double quotes. Comments are kept with the entry they precede.
+// Packages keep their order unless sortPackages is set.
+func FormatManifest(data []byte, sortPackages bool) ([]byte, error) {
+	doc, err := ParseYAMLDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Root.Kind != yamlMapping {
+		return nil, fmt.Errorf("manifest must be a mapping")
+	}
+
+	f := &manifestFormatter{sortPackages: sortPackages}
+	f.writeDocument(doc, reflect.TypeOf(Manifest{}))
+	formatted := f.buf.Bytes()
+
+	// Formatting must never change what careen reads from the manifest
+	before, after := Manifest{}, Manifest{}
+	if err := yaml.Unmarshal(data, &before); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(formatted, &after); err != nil {
+		return nil, fmt.Errorf("formatted manifest does not parse: %v", err)
+	}
+	if sortPackages {
+		sortPackagesByName(before.Packages)
+	}
+	if !reflect.DeepEqual(before, after) {
+		return nil, fmt.Errorf("formatting would change the meaning of the manifest")
+	}
+
+	return formatted, nil
+}
+
+type packagesByName []Package
+
+func (p packagesByName) Len() int           { return len(p) }
+func (p packagesByName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p packagesByName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func sortPackagesByName(packages []Package) {
+	sort.Stable(packagesByName(packages))
+}
+
+// Sorts entries in place, keeping the order of equal entries. Manifests are
+// small, so an insertion sort is plenty.
+func sortEntriesStable(entries []*yamlEntry, less func(a, b *yamlEntry) bool) {
+	for i := 1; i < len(entries); i++ {
+		for j := i; j > 0 && less(entries[j], entries[j-1]); j-- {
+			entries[j], entries[j-1] = entries[j-1], entries[j]
+		}
+	}
+}
+
+// Writes the document with its comments. Keys are ordered and scalars quoted
+// as the fields of t say, or kept as they are if t is nil.
+func (f *manifestFormatter) writeDocument(doc *yamlDocument, t reflect.Type) {
+	f.writeComments(doc.Preamble, 0)
+	f.buf.WriteString("---\n")
+	f.writeComments(doc.Header, 0)
+	f.writeMapping(doc.Root, t, 0, -1)
+	f.writeComments(doc.Footer, 0)
+}
+
+func (f *manifestFormatter) writeComments(comments []string, indent int) {
+	for _, comment := range comments {
+		fmt.Fprintf(&f.buf, "%v%v\n", strings.Repeat(" ", indent), comment)
+	}
+}
+
+func (f *manifestFormatter) writeTrailing(trailing string) {
+	if trailing != "" {
+		f.buf.WriteString(" " + trailing)
+	}
+	f.buf.WriteString("\n")
+}
+
+// Writes the value following "key:" or "-", either on the same line or as an
+// indented block
+func (f *manifestFormatter) writeValue(value *yamlNode, t reflect.Type, trailing string, indent int) {
+	if value.Props != "" {
+		f.buf.WriteString(" " + value.Props)
+	}
+	switch {
+	case value.Block != nil:
+		f.buf.WriteString(" " + blockScalarHeaderOf(value))
+		f.writeTrailing(trailing)
+		for _, line := range value.Block {
+			if line != "" {
+				f.buf.WriteString(strings.Repeat(" ", indent+2) + line)
+			}
+			f.buf.WriteString("\n")
+		}
+	case value.Kind == yamlScalar:
+		scalar := value.Value
+		// A tag says how to read the scalar, so quoting could change it
+		if !strings.Contains(value.Props, "!") {
+			scalar = formatScalar(value.Value, t)
+		}
+		if scalar != "" {
+			f.buf.WriteString(" " + scalar)
+		}
+		f.writeTrailing(trailing)
+	case len(value.Entries) == 0 && value.Kind == yamlSequence:
+		f.buf.WriteString(" []")
+		f.writeTrailing(trailing)
+	case len(value.Entries) == 0:
+		f.buf.WriteString(" {}")
+		f.writeTrailing(trailing)
+	case value.Kind == yamlSequence:
+		f.writeTrailing(trailing)
+		f.writeSequence(value, t, indent+2)
+	default:
+		f.writeTrailing(trailing)
+		f.writeMapping(value, t, indent+2, -1)
+	}
+}
+
+// Writes a mapping at indent. When it is the value of a sequence item at
+// itemIndent (>= 0), the first entry shares the line of the "-".
+func (f *manifestFormatter) writeMapping(node *yamlNode, t reflect.Type, indent int, itemIndent int) {
+	for i, entry := range orderedEntries(node, t) {
+		f.writeComments(entry.Comments, indent)
+		if i == 0 && itemIndent >= 0 {
+			f.buf.WriteString(strings.Repeat(" ", itemIndent) + "- ")
+		} else {
+			f.buf.WriteString(strings.Repeat(" ", indent))
+		}
+		if plainKey.MatchString(entry.Key) {
+			f.buf.WriteString(entry.Key + ":")
+		} else {
+			f.buf.WriteString(encodeDoubleQuoted(entry.Key) + ":")
+		}
+
+		valueType := fieldType(t, entry.Key)
+		if entry.Key == "packages" && t == reflect.TypeOf(Manifest{}) && f.sortPackages {
+			entry.Value = sortedPackageNodes(entry.Value)
+		}
+		f.writeValue(entry.Value, valueType, entry.Trailing, indent)
+	}
+}
+
+func (f *manifestFormatter) writeSequence(node *yamlNode, t reflect.Type, indent int) {
+	var itemType reflect.Type
+	if t != nil && t.Kind() == reflect.Slice {
+		itemType = t.Elem()
+	} else if t == reflect.TypeOf(Submodules{}) {
+		itemType = reflect.TypeOf("")
+	}
+
+	for _, item := range node.Entries {
+		f.writeComments(item.Comments, indent)
+		if item.Value.Kind == yamlMapping && len(item.Value.Entries) > 0 && item.Trailing == "" && item.Value.Props == "" {
+			f.writeMapping(item.Value, itemType, indent+2, indent)
+			continue
+		}
+		f.buf.WriteString(strings.Repeat(" ", indent) + "-")
+		f.writeValue(item.Value, itemType, item.Trailing, indent)
+	}
+}
+
+// Returns the header of a block scalar written two spaces deeper than its
+// parent. The indentation is only given when the first line starts with a
+// space, which would otherwise be taken as indentation.
+func blockScalarHeaderOf(node *yamlNode) string {
+	header := node.Value[:1]
+	for _, line := range node.Block {
+		if line != "" {
+			if line[0] == ' ' {
+				header += "2"
+			}
+			break
+		}
+	}
+	if chomp := strings.IndexAny(node.Value, "-+"); chomp >= 0 {
+		header += node.Value[chomp : chomp+1]
+	}
+	return header
+}
+
+// Quotes scalars which careen reads as strings. Other scalars, including those
+// of keys careen does not know and aliases, are written as they are.
+func formatScalar(raw string, t reflect.Type) string {
+	if t == nil || t.Kind() != reflect.String || strings.HasPrefix(raw, "*") {
+		return raw
+	}
+	// Errors were reported when the document was parsed
+	value, _ := decodeScalar(raw, 0)
+	if raw == "~" || raw == "null" || raw == "Null" || raw == "NULL" {
+		value = ""
+	}
+	return encodeDoubleQuoted(value)
+}
+
+// Returns the YAML key of each field of a struct, in declaration order
+func yamlFieldNames(t reflect.Type) []string {
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(t.Field(i).Name)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// Returns the Go type careen decodes the value of key into, or nil if unknown
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i, name := range yamlFieldNames(t) {
+			if name == key {
+				return derefType(t.Field(i).Type)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the type optional settings such as *ArchiveSource point to
+func derefType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// Orders struct keys by the struct's fields followed by unknown keys as they
+// were, and map keys alphabetically
+func orderedEntries(node *yamlNode, t reflect.Type) []*yamlEntry {
+	entries := append([]*yamlEntry{}, node.Entries...)
+	if t == nil {
+		return entries
+	}
+
+	switch t.Kind() {
+	case reflect.Map:
+		sortEntriesStable(entries, func(a, b *yamlEntry) bool {
+			return a.Key < b.Key
+		})
+	case reflect.Struct:
+		rank := map[string]int{}
+		for i, name := range yamlFieldNames(t) {
+			rank[name] = i
+		}
+		unknown := len(rank)
+		rankOf := func(entry *yamlEntry) int {
+			if r, ok := rank[entry.Key]; ok {
+				return r
+			}
+			return unknown
+		}
+		sortEntriesStable(entries, func(a, b *yamlEntry) bool {
+			return rankOf(a) < rankOf(b)
+		})
+	}
+	return entries
+}
+
+// Returns a copy of the packages sequence ordered by package name
+func sortedPackageNodes(node *yamlNode) *yamlNode {
+	if node.Kind != yamlSequence {
+		return node
+	}
+
+	name := func(item *yamlEntry) string {
+		for _, entry := range item.Value.Entries {
+			if entry.Key == "name" && entry.Value.Kind == yamlScalar {
+				value, _ := decodeScalar(entry.Value.Value, 0)
+				return value
+			}
+		}
+		return ""
+	}
+
+	sorted := &yamlNode{Kind: yamlSequence, Entries: append([]*yamlEntry{}, node.Entries...)}
+	sortEntriesStable(sorted.Entries, func(a, b *yamlEntry) bool {
+		return name(a) < name(b)
+	})
+	return sorted
+}
@@ -0,0 +1,204 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"github.com/go-yaml/yaml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A manifest whose hooks go-yaml writes as block scalars of every kind
+func blockScalarManifest() *Manifest {
+	return &Manifest{
+		Version: CurrentManifestVersion,
+		Hooks: &Hooks{PostClone: []string{
+			"echo one\necho two\n",
+			"echo clipped\necho stripped",
+			"echo kept\n\n\n",
+			"  indented first\nline\n",
+			"# not a comment\n\n  nested\n",
+		}},
+		Packages: []Package{{
+			Name:  "docker",
+			Repo:  "https://example.com/docker.git",
+			Tag:   "v1.11.2",
+			Hooks: &Hooks{PreApply: []string{"set -e\nmake check\n"}},
+			Patches: []Patch{
+				{Name: "a", Filename: "a.patch", Hash: "1", Documentation: []string{"https://example.com/1"}},
+			},
+		}},
+	}
+}
+
+func TestFormatManifestRoundTripsEncodedManifests(t *testing.T) {
+	manifest := blockScalarManifest()
+	for _, format := range []string{FormatYAML, FormatJSON, FormatTOML} {
+		encoded, err := EncodeManifest(manifest, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ConvertToYAML(encoded, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		formatted, err := FormatManifest(data, false)
+		if err != nil {
+			t.Errorf("%v: %v\n%s", format, err, data)
+			continue
+		}
+
+		decoded := Manifest{}
+		if err := yaml.Unmarshal(formatted, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&decoded, manifest) {
+			t.Errorf("%v: formatted manifest reads as %+v", format, decoded)
+		}
+		again, err := FormatManifest(formatted, false)
+		if err != nil || string(again) != string(formatted) {
+			t.Errorf("%v: formatting again gives %s, %v, want\n%s", format, again, err, formatted)
+		}
+	}
+}
+
+func TestFormatManifestBlockScalars(t *testing.T) {
+	input := `version: "0.0.1"
+hooks:
+  post_clone:
+  - |
+      echo one
+        # indented, not a comment
+
+      echo two
+  - >-
+   folded
+   text
+  pre_apply: [ |+ ]
+packages: []
+`
+	_, err := FormatManifest([]byte(input), false)
+	if err == nil || !strings.Contains(err.Error(), "block scalars must follow a key or '-'") {
+		t.Errorf("block scalar in flow collection: error = %v", err)
+	}
+
+	input = strings.Replace(input, "  pre_apply: [ |+ ]\n", "  pre_apply:\n  - |4+ # kept\n        four\n\n", 1)
+	want := `---
+version: "0.0.1"
+hooks:
+  post_clone:
+    - |
+      echo one
+        # indented, not a comment
+
+      echo two
+    - >-
+      folded
+      text
+  pre_apply:
+    - |2+ # kept
+        four
+
+packages: []
+`
+	formatted, err := FormatManifest([]byte(input), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != want {
+		t.Errorf("formatted:\n%s\nwant:\n%s", formatted, want)
+	}
+}
+
+func TestFormatManifestAnchorsAndFlowCollections(t *testing.T) {
+	input := `version: !!str 0.0.1
+vars: {MIRROR: "https://example.com", "DIR": /src}
+x-defaults: &defaults
+  repo: https://example.com/docker.git
+  tag: v1
+packages:
+  - &docker
+    <<: *defaults
+    name: docker
+    depends_on: [etcd, 'kube-dns']
+    patches: [{name: a, filename: a.patch, hash: "1", documentation: ["https://example.com/1", {}]}]
+  - {name: etcd, repo: *docker, tag: v3, hooks: {post_apply: [echo done, "echo [x]"]}}
+`
+	_, err := FormatManifest([]byte(input), false)
+	if err == nil {
+		t.Fatal("formatted a manifest whose documentation is not a list of strings")
+	}
+
+	input = strings.Replace(input, ", {}]", "]", 1)
+	input = strings.Replace(input, "repo: *docker", `repo: "https://example.com/etcd.git"`, 1)
+	want := `---
+version: !!str 0.0.1
+vars:
+  DIR: "/src"
+  MIRROR: "https://example.com"
+packages:
+  - &docker
+    name: "docker"
+    depends_on:
+      - "etcd"
+      - "kube-dns"
+    patches:
+      - name: "a"
+        filename: "a.patch"
+        hash: "1"
+        documentation:
+          - "https://example.com/1"
+    <<: *defaults
+  - name: "etcd"
+    repo: "https://example.com/etcd.git"
+    tag: "v3"
+    hooks:
+      post_apply:
+        - "echo done"
+        - "echo [x]"
+x-defaults: &defaults
+  repo: https://example.com/docker.git
+  tag: v1
+`
+	formatted, err := FormatManifest([]byte(input), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != want {
+		t.Errorf("formatted:\n%s\nwant:\n%s", formatted, want)
+	}
+}
+
+func TestParseYAMLDocumentErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"a: [b,\n  c]\n", "flow collections must be on one line"},
+		{"a: {b: c]\n", "expected ',' or '}'"},
+		{"a: |\n    b\n  c\n", "block scalar line is less indented than the first"},
+		{"- &x name: a\n", "anchors and tags must be on their own line"},
+		{"&x a: b\n", "keys must be scalars"},
+		{"a: {b: 1, b: 2}\n", `duplicate key "b"`},
+		{"a: |x\n", "invalid block scalar header"},
+	}
+	for _, test := range tests {
+		_, err := ParseYAMLDocument([]byte(test.input))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: error = %v, want %q", test.input, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"github.com/pelletier/go-toml"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// Returns the format of a manifest from its extension, defaulting to YAML
+func ManifestFormatFromFilename(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatYAML
+	}
+}
+
+// Converts a document in format to block style YAML so that all formats
+// share one parser
+func ConvertToYAML(data []byte, format string) ([]byte, error) {
+	switch format {
+	case FormatYAML:
+		return data, nil
+	case FormatJSON:
+		// JSON is YAML already, but in the flow style which migrations,
+		// working on block style documents, cannot read
+		manifest := yaml.MapSlice{}
+		if err := yaml.Unmarshal(data, &manifest); err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(manifest)
+	case FormatTOML:
+		tree, err := toml.Load(string(data))
+		if err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(tree.ToMap())
+	default:
+		return nil, fmt.Errorf("Unknown manifest format %v", format)
+	}
+}
+
+// Encodes the manifest in format
+func EncodeManifest(manifest *Manifest, format string) ([]byte, error) {
+	switch format {
+	case FormatYAML:
+		out, err := yaml.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte("---\n"), out...), nil
+	case FormatJSON:
+		out, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(out, '\n'), nil
+	case FormatTOML:
+		return encodeManifestTOML(manifest), nil
+	default:
+		return nil, fmt.Errorf("Unknown manifest format %v", format)
+	}
+}
+
+// go-toml cannot encode arrays of tables in a stable order, so manifests are
+// written by hand in the same key order as the YAML.
+func encodeManifestTOML(manifest *Manifest) []byte {
+	var buf bytes.Buffer
+
+	writeTOMLString(&buf, "version", manifest.Version)
+	if len(manifest.Include) > 0 {
+		writeTOMLStrings(&buf, "include", manifest.Include)
+	}
+	if len(manifest.Vars) > 0 {
+		buf.WriteString("\n[vars]\n")
+		names := []string{}
+		for name := range manifest.Vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writeTOMLString(&buf, name, manifest.Vars[name])
+		}
+	}
+	if manifest.Hooks != nil {
+		buf.WriteString("\n[hooks]\n")
+		writeTOMLHooks(&buf, manifest.Hooks)
+	}
+
+	for _, pkg := range manifest.Packages {
+		buf.WriteString("\n[[packages]]\n")
+		writeTOMLString(&buf, "name", pkg.Name)
+		if pkg.Repo != "" {
+			writeTOMLString(&buf, "repo", pkg.Repo)
+		}
+		if pkg.Revision != "" {
+			writeTOMLString(&buf, "revision", pkg.Revision)
+		}
+		if pkg.Tag != "" {
+			writeTOMLString(&buf, "tag", pkg.Tag)
+		}
+		if pkg.Submodules != nil {
+			if pkg.Submodules.Mode != "" {
+				writeTOMLString(&buf, "submodules", pkg.Submodules.Mode)
+			} else {
+				writeTOMLStrings(&buf, "submodules", pkg.Submodules.Paths)
+			}
+		}
+		if pkg.Lfs {
+			buf.WriteString("lfs = true\n")
+		}
+		if pkg.VerifySignature != "" {
+			writeTOMLString(&buf, "verify_signature", pkg.VerifySignature)
+		}
+		if pkg.Source != "" {
+			writeTOMLString(&buf, "source", pkg.Source)
+		}
+		if len(pkg.DependsOn) > 0 {
+			writeTOMLStrings(&buf, "depends_on", pkg.DependsOn)
+		}
+		if pkg.Archive != nil {
+			buf.WriteString("\n[packages.archive]\n")
+			writeTOMLString(&buf, "url", pkg.Archive.Url)
+			writeTOMLString(&buf, "digest", pkg.Archive.Digest)
+			if pkg.Archive.StripComponents != 0 {
+				fmt.Fprintf(&buf, "strip_components = %v\n", pkg.Archive.StripComponents)
+			}
+		}
+		if pkg.Local != nil {
+			buf.WriteString("\n[packages.local]\n")
+			writeTOMLString(&buf, "path", pkg.Local.Path)
+			if pkg.Local.Symlink {
+				buf.WriteString("symlink = true\n")
+			}
+		}
+		if pkg.Hooks != nil {
+			buf.WriteString("\n[packages.hooks]\n")
+			writeTOMLHooks(&buf, pkg.Hooks)
+		}
+		for _, patch := range pkg.Patches {
+			buf.WriteString("\n[[packages.patches]]\n")
+			writeTOMLString(&buf, "name", patch.Name)
+			writeTOMLString(&buf, "filename", patch.Filename)
+			writeTOMLString(&buf, "hash", patch.Hash)
+			if len(patch.Documentation) > 0 {
+				writeTOMLStrings(&buf, "documentation", patch.Documentation)
+			}
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func writeTOMLHooks(buf *bytes.Buffer, hooks *Hooks) {
+	for _, hook := range HookNames {
+		if commands := hooks.Commands(hook); len(commands) > 0 {
+			writeTOMLStrings(buf, hook, commands)
+		}
+	}
+}
+
+func writeTOMLString(buf *bytes.Buffer, key string, value string) {
+	fmt.Fprintf(buf, "%v = %v\n", tomlKey(key), tomlString(value))
+}
+
+func writeTOMLStrings(buf *bytes.Buffer, key string, values []string) {
+	quoted := []string{}
+	for _, value := range values {
+		quoted = append(quoted, tomlString(value))
+	}
+	fmt.Fprintf(buf, "%v = [%v]\n", tomlKey(key), strings.Join(quoted, ", "))
+}
+
+// Quotes keys which are not valid TOML bare keys
+func tomlKey(key string) string {
+	if key == "" {
+		return tomlString(key)
+	}
+	for _, r := range key {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return tomlString(key)
+		}
+	}
+	return key
+}
+
+func tomlString(value string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&buf, `\u%04X`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
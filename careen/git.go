@@ -0,0 +1,108 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Called with the objects received so far and the total, which is 0 until known
+type ProgressFunc func(current uint64, total uint64)
+
+// The git operations careen makes on repositories, so that careen can be
+// built with libgit2 or without it, using go-git or the git command instead
+type GitBackend interface {
+	// Clones the repository at url into the empty or missing directory dir
+	Clone(ctx context.Context, url string, dir string, progress ProgressFunc) error
+	// Fetches the branches and tags of remote into the repository in repoDir
+	Fetch(ctx context.Context, repoDir string, remote string, progress ProgressFunc) error
+	// Detaches HEAD at ref and checks it out, keeping local changes to files
+	// which ref does not change
+	Checkout(ctx context.Context, repoDir string, ref string) error
+	// Returns the id of the commit ref names
+	ResolveRef(repoDir string, ref string) (string, error)
+	RemoteURL(repoDir string, remote string) (string, error)
+	// Applies the patch file patchPath to the working tree, giving up after
+	// timeout if not zero
+	Apply(ctx context.Context, repoDir string, patchPath string, timeout time.Duration, log *Logger) error
+	// Commits every change to the working tree on top of HEAD, returning the
+	// id of the new commit
+	Commit(ctx context.Context, repoDir string, message string) (string, error)
+
+	// Returns the paths of the submodules listed in the checked out .gitmodules
+	SubmodulePaths(repoDir string) ([]string, error)
+	// Initializes the submodule at path if needed and checks out the commit
+	// the repository's index records for it
+	UpdateSubmodule(ctx context.Context, repoDir string, path string, progress ProgressFunc) error
+	// Returns the directory holding the git data of the submodule at path,
+	// which an update clones into
+	SubmoduleGitDir(repoDir string, path string) (string, error)
+	// Returns the commit HEAD records for the submodule at path and the
+	// commit checked out in it, either empty if there is none
+	SubmoduleCommits(repoDir string, path string) (recorded string, checkedOut string, err error)
+
+	// Returns the contents of the files in the tree of HEAD which are no
+	// larger than maxSize, keyed by slash separated path. Symlinks and
+	// submodules are skipped.
+	SmallBlobs(repoDir string, maxSize uint64) (map[string][]byte, error)
+}
+
+const (
+	GitBackendLibgit2 = "libgit2"
+	GitBackendGoGit   = "go-git"
+	GitBackendCLI     = "cli"
+)
+
+// Backends careen was built with, by name. libgit2 is left out of builds
+// with the nolibgit2 tag.
+var gitBackends = map[string]func() GitBackend{
+	GitBackendGoGit: func() GitBackend { return &goGitBackend{} },
+	GitBackendCLI:   func() GitBackend { return &cliGitBackend{} },
+}
+
+// Returns the names of the backends careen was built with
+func GitBackendNames() []string {
+	names := []string{}
+	for name := range gitBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the libgit2 backend if careen was built with it, else go-git, which
+// needs neither libgit2 nor the git command
+func DefaultGitBackendName() string {
+	if _, ok := gitBackends[GitBackendLibgit2]; ok {
+		return GitBackendLibgit2
+	}
+	return GitBackendGoGit
+}
+
+// Returns the backend named name, or the default one if name is empty
+func NewGitBackend(name string) (GitBackend, error) {
+	if name == "" {
+		name = DefaultGitBackendName()
+	}
+	newBackend, ok := gitBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown git backend %q, expected %v", name, strings.Join(GitBackendNames(), " or "))
+	}
+	return newBackend(), nil
+}
@@ -0,0 +1,390 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Identity of commits made where git has no user configured
+const (
+	defaultCommitName  = "careen"
+	defaultCommitEmail = "careen@localhost"
+)
+
+// Git backend running the git command, which needs no libgit2
+type cliGitBackend struct{}
+
+// Progress git reports on stderr while receiving objects
+var gitReceivingProgress = regexp.MustCompile(`Receiving objects:\s+\d+% \((\d+)/(\d+)\)`)
+
+// Writer passing the object counts of the progress lines git writes, which
+// end in carriage returns, to progress, and keeping the other lines
+type gitProgressWriter struct {
+	progress ProgressFunc
+	partial  []byte
+	lines    bytes.Buffer
+}
+
+func (w *gitProgressWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexAny(w.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		line := w.partial[:i]
+		if m := gitReceivingProgress.FindSubmatch(line); m != nil {
+			if w.progress != nil {
+				current, _ := strconv.ParseUint(string(m[1]), 10, 64)
+				total, _ := strconv.ParseUint(string(m[2]), 10, 64)
+				w.progress(current, total)
+			}
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			w.lines.Write(line)
+			w.lines.WriteByte('\n')
+		}
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Error of a git command which failed, with what it wrote to stderr
+type gitCommandError struct {
+	Command string
+	Status  int // Exit status, -1 if unknown
+	Output  string
+}
+
+func (e *gitCommandError) Error() string {
+	return fmt.Sprintf("git %v failed with exit status %v: %v", e.Command, e.Status, e.Output)
+}
+
+// Returns the exit status of the git which failed with err, or -1
+func gitExitStatus(err error) int {
+	if gitErr, ok := err.(*gitCommandError); ok {
+		return gitErr.Status
+	}
+	return -1
+}
+
+// Runs git with args in dir, feeding it stdin if not nil, and returns what it
+// writes to stdout. git is killed once ctx is cancelled. A failed git returns
+// a gitCommandError with what it wrote to stderr. If progress is not nil, git
+// is asked for progress, which is passed to progress, and --quiet, which
+// would silence it, is dropped.
+func runGit(ctx context.Context, dir string, stdin io.Reader, progress ProgressFunc, args ...string) ([]byte, error) {
+	if progress != nil {
+		progressArgs := []string{args[0], "--progress"}
+		for _, arg := range args[1:] {
+			if arg != "--quiet" {
+				progressArgs = append(progressArgs, arg)
+			}
+		}
+		args = progressArgs
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// Fail rather than wait for credentials no one will type
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdin = stdin
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stderr := &gitProgressWriter{progress: progress}
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return nil, ErrInterrupted
+	case err = <-done:
+	}
+	stderr.Write([]byte{'\n'})
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status := -1
+		if waitStatus, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			status = waitStatus.ExitStatus()
+		}
+		return nil, &gitCommandError{Command: args[0], Status: status, Output: strings.TrimSpace(stderr.lines.String())}
+	} else if err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// Returns the retry class of a failed git command from what it reported, see
+// retryableClass
+func cliGitErrorClass(err error) string {
+	gitErr, ok := err.(*gitCommandError)
+	if !ok {
+		return ""
+	}
+	output := strings.ToLower(gitErr.Output)
+	switch {
+	case strings.Contains(output, "timed out"):
+		return RetryTimeout
+	case strings.Contains(output, "returned error: 5"), strings.Contains(output, "returned error: 429"):
+		return RetryServer
+	case strings.Contains(output, "could not resolve host"),
+		strings.Contains(output, "connection refused"),
+		strings.Contains(output, "connection reset"),
+		strings.Contains(output, "early eof"),
+		strings.Contains(output, "the remote end hung up unexpectedly"):
+		return RetryNetwork
+	}
+	return ""
+}
+
+func (b *cliGitBackend) Clone(ctx context.Context, url string, dir string, progress ProgressFunc) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	_, err = runGit(ctx, "", nil, progress, "clone", "--quiet", "--", url, absDir)
+	return err
+}
+
+func (b *cliGitBackend) Fetch(ctx context.Context, repoDir string, remote string, progress ProgressFunc) error {
+	_, err := runGit(ctx, repoDir, nil, progress, "fetch", "--quiet", "--tags", remote)
+	return err
+}
+
+// git checkout keeps local changes, such as applied patches, to files the ref
+// does not change, as does the libgit2 backend
+func (b *cliGitBackend) Checkout(ctx context.Context, repoDir string, ref string) error {
+	commit, err := b.ResolveRef(repoDir, ref)
+	if err != nil {
+		return err
+	}
+	_, err = runGit(ctx, repoDir, nil, nil, "checkout", "--quiet", "--detach", commit)
+	return err
+}
+
+func (b *cliGitBackend) ResolveRef(repoDir string, ref string) (string, error) {
+	out, err := runGit(context.Background(), repoDir, nil, nil, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if gitExitStatus(err) == 1 {
+		return "", fmt.Errorf("Reference %v not found in repository %v", ref, repoDir)
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (b *cliGitBackend) RemoteURL(repoDir string, remote string) (string, error) {
+	out, err := runGit(context.Background(), repoDir, nil, nil, "config", "--get", "remote."+remote+".url")
+	if gitExitStatus(err) == 1 {
+		return "", fmt.Errorf("Remote %v not found in repository %v", remote, repoDir)
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (b *cliGitBackend) Apply(ctx context.Context, repoDir string, patchPath string, timeout time.Duration, log *Logger) error {
+	return ApplyPatchFile(ctx, repoDir, patchPath, timeout, log)
+}
+
+func (b *cliGitBackend) Commit(ctx context.Context, repoDir string, message string) (string, error) {
+	if _, err := runGit(ctx, repoDir, nil, nil, "add", "--all"); err != nil {
+		return "", err
+	}
+	args := []string{"commit", "--quiet", "--no-verify", "--allow-empty", "--message", message}
+	if _, err := runGit(ctx, repoDir, nil, nil, "var", "GIT_COMMITTER_IDENT"); err != nil {
+		args = append([]string{"-c", "user.name=" + defaultCommitName, "-c", "user.email=" + defaultCommitEmail}, args...)
+	}
+	if _, err := runGit(ctx, repoDir, nil, nil, args...); err != nil {
+		return "", err
+	}
+	return b.ResolveRef(repoDir, "HEAD")
+}
+
+// Returns the paths of the submodules in the checked out .gitmodules, keyed by
+// the names git keeps their data under
+func (b *cliGitBackend) submodules(repoDir string) (map[string]string, error) {
+	if _, err := os.Stat(filepath.Join(repoDir, ".gitmodules")); os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	out, err := runGit(context.Background(), repoDir, nil, nil, "config", "--file", ".gitmodules", "--get-regexp", `^submodule\..*\.path$`)
+	if gitExitStatus(err) == 1 {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	submodules := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(fields[0], "submodule."), ".path")
+		submodules[name] = fields[1]
+	}
+	return submodules, scanner.Err()
+}
+
+func (b *cliGitBackend) SubmodulePaths(repoDir string) ([]string, error) {
+	submodules, err := b.submodules(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, path := range submodules {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (b *cliGitBackend) UpdateSubmodule(ctx context.Context, repoDir string, path string, progress ProgressFunc) error {
+	_, err := runGit(ctx, repoDir, nil, nil, "submodule", "update", "--init", "--quiet", "--", path)
+	return err
+}
+
+func (b *cliGitBackend) SubmoduleGitDir(repoDir string, path string) (string, error) {
+	submodules, err := b.submodules(repoDir)
+	if err != nil {
+		return "", err
+	}
+	for name, subPath := range submodules {
+		if subPath != path {
+			continue
+		}
+		out, err := runGit(context.Background(), repoDir, nil, nil, "rev-parse", "--git-dir")
+		if err != nil {
+			return "", err
+		}
+		gitDir := strings.TrimSpace(string(out))
+		if !filepath.IsAbs(gitDir) {
+			gitDir = filepath.Join(repoDir, gitDir)
+		}
+		return filepath.Join(gitDir, "modules", name), nil
+	}
+	return "", fmt.Errorf("No submodule at path %v in repository %v", path, repoDir)
+}
+
+func (b *cliGitBackend) SubmoduleCommits(repoDir string, path string) (recorded string, checkedOut string, err error) {
+	out, err := runGit(context.Background(), repoDir, nil, nil, "ls-tree", "-z", "HEAD", "--", path)
+	if err != nil {
+		return "", "", err
+	}
+	// <mode> SP commit SP <id> TAB <path> NUL
+	fields := strings.Fields(strings.SplitN(string(out), "\t", 2)[0])
+	if len(fields) == 3 && fields[1] == "commit" {
+		recorded = fields[2]
+	}
+
+	// Without a .git of its own, git would report the commit of the
+	// repository around the submodule
+	subDir := filepath.Join(repoDir, path)
+	if _, err := os.Lstat(filepath.Join(subDir, ".git")); os.IsNotExist(err) {
+		return recorded, "", nil
+	}
+	out, err = runGit(context.Background(), subDir, nil, nil, "rev-parse", "--verify", "--quiet", "HEAD")
+	if gitExitStatus(err) == 1 {
+		return recorded, "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	return recorded, strings.TrimSpace(string(out)), nil
+}
+
+func (b *cliGitBackend) SmallBlobs(repoDir string, maxSize uint64) (map[string][]byte, error) {
+	out, err := runGit(context.Background(), repoDir, nil, nil, "ls-tree", "-r", "-l", "-z", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each entry is <mode> SP <type> SP <id> SP+ <size> TAB <path> NUL
+	ids := []string{}
+	paths := map[string][]string{}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		parts := strings.SplitN(entry, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		if len(fields) != 4 || fields[1] != "blob" || fields[0] == symlinkMode {
+			continue
+		}
+		size, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil || size > maxSize {
+			continue
+		}
+		if _, ok := paths[fields[2]]; !ok {
+			ids = append(ids, fields[2])
+		}
+		paths[fields[2]] = append(paths[fields[2]], parts[1])
+	}
+
+	blobs := map[string][]byte{}
+	if len(ids) == 0 {
+		return blobs, nil
+	}
+	out, err = runGit(context.Background(), repoDir, strings.NewReader(strings.Join(ids, "\n")+"\n"), nil, "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each object is <id> SP <type> SP <size> LF <contents> LF
+	reader := bufio.NewReader(bytes.NewReader(out))
+	for range ids {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Unexpected git cat-file output %q", header)
+		}
+		size, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		contents := make([]byte, size+1)
+		if _, err := io.ReadFull(reader, contents); err != nil {
+			return nil, err
+		}
+		for _, path := range paths[fields[0]] {
+			blobs[path] = contents[:size]
+		}
+	}
+	return blobs, nil
+}
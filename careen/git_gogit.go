@@ -0,0 +1,349 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+func init() {
+	gitErrorClassifiers = append(gitErrorClassifiers, goGitErrorClass)
+	// go-git runs git-upload-pack for repositories on disk, so they are served
+	// in-process instead, as they are without git installed
+	client.InstallProtocol("file", server.NewServer(localRepoLoader{}))
+}
+
+// Git backend using go-git, which is written in Go and needs neither libgit2
+// nor the git command. It reports no transfer progress.
+type goGitBackend struct{}
+
+// Finds repositories on disk by path, whether bare or with a working tree
+type localRepoLoader struct{}
+
+func (localRepoLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	for _, dir := range []string{filepath.Join(ep.Path, ".git"), ep.Path} {
+		if info, err := os.Stat(filepath.Join(dir, "config")); err == nil && !info.IsDir() {
+			return filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault()), nil
+		}
+	}
+	return nil, transport.ErrRepositoryNotFound
+}
+
+// Returns the retry class of a go-git error, see retryableClass. go-git wraps
+// the errors of HTTP requests, and reports unexpected statuses as errors of
+// their own.
+func goGitErrorClass(err error) string {
+	switch e := err.(type) {
+	case *plumbing.UnexpectedError:
+		return retryableClass(e.Err)
+	case *githttp.Err:
+		if e.StatusCode() >= 500 || e.StatusCode() == 429 {
+			return RetryServer
+		}
+	}
+	return ""
+}
+
+func (b *goGitBackend) Clone(ctx context.Context, url string, dir string, progress ProgressFunc) error {
+	_, err := git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{URL: url, Tags: git.AllTags})
+	return interruptedError(ctx, err)
+}
+
+func (b *goGitBackend) Fetch(ctx context.Context, repoDir string, remote string, progress ProgressFunc) error {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return err
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{RemoteName: remote, Tags: git.AllTags})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return interruptedError(ctx, err)
+}
+
+// go-git cannot keep local changes across a checkout, so a repository with
+// any is only accepted if ref is already checked out
+func (b *goGitBackend) Checkout(ctx context.Context, repoDir string, ref string) error {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return err
+	}
+	commit, err := b.resolve(repo, repoDir, ref)
+	if err != nil {
+		return err
+	}
+	if head, err := repo.Head(); err == nil && head.Hash() == commit && head.Name() == plumbing.HEAD {
+		return nil
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+	if !status.IsClean() {
+		return fmt.Errorf("Repository %v has local changes, which the go-git backend cannot keep when checking out %v", repoDir, ref)
+	}
+	return worktree.Checkout(&git.CheckoutOptions{Hash: commit})
+}
+
+// Returns the commit ref names, peeling tags
+func (b *goGitBackend) resolve(repo *git.Repository, repoDir string, ref string) (plumbing.Hash, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err == plumbing.ErrReferenceNotFound || err == plumbing.ErrObjectNotFound {
+		return plumbing.ZeroHash, fmt.Errorf("Reference %v not found in repository %v", ref, repoDir)
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return *hash, nil
+}
+
+func (b *goGitBackend) ResolveRef(repoDir string, ref string) (string, error) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return "", err
+	}
+	commit, err := b.resolve(repo, repoDir, ref)
+	if err != nil {
+		return "", err
+	}
+	return commit.String(), nil
+}
+
+func (b *goGitBackend) RemoteURL(repoDir string, remote string) (string, error) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return "", err
+	}
+	r, err := repo.Remote(remote)
+	if err == git.ErrRemoteNotFound {
+		return "", fmt.Errorf("Remote %v not found in repository %v", remote, repoDir)
+	} else if err != nil {
+		return "", err
+	}
+	if urls := r.Config().URLs; len(urls) > 0 {
+		return urls[0], nil
+	}
+	return "", nil
+}
+
+func (b *goGitBackend) Apply(ctx context.Context, repoDir string, patchPath string, timeout time.Duration, log *Logger) error {
+	return ApplyPatchFile(ctx, repoDir, patchPath, timeout, log)
+}
+
+// Returns the identity configured in the repository, or careen's own
+func goGitSignature(repo *git.Repository) *object.Signature {
+	sig := &object.Signature{Name: defaultCommitName, Email: defaultCommitEmail, When: time.Now()}
+	cfg, err := repo.Config()
+	if err != nil {
+		return sig
+	}
+	user := cfg.Raw.Section("user")
+	if name := user.Option("name"); name != "" {
+		sig.Name = name
+	}
+	if email := user.Option("email"); email != "" {
+		sig.Email = email
+	}
+	return sig
+}
+
+func (b *goGitBackend) Commit(ctx context.Context, repoDir string, message string) (string, error) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return "", err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	// Commit's All option stages changed and deleted files, not new ones
+	status, err := worktree.Status()
+	if err != nil {
+		return "", err
+	}
+	for path, fileStatus := range status {
+		if fileStatus.Worktree == git.Untracked {
+			if _, err := worktree.Add(path); err != nil {
+				return "", err
+			}
+		}
+	}
+	sig := goGitSignature(repo)
+	hash, err := worktree.Commit(message, &git.CommitOptions{All: true, Author: sig, Committer: sig})
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// Returns the submodule at path in the repository's checked out .gitmodules
+func (b *goGitBackend) submodule(repo *git.Repository, repoDir string, path string) (*git.Submodule, error) {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	submodules, err := worktree.Submodules()
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range submodules {
+		if sub.Config().Path == path {
+			return sub, nil
+		}
+	}
+	return nil, fmt.Errorf("No submodule at path %v in repository %v", path, repoDir)
+}
+
+func (b *goGitBackend) SubmodulePaths(repoDir string) ([]string, error) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	submodules, err := worktree.Submodules()
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, sub := range submodules {
+		paths = append(paths, sub.Config().Path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (b *goGitBackend) UpdateSubmodule(ctx context.Context, repoDir string, path string, progress ProgressFunc) error {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return err
+	}
+	sub, err := b.submodule(repo, repoDir, path)
+	if err != nil {
+		return err
+	}
+	return interruptedError(ctx, sub.UpdateContext(ctx, &git.SubmoduleUpdateOptions{Init: true}))
+}
+
+func (b *goGitBackend) SubmoduleGitDir(repoDir string, path string) (string, error) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return "", err
+	}
+	sub, err := b.submodule(repo, repoDir, path)
+	if err != nil {
+		return "", err
+	}
+	storage, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return "", fmt.Errorf("Repository %v is not stored on disk", repoDir)
+	}
+	return filepath.Join(storage.Filesystem().Root(), "modules", sub.Config().Name), nil
+}
+
+func (b *goGitBackend) SubmoduleCommits(repoDir string, path string) (recorded string, checkedOut string, err error) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return "", "", err
+	}
+	tree, err := b.headTree(repo)
+	if err != nil {
+		return "", "", err
+	}
+	entry, err := tree.FindEntry(filepath.ToSlash(path))
+	if err == nil && entry.Mode == filemode.Submodule {
+		recorded = entry.Hash.String()
+	} else if err != nil && err != object.ErrEntryNotFound && err != object.ErrDirectoryNotFound {
+		return "", "", err
+	}
+
+	subRepo, err := git.PlainOpen(filepath.Join(repoDir, path))
+	if err == git.ErrRepositoryNotExists {
+		return recorded, "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	head, err := subRepo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return recorded, "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	return recorded, head.Hash().String(), nil
+}
+
+func (b *goGitBackend) headTree(repo *git.Repository) (*object.Tree, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+func (b *goGitBackend) SmallBlobs(repoDir string, maxSize uint64) (map[string][]byte, error) {
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := b.headTree(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := map[string][]byte{}
+	// Files skips submodules, which have no blob
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if file.Mode == filemode.Symlink || uint64(file.Size) > maxSize {
+			return nil
+		}
+		contents, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		blobs[file.Name] = []byte(contents)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
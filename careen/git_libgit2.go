@@ -0,0 +1,352 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nolibgit2
+// +build !nolibgit2
+
+package careen
+
+/* For instructions on installing git2go see:
+   http://www.petethompson.net/blog/golang/2015/10/04/getting-going-with-git2go/
+*/
+
+import (
+	"context"
+	"github.com/libgit2/git2go"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	gitBackends[GitBackendLibgit2] = func() GitBackend { return &libgit2Backend{} }
+	gitErrorClassifiers = append(gitErrorClassifiers, libgit2ErrorClass)
+}
+
+// Git backend using libgit2 through git2go. Patches are applied by careen
+// itself, as with every backend.
+type libgit2Backend struct{}
+
+// Fetch options which report the objects received to progress, if not nil,
+// and abort the transfer once ctx is cancelled
+func gitFetchOptions(ctx context.Context, progress ProgressFunc) *git.FetchOptions {
+	return &git.FetchOptions{
+		RemoteCallbacks: git.RemoteCallbacks{
+			TransferProgressCallback: func(stats git.TransferProgress) git.ErrorCode {
+				if ctx.Err() != nil {
+					return git.ErrUser
+				}
+				if progress != nil {
+					progress(uint64(stats.ReceivedObjects), uint64(stats.TotalObjects))
+				}
+				return git.ErrOk
+			},
+		},
+	}
+}
+
+func (b *libgit2Backend) Clone(ctx context.Context, url string, dir string, progress ProgressFunc) error {
+	repo, err := git.Clone(url, dir, &git.CloneOptions{FetchOptions: gitFetchOptions(ctx, progress)})
+	if err != nil {
+		return interruptedError(ctx, err)
+	}
+	repo.Free()
+	return nil
+}
+
+func (b *libgit2Backend) Fetch(ctx context.Context, repoDir string, remote string, progress ProgressFunc) error {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	r, err := repo.Remotes.Lookup(remote)
+	if err != nil {
+		return err
+	}
+	defer r.Free()
+
+	opts := gitFetchOptions(ctx, progress)
+	opts.DownloadTags = git.DownloadTagsAll
+	return interruptedError(ctx, r.Fetch(nil, opts, ""))
+}
+
+// Returns the retry class of a libgit2 error, see retryableClass. libgit2
+// reports HTTP statuses and timeouts in the messages of network errors only.
+func libgit2ErrorClass(err error) string {
+	gitErr, ok := err.(*git.GitError)
+	if !ok || (gitErr.Class != git.ErrClassNet && gitErr.Class != git.ErrClassSsh) {
+		return ""
+	}
+	message := strings.ToLower(gitErr.Message)
+	switch {
+	case strings.Contains(message, "timed out"):
+		return RetryTimeout
+	case strings.Contains(message, "status code: 5"), strings.Contains(message, "status code: 429"):
+		return RetryServer
+	case strings.Contains(message, "status code"):
+		return ""
+	}
+	return RetryNetwork
+}
+
+func (b *libgit2Backend) Checkout(ctx context.Context, repoDir string, ref string) error {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	/* Note DwimReference() was renamed Dwim() and moved from repository.go
+	   to references.go. This can lead to some confusion if you read the
+	   docs and not the code. Beware.
+	*/
+	reference, err := repo.References.Dwim(ref)
+	if err != nil {
+		return err
+	}
+	defer reference.Free()
+
+	if err := repo.SetHeadDetached(reference.Target()); err != nil {
+		return err
+	}
+
+	// Moving HEAD leaves the index and working tree at the commit cloned,
+	// which submodule updates read their commits from. A safe checkout keeps
+	// local changes, such as applied patches, when the ref is unchanged.
+	if err := repo.CheckoutHead(&git.CheckoutOpts{Strategy: git.CheckoutSafe}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *libgit2Backend) ResolveRef(repoDir string, ref string) (string, error) {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Free()
+
+	obj, err := repo.RevparseSingle(ref + "^{commit}")
+	if err != nil {
+		return "", err
+	}
+	defer obj.Free()
+	return obj.Id().String(), nil
+}
+
+func (b *libgit2Backend) RemoteURL(repoDir string, remote string) (string, error) {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Free()
+
+	r, err := repo.Remotes.Lookup(remote)
+	if err != nil {
+		return "", err
+	}
+	defer r.Free()
+
+	return r.Url(), nil
+}
+
+func (b *libgit2Backend) Apply(ctx context.Context, repoDir string, patchPath string, timeout time.Duration, log *Logger) error {
+	return ApplyPatchFile(ctx, repoDir, patchPath, timeout, log)
+}
+
+func (b *libgit2Backend) Commit(ctx context.Context, repoDir string, message string) (string, error) {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Free()
+
+	idx, err := repo.Index()
+	if err != nil {
+		return "", err
+	}
+	defer idx.Free()
+	// AddAll adds new and changed files, UpdateAll removes deleted ones
+	if err := idx.AddAll([]string{}, git.IndexAddDefault, nil); err != nil {
+		return "", err
+	}
+	if err := idx.UpdateAll([]string{}, nil); err != nil {
+		return "", err
+	}
+	if err := idx.Write(); err != nil {
+		return "", err
+	}
+	treeId, err := idx.WriteTree()
+	if err != nil {
+		return "", err
+	}
+	tree, err := repo.LookupTree(treeId)
+	if err != nil {
+		return "", err
+	}
+	defer tree.Free()
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	defer head.Free()
+	parent, err := repo.LookupCommit(head.Target())
+	if err != nil {
+		return "", err
+	}
+	defer parent.Free()
+
+	sig, err := repo.DefaultSignature()
+	if err != nil {
+		sig = &git.Signature{Name: defaultCommitName, Email: defaultCommitEmail, When: time.Now()}
+	}
+	id, err := repo.CreateCommit("HEAD", sig, sig, message, tree, parent)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+func (b *libgit2Backend) SubmodulePaths(repoDir string) ([]string, error) {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	paths := []string{}
+	err = repo.Submodules.Foreach(func(sub *git.Submodule, name string) int {
+		paths = append(paths, sub.Path())
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+func (b *libgit2Backend) UpdateSubmodule(ctx context.Context, repoDir string, path string, progress ProgressFunc) error {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	sub, err := repo.Submodules.Lookup(path)
+	if err != nil {
+		return err
+	}
+
+	err = sub.Update(true, &git.SubmoduleUpdateOptions{
+		CheckoutOpts:          &git.CheckoutOpts{Strategy: git.CheckoutSafe},
+		FetchOptions:          gitFetchOptions(ctx, progress),
+		CloneCheckoutStrategy: git.CheckoutSafe,
+	})
+	return interruptedError(ctx, err)
+}
+
+func (b *libgit2Backend) SubmoduleGitDir(repoDir string, path string) (string, error) {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Free()
+
+	sub, err := repo.Submodules.Lookup(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(repo.Path(), "modules", sub.Name()), nil
+}
+
+func (b *libgit2Backend) SubmoduleCommits(repoDir string, path string) (recorded string, checkedOut string, err error) {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return "", "", err
+	}
+	defer repo.Free()
+
+	sub, err := repo.Submodules.Lookup(path)
+	if err != nil {
+		return "", "", err
+	}
+	if id := sub.HeadId(); id != nil {
+		recorded = id.String()
+	}
+	if id := sub.WdId(); id != nil {
+		checkedOut = id.String()
+	}
+	return recorded, checkedOut, nil
+}
+
+func (b *libgit2Backend) SmallBlobs(repoDir string, maxSize uint64) (map[string][]byte, error) {
+	repo, err := git.OpenRepository(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	obj, err := repo.RevparseSingle("HEAD^{tree}")
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Free()
+	tree, err := obj.AsTree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	odb, err := repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	defer odb.Free()
+
+	blobs := map[string][]byte{}
+	var walkErr error
+	err = tree.Walk(func(root string, entry *git.TreeEntry) int {
+		if entry.Type != git.ObjectBlob || entry.Filemode == git.FilemodeLink {
+			return 0
+		}
+		// Reading the header alone avoids loading large files
+		size, _, err := odb.ReadHeader(entry.Id)
+		if err != nil {
+			walkErr = err
+			return -1
+		}
+		if size > maxSize {
+			return 0
+		}
+		blob, err := repo.LookupBlob(entry.Id)
+		if err != nil {
+			walkErr = err
+			return -1
+		}
+		blobs[root+entry.Name] = append([]byte{}, blob.Contents()...)
+		blob.Free()
+		return 0
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
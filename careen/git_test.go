@@ -0,0 +1,115 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGitBackends(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	for _, name := range []string{GitBackendCLI, GitBackendGoGit} {
+		git, err := NewGitBackend(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) { testGitBackend(t, git) })
+	}
+}
+
+func testGitBackend(t *testing.T, git GitBackend) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	upstreamDir := filepath.Join(dir, "upstream")
+	v1 := makeTestRepo(t, upstreamDir, MemoryTree{
+		"small.txt": textFile("small\n"),
+		"large.txt": textFile(strings.Repeat("large\n", 100)),
+	})
+	runTestGit(t, upstreamDir, "-c", "user.name=careen", "-c", "user.email=careen@example.com", "tag", "-a", "-m", "v1", "v1")
+
+	repoDir := filepath.Join(dir, "work")
+	if err := git.Clone(ctx, upstreamDir, repoDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if url, err := git.RemoteURL(repoDir, "origin"); err != nil || url != upstreamDir {
+		t.Errorf("RemoteURL = %q, %v, want %q", url, err, upstreamDir)
+	}
+	if _, err := git.RemoteURL(repoDir, "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("RemoteURL of a missing remote = %v, want not found", err)
+	}
+
+	// Annotated tags resolve to the commit they point at
+	if err := git.Checkout(ctx, repoDir, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"v1", "HEAD"} {
+		if got, err := git.ResolveRef(repoDir, ref); err != nil || got != v1 {
+			t.Errorf("ResolveRef(%v) = %q, %v, want %q", ref, got, err, v1)
+		}
+	}
+	if _, err := git.ResolveRef(repoDir, "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("ResolveRef of a missing ref = %v, want not found", err)
+	}
+
+	writeTestTree(t, upstreamDir, MemoryTree{"small.txt": textFile("small v2\n")})
+	v2 := commitTestRepo(t, upstreamDir, "v2")
+	runTestGit(t, upstreamDir, "tag", "v2")
+	if err := git.Fetch(ctx, repoDir, "origin", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := git.ResolveRef(repoDir, "v2"); err != nil || got != v2 {
+		t.Errorf("ResolveRef(v2) after Fetch = %q, %v, want %q", got, err, v2)
+	}
+	if err := git.Checkout(ctx, repoDir, "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commit takes new, changed and deleted files alike
+	writeTestTree(t, repoDir, MemoryTree{
+		"small.txt": textFile("patched\n"),
+		"new.txt":   textFile("new\n"),
+	})
+	if err := os.Remove(filepath.Join(repoDir, "large.txt")); err != nil {
+		t.Fatal(err)
+	}
+	commit, err := git.Commit(ctx, repoDir, "patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head, err := git.ResolveRef(repoDir, "HEAD"); err != nil || head != commit {
+		t.Errorf("HEAD after Commit = %q, %v, want %q", head, err, commit)
+	}
+	if parent, err := git.ResolveRef(repoDir, "HEAD^"); err != nil || parent != v2 {
+		t.Errorf("parent of the commit = %q, %v, want %q", parent, err, v2)
+	}
+	blobs, err := git.SmallBlobs(repoDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"small.txt": []byte("patched\n"), "new.txt": []byte("new\n")}
+	if !reflect.DeepEqual(blobs, want) {
+		t.Errorf("SmallBlobs = %q, want %q", blobs, want)
+	}
+}
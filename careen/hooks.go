@@ -0,0 +1,171 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	HookPreClone  = "pre_clone"
+	HookPostClone = "post_clone"
+	HookPreApply  = "pre_apply"
+	HookPostApply = "post_apply"
+)
+
+// Names of the hooks, in the order they run
+var HookNames = []string{HookPreClone, HookPostClone, HookPreApply, HookPostApply}
+
+// Default time a hook may take
+const DefaultHookTimeout = 10 * time.Minute
+
+// Shell commands run before and after a package is cloned or patched, such as
+// generators after cloning and sanity checks after patching
+type Hooks struct {
+	PreClone  []string `yaml:"pre_clone,omitempty" json:"pre_clone,omitempty"`
+	PostClone []string `yaml:"post_clone,omitempty" json:"post_clone,omitempty"`
+	PreApply  []string `yaml:"pre_apply,omitempty" json:"pre_apply,omitempty"`
+	PostApply []string `yaml:"post_apply,omitempty" json:"post_apply,omitempty"`
+}
+
+// What a hook run for a package did
+type HookResult struct {
+	Hook     string // One of HookNames
+	Command  string
+	Duration time.Duration
+	Output   string // What the command wrote to stdout and stderr
+	Error    string
+}
+
+// Returns the commands of the named hook, none if h is nil
+func (h *Hooks) Commands(hook string) []string {
+	if h == nil {
+		return nil
+	}
+	switch hook {
+	case HookPreClone:
+		return h.PreClone
+	case HookPostClone:
+		return h.PostClone
+	case HookPreApply:
+		return h.PreApply
+	case HookPostApply:
+		return h.PostApply
+	}
+	return nil
+}
+
+// Returns the commands of hooks followed by those of more not already among
+// them, or nil if there are none. Neither argument is changed.
+func MergeHooks(hooks *Hooks, more *Hooks) *Hooks {
+	merged := &Hooks{}
+	empty := true
+	for _, hook := range []struct {
+		name     string
+		commands *[]string
+	}{
+		{HookPreClone, &merged.PreClone},
+		{HookPostClone, &merged.PostClone},
+		{HookPreApply, &merged.PreApply},
+		{HookPostApply, &merged.PostApply},
+	} {
+		for _, command := range append(append([]string{}, hooks.Commands(hook.name)...), more.Commands(hook.name)...) {
+			if !ContainsString(*hook.commands, command) {
+				*hook.commands = append(*hook.commands, command)
+				empty = false
+			}
+		}
+	}
+	if empty {
+		return nil
+	}
+	return merged
+}
+
+// Returns a problem for each empty command
+func (h *Hooks) problems() []string {
+	var problems []string
+	for _, hook := range HookNames {
+		for _, command := range h.Commands(hook) {
+			if command == "" {
+				problems = append(problems, fmt.Sprintf("hooks: %v: empty command", hook))
+			}
+		}
+	}
+	return problems
+}
+
+// Runs the commands of the named hook, those of the workspace first and then
+// the package's, recording each in result. pre_clone hooks run in the output
+// directory, the others in the package's directory. Stops at the first which
+// fails. The manifests' signatures are checked first if they have not been.
+func (w *Workspace) runHooks(ctx context.Context, hook string, pkg *Package, repoDir string, result *Result, log *Logger) error {
+	commands := append(append([]string{}, w.Hooks.Commands(hook)...), pkg.Hooks.Commands(hook)...)
+	if len(commands) == 0 {
+		return nil
+	}
+	if !w.manifestsChecked {
+		if err := w.CheckManifests(); err != nil {
+			return err
+		}
+	}
+	absRepoDir, err := filepath.Abs(repoDir)
+	if err != nil {
+		return err
+	}
+	dir := absRepoDir
+	if hook == HookPreClone {
+		if err := os.MkdirAll(w.OutputDir, 0755); err != nil {
+			return err
+		}
+		dir = w.OutputDir
+	}
+	env := append(os.Environ(),
+		"CAREEN_HOOK="+hook,
+		"CAREEN_PACKAGE="+pkg.Name,
+		"CAREEN_REPO_DIR="+absRepoDir,
+		"CAREEN_REVISION="+pkg.Revision,
+		"CAREEN_TAG="+pkg.Tag,
+	)
+
+	for _, command := range commands {
+		if err := checkInterrupted(ctx); err != nil {
+			return err
+		}
+		hookLog := log.With(Fields{"hook": hook})
+		hookLog.With(Fields{"command": command}).Infof("Running hook")
+		cmd := shellCommand(command)
+		cmd.Dir = dir
+		cmd.Env = env
+		started := time.Now()
+		output, err := runCommand(ctx, hookLog, cmd, command, w.HookTimeout)
+		hookResult := HookResult{Hook: hook, Command: command, Duration: time.Since(started), Output: output}
+		if err != nil {
+			hookResult.Error = err.Error()
+		}
+		result.Hooks = append(result.Hooks, hookResult)
+		if err == ErrInterrupted {
+			return err
+		} else if err != nil {
+			hookLog.WithError(err).Errorf("Hook failed")
+			return fmt.Errorf("Hook %v %q failed: %v", hook, command, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,489 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	lfsPointerVersion = "https://git-lfs.github.com/spec/v1"
+	lfsMaxPointerSize = 1024
+	lfsMediaType      = "application/vnd.git-lfs+json"
+)
+
+// Object named by a Git LFS pointer file
+type LFSPointer struct {
+	Oid  string `json:"oid"` // SHA-256 of the contents, in hex
+	Size int64  `json:"size"`
+}
+
+// File of a repository stored in Git LFS
+type lfsFile struct {
+	Path    string
+	Pointer LFSPointer
+}
+
+// Downloads the contents of LFS objects. Clients are chosen by the URL scheme
+// of the repository, see RegisterLFSClient.
+type LFSClient interface {
+	Fetch(ctx context.Context, pointer LFSPointer, w io.Writer) error
+}
+
+// Creates the LFS client for a repository URL
+type LFSClientFactory func(repoUrl *url.URL) (LFSClient, error)
+
+// Factories of LFS clients, keyed by URL scheme
+var lfsClientFactories = map[string]LFSClientFactory{
+	"http":  newHTTPLFSClient,
+	"https": newHTTPLFSClient,
+	"file":  newFileLFSClient,
+	"":      newFileLFSClient,
+}
+
+// Makes factory create the LFS clients of repositories whose URLs have
+// scheme, replacing the client careen has for it, if any. Register clients
+// before cloning, not while packages are cloned.
+func RegisterLFSClient(scheme string, factory LFSClientFactory) {
+	lfsClientFactories[scheme] = factory
+}
+
+// Returns the LFS client for the repository at repoUrl
+func NewLFSClient(repoUrl string) (LFSClient, error) {
+	unsupported := fmt.Errorf("No LFS server for repository %v, use an http(s) URL or a url rewrite", repoUrl)
+	// scp-like URLs such as git@host:repo.git do not parse
+	u, err := url.Parse(repoUrl)
+	if err != nil {
+		return nil, unsupported
+	}
+	factory, ok := lfsClientFactories[u.Scheme]
+	if !ok {
+		return nil, unsupported
+	}
+	return factory(u)
+}
+
+// Parses an LFS pointer file, returning false if data is not one
+func ParseLFSPointer(data []byte) (LFSPointer, bool) {
+	pointer := LFSPointer{Size: -1}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for i := 0; scanner.Scan(); i++ {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return LFSPointer{}, false
+		}
+		switch {
+		case i == 0:
+			if fields[0] != "version" || fields[1] != lfsPointerVersion {
+				return LFSPointer{}, false
+			}
+		case fields[0] == "oid":
+			oid := strings.TrimPrefix(fields[1], "sha256:")
+			if oid == fields[1] || len(oid) != sha256.Size*2 {
+				return LFSPointer{}, false
+			}
+			if _, err := hex.DecodeString(oid); err != nil {
+				return LFSPointer{}, false
+			}
+			pointer.Oid = strings.ToLower(oid)
+		case fields[0] == "size":
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || size < 0 {
+				return LFSPointer{}, false
+			}
+			pointer.Size = size
+		}
+	}
+	if pointer.Oid == "" || pointer.Size < 0 {
+		return LFSPointer{}, false
+	}
+	return pointer, true
+}
+
+// Returns the files of HEAD in the repository in repoDir which are LFS pointers
+func lfsFiles(git GitBackend, repoDir string) ([]lfsFile, error) {
+	blobs, err := git.SmallBlobs(repoDir, lfsMaxPointerSize)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []lfsFile{}
+	for path, data := range blobs {
+		if pointer, ok := ParseLFSPointer(data); ok {
+			files = append(files, lfsFile{Path: path, Pointer: pointer})
+		}
+	}
+	sort.Sort(lfsFilesByPath(files))
+	return files, nil
+}
+
+type lfsFilesByPath []lfsFile
+
+func (f lfsFilesByPath) Len() int           { return len(f) }
+func (f lfsFilesByPath) Less(i, j int) bool { return f[i].Path < f[j].Path }
+func (f lfsFilesByPath) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// Checks that the file at path has the contents the pointer names
+func verifyLFSObject(path string, pointer LFSPointer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	digest := sha256.New()
+	size, err := io.Copy(digest, f)
+	if err != nil {
+		return err
+	}
+	if size != pointer.Size {
+		return fmt.Errorf("%v has %v bytes, expected %v", path, size, pointer.Size)
+	}
+	if computed := hex.EncodeToString(digest.Sum(nil)); computed != pointer.Oid {
+		return fmt.Errorf("%v has digest sha256:%v, expected sha256:%v", path, computed, pointer.Oid)
+	}
+	return nil
+}
+
+// Returns where the object is cached, using the layout of git-lfs
+func lfsObjectPath(objectsDir string, oid string) string {
+	return filepath.Join(objectsDir, oid[0:2], oid[2:4], oid)
+}
+
+// Fails writes past the size of the object being fetched, so that a server
+// sending more than the pointer names cannot fill the disk
+type lfsObjectWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (w *lfsObjectWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.remaining {
+		return 0, errLFSObjectTooLarge
+	}
+	n, err := w.w.Write(p)
+	w.remaining -= int64(n)
+	return n, err
+}
+
+var errLFSObjectTooLarge = errors.New("object is larger than its pointer says")
+
+// Downloads the object into the cache in objectsDir unless already there,
+// checking its size and digest before it is stored. Failed downloads are
+// retried as policy allows.
+func fetchLFSObject(ctx context.Context, client LFSClient, objectsDir string, pointer LFSPointer, policy RetryPolicy, log *Logger) (string, error) {
+	cached := lfsObjectPath(objectsDir, pointer.Oid)
+	if err := verifyLFSObject(cached, pointer); err == nil {
+		return cached, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(cached), "incomplete-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = policy.Do(ctx, log, func() error {
+		// Start again from an empty file
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := tmp.Truncate(0); err != nil {
+			return err
+		}
+		return client.Fetch(ctx, pointer, &lfsObjectWriter{w: tmp, remaining: pointer.Size})
+	})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == ErrInterrupted {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("Failed to fetch LFS object %v: %v", pointer.Oid, err)
+	}
+	if err := verifyLFSObject(tmp.Name(), pointer); err != nil {
+		return "", fmt.Errorf("Refusing LFS object %v: %v", pointer.Oid, err)
+	}
+	if err := os.Rename(tmp.Name(), cached); err != nil {
+		return "", err
+	}
+	return cached, nil
+}
+
+// Replaces the LFS pointer files checked out in repoDir with the objects they
+// name, fetched from the LFS server of the repository at repoUrl
+func FetchLFSObjects(ctx context.Context, git GitBackend, repoDir string, repoUrl string, policy RetryPolicy, log *Logger) error {
+	files, err := lfsFiles(git, repoDir)
+	if err != nil {
+		return err
+	}
+
+	var client LFSClient
+	objectsDir := filepath.Join(repoDir, ".git", "lfs", "objects")
+	for _, file := range files {
+		if err := checkInterrupted(ctx); err != nil {
+			return err
+		}
+		target, err := SafeJoin(repoDir, filepath.FromSlash(file.Path))
+		if err != nil {
+			return err
+		}
+		if err := verifyLFSObject(target, file.Pointer); err == nil {
+			continue
+		}
+		// The file is replaced, so a symlinked directory must not take the
+		// write elsewhere
+		if err := CheckNoSymlinkEscape(repoDir, target); err != nil {
+			return err
+		}
+
+		if client == nil {
+			client, err = NewLFSClient(repoUrl)
+			if err != nil {
+				return err
+			}
+		}
+		objectLog := log.With(Fields{"repo": repoDir, "file": file.Path, "oid": file.Pointer.Oid})
+		objectLog.Infof("Fetching LFS object")
+		cached, err := fetchLFSObject(ctx, client, objectsDir, file.Pointer, policy, objectLog)
+		if err != nil {
+			return err
+		}
+		if err := replaceFile(target, cached); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Overwrites target with a copy of source, keeping the mode of target
+func replaceFile(target string, source string) error {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%v is not a regular file", target)
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(target), ".careen-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// Checks that every LFS file of the repository in repoDir has been replaced by
+// the object it names
+func VerifyLFSObjects(git GitBackend, repoDir string) error {
+	files, err := lfsFiles(git, repoDir)
+	if err != nil {
+		return err
+	}
+
+	errs := []string{}
+	for _, file := range files {
+		target := filepath.Join(repoDir, filepath.FromSlash(file.Path))
+		if err := verifyLFSObject(target, file.Pointer); err != nil {
+			errs = append(errs, "  "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("LFS files of repository directory %v do not match their objects:\n%v", repoDir, strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Reads objects from the LFS storage of a local repository, as git-lfs does
+// for file URLs. Also serves as an LFS server for repositories kept on disk.
+type fileLFSClient struct {
+	objectsDir string
+}
+
+func newFileLFSClient(repoUrl *url.URL) (LFSClient, error) {
+	if repoUrl.Host != "" || strings.Contains(repoUrl.Path, ":") {
+		return nil, fmt.Errorf("No LFS server for repository %v, use an http(s) URL or a url rewrite", repoUrl)
+	}
+	dir := repoUrl.Path
+	for _, objectsDir := range []string{filepath.Join(dir, ".git", "lfs", "objects"), filepath.Join(dir, "lfs", "objects")} {
+		if info, err := os.Stat(objectsDir); err == nil && info.IsDir() {
+			return &fileLFSClient{objectsDir: objectsDir}, nil
+		}
+	}
+	return nil, fmt.Errorf("Repository %v has no LFS objects directory", dir)
+}
+
+func (c *fileLFSClient) Fetch(ctx context.Context, pointer LFSPointer, w io.Writer) error {
+	f, err := os.Open(lfsObjectPath(c.objectsDir, pointer.Oid))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Downloads objects with the batch API of an LFS server over http(s)
+type httpLFSClient struct {
+	endpoint string
+}
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers"`
+	Objects   []LFSPointer `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Objects []struct {
+		Oid     string `json:"oid"`
+		Actions map[string]struct {
+			Href   string            `json:"href"`
+			Header map[string]string `json:"header"`
+		} `json:"actions"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"objects"`
+}
+
+// The server of https://host/repo.git is at https://host/repo.git/info/lfs
+func newHTTPLFSClient(repoUrl *url.URL) (LFSClient, error) {
+	endpoint := strings.TrimSuffix(repoUrl.String(), "/")
+	if !strings.HasSuffix(endpoint, ".git") {
+		endpoint += ".git"
+	}
+	return &httpLFSClient{endpoint: endpoint + "/info/lfs"}, nil
+}
+
+func (c *httpLFSClient) Fetch(ctx context.Context, pointer LFSPointer, w io.Writer) error {
+	body, err := json.Marshal(lfsBatchRequest{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   []LFSPointer{pointer},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &HTTPStatusError{
+			Message:    fmt.Sprintf("LFS batch request to %v returned %v", c.endpoint, resp.Status),
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	batch := lfsBatchResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return fmt.Errorf("Invalid LFS batch response from %v: %v", c.endpoint, err)
+	}
+	for _, object := range batch.Objects {
+		if object.Oid != pointer.Oid {
+			continue
+		}
+		if object.Error != nil {
+			return fmt.Errorf("LFS server returned %v: %v", object.Error.Code, object.Error.Message)
+		}
+		download, ok := object.Actions["download"]
+		if !ok {
+			return fmt.Errorf("LFS server has no download for the object")
+		}
+		return c.download(ctx, download.Href, download.Header, pointer.Size, w)
+	}
+	return fmt.Errorf("LFS server did not return the object")
+}
+
+// Downloads the object of size bytes from href, reading no more than one byte
+// past it
+func (c *httpLFSClient) download(ctx context.Context, href string, header map[string]string, size int64, w io.Writer) error {
+	req, err := http.NewRequest("GET", href, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &HTTPStatusError{
+			Message:    fmt.Sprintf("LFS download returned %v", resp.Status),
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	n, err := io.Copy(w, io.LimitReader(resp.Body, size+1))
+	if err != nil {
+		return err
+	}
+	if n > size {
+		return errLFSObjectTooLarge
+	}
+	return nil
+}
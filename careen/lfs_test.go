@@ -0,0 +1,273 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Git backend whose HEAD holds blobs, for the LFS code which reads nothing else
+type blobsGitBackend struct {
+	GitBackend
+	blobs map[string][]byte
+}
+
+func (b *blobsGitBackend) SmallBlobs(repoDir string, maxSize uint64) (map[string][]byte, error) {
+	return b.blobs, nil
+}
+
+func lfsPointerFile(pointer LFSPointer) []byte {
+	return []byte(fmt.Sprintf("version %v\noid sha256:%v\nsize %v\n", lfsPointerVersion, pointer.Oid, pointer.Size))
+}
+
+func lfsPointerOf(contents string) LFSPointer {
+	digest := sha256.Sum256([]byte(contents))
+	return LFSPointer{Oid: hex.EncodeToString(digest[:]), Size: int64(len(contents))}
+}
+
+// Sets up a repository on disk serving stored as the object of pointer, and a
+// clone with a pointer file at each of paths
+func setupLFSRepos(t *testing.T, dir string, pointer LFSPointer, stored string, paths ...string) (*blobsGitBackend, string, string) {
+	remoteDir := filepath.Join(dir, "remote")
+	object := lfsObjectPath(filepath.Join(remoteDir, ".git", "lfs", "objects"), pointer.Oid)
+	if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(object, []byte(stored), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repoDir := filepath.Join(dir, "repo")
+	git := &blobsGitBackend{blobs: map[string][]byte{}}
+	for _, path := range paths {
+		git.blobs[path] = lfsPointerFile(pointer)
+		file := filepath.Join(repoDir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, lfsPointerFile(pointer), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return git, remoteDir, repoDir
+}
+
+var noRetries = RetryPolicy{Attempts: 1}
+
+func TestFetchLFSObjectsFromFileRepository(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	contents := "large binary contents\n"
+	pointer := lfsPointerOf(contents)
+	git, remoteDir, repoDir := setupLFSRepos(t, dir, pointer, contents, "assets/big.bin", "other.bin")
+
+	if err := FetchLFSObjects(context.Background(), git, repoDir, "file://"+remoteDir, noRetries, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"assets/big.bin", "other.bin"} {
+		data, err := ioutil.ReadFile(filepath.Join(repoDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents {
+			t.Errorf("%v contains %q, want the LFS object", path, data)
+		}
+	}
+	if err := VerifyLFSObjects(git, repoDir); err != nil {
+		t.Error(err)
+	}
+	// The object is cached in the clone as git-lfs would
+	if _, err := os.Stat(lfsObjectPath(filepath.Join(repoDir, ".git", "lfs", "objects"), pointer.Oid)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFetchLFSObjectsRejectsDigestMismatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	pointer := lfsPointerOf("large binary contents\n")
+	git, remoteDir, repoDir := setupLFSRepos(t, dir, pointer, "tampered contents!!!!\n", "big.bin")
+
+	err := FetchLFSObjects(context.Background(), git, repoDir, remoteDir, noRetries, discardLogger)
+	if err == nil || !strings.Contains(err.Error(), "Refusing LFS object") {
+		t.Errorf("FetchLFSObjects error = %v, want the object refused", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(repoDir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(lfsPointerFile(pointer)) {
+		t.Errorf("big.bin contains %q, want the pointer left in place", data)
+	}
+	if err := VerifyLFSObjects(git, repoDir); err == nil {
+		t.Error("VerifyLFSObjects accepted a pointer file")
+	}
+}
+
+func TestFetchLFSObjectsRejectsSymlinkedTarget(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	contents := "large binary contents\n"
+	pointer := lfsPointerOf(contents)
+	git, remoteDir, repoDir := setupLFSRepos(t, dir, pointer, contents)
+	// The pointer file is reached through a symlinked directory of the clone
+	git.blobs["link/big.bin"] = lfsPointerFile(pointer)
+	outside := filepath.Join(dir, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "big.bin"), lfsPointerFile(pointer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", filepath.Join(repoDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := FetchLFSObjects(context.Background(), git, repoDir, remoteDir, noRetries, discardLogger)
+	if err == nil || !strings.Contains(err.Error(), "through a symlink") {
+		t.Errorf("FetchLFSObjects error = %v, want the symlink refused", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "outside", "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(lfsPointerFile(pointer)) {
+		t.Errorf("file outside the clone was replaced with %q", data)
+	}
+}
+
+type stringLFSClient string
+
+func (c stringLFSClient) Fetch(ctx context.Context, pointer LFSPointer, w io.Writer) error {
+	_, err := io.WriteString(w, string(c))
+	return err
+}
+
+func TestRegisterLFSClient(t *testing.T) {
+	defer delete(lfsClientFactories, "test")
+	RegisterLFSClient("test", func(repoUrl *url.URL) (LFSClient, error) {
+		return stringLFSClient(repoUrl.Host), nil
+	})
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	contents := "example.com"
+	pointer := lfsPointerOf(contents)
+	git, _, repoDir := setupLFSRepos(t, dir, pointer, "", "big.bin")
+
+	if err := FetchLFSObjects(context.Background(), git, repoDir, "test://example.com/repo.git", noRetries, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyLFSObjects(git, repoDir); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewLFSClient("unknown://example.com/repo.git"); err == nil {
+		t.Error("NewLFSClient accepted an unregistered scheme")
+	}
+}
+
+// Serves the LFS batch API of a repository at /repo.git, sending contents
+// for every object whatever its size
+func lfsTestServer(contents string) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/repo.git/info/lfs/objects/batch", func(w http.ResponseWriter, r *http.Request) {
+		request := lfsBatchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		objects := []interface{}{}
+		for _, object := range request.Objects {
+			objects = append(objects, map[string]interface{}{
+				"oid":     object.Oid,
+				"size":    object.Size,
+				"actions": map[string]interface{}{"download": map[string]string{"href": server.URL + "/object"}},
+			})
+		}
+		w.Header().Set("Content-Type", lfsMediaType)
+		json.NewEncoder(w).Encode(map[string]interface{}{"objects": objects})
+	})
+	mux.HandleFunc("/object", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, contents)
+	})
+	return server
+}
+
+func TestFetchLFSObjectsOverHTTP(t *testing.T) {
+	contents := "large binary contents\n"
+	pointer := lfsPointerOf(contents)
+
+	tests := []struct {
+		served string
+		err    string
+	}{
+		{contents, ""},
+		{contents + strings.Repeat("x", 1<<20), "larger than its pointer says"},
+		{"short", "Refusing LFS object"},
+	}
+	for _, test := range tests {
+		server := lfsTestServer(test.served)
+		dir := tempDir(t)
+		git, _, repoDir := setupLFSRepos(t, dir, pointer, "", "big.bin")
+
+		err := FetchLFSObjects(context.Background(), git, repoDir, server.URL+"/repo.git", noRetries, discardLogger)
+		server.Close()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("serving %v bytes: %v", len(test.served), err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("serving %v bytes: error = %v, want %q", len(test.served), err, test.err)
+		}
+		cached := lfsObjectPath(filepath.Join(repoDir, ".git", "lfs", "objects"), pointer.Oid)
+		if _, statErr := os.Stat(cached); (statErr == nil) != (test.err == "") {
+			t.Errorf("serving %v bytes: cached object exists %v, want %v", len(test.served), statErr == nil, test.err == "")
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFetchLFSObjectsLimitsRegisteredClients(t *testing.T) {
+	defer delete(lfsClientFactories, "test")
+	RegisterLFSClient("test", func(repoUrl *url.URL) (LFSClient, error) {
+		return stringLFSClient(strings.Repeat("x", 4096)), nil
+	})
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	pointer := lfsPointerOf("small")
+	git, _, repoDir := setupLFSRepos(t, dir, pointer, "", "big.bin")
+
+	err := FetchLFSObjects(context.Background(), git, repoDir, "test://example.com/repo.git", noRetries, discardLogger)
+	if err == nil || !strings.Contains(err.Error(), "larger than its pointer says") {
+		t.Errorf("FetchLFSObjects error = %v, want the object refused as too large", err)
+	}
+}
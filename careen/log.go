@@ -0,0 +1,200 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug: "debug",
+	LogInfo:  "info",
+	LogWarn:  "warn",
+	LogError: "error",
+}
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Values attached to log messages, such as package, patch, repo and duration
+type Fields map[string]interface{}
+
+// Where and how messages are written, shared by a logger and those made from
+// it with With, so configuring the root logger configures them all
+type logSink struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  LogLevel
+	format string
+}
+
+// Leveled logger writing lines of text, "INFO: message key=value", or JSON
+// objects with time, level and msg keys
+type Logger struct {
+	sink   *logSink
+	fields Fields
+	err    error
+}
+
+func NewLogger(out io.Writer) *Logger {
+	return &Logger{sink: &logSink{out: out, level: LogInfo, format: LogFormatText}}
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return LogWarn, nil
+	}
+	return LogInfo, fmt.Errorf("Unknown log level %q, expected debug, info, warn or error", name)
+}
+
+func (l *Logger) SetLevel(level LogLevel) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.level = level
+}
+
+func (l *Logger) SetFormat(format string) error {
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("Unknown log format %q, expected %v or %v", format, LogFormatText, LogFormatJSON)
+	}
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.format = format
+	return nil
+}
+
+func (l *Logger) Format() string {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	return l.sink.format
+}
+
+// Reports whether messages at level are written
+func (l *Logger) Enabled(level LogLevel) bool {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	return level >= l.sink.level
+}
+
+// Returns a logger adding fields to every message
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{sink: l.sink, fields: merged, err: l.err}
+}
+
+// Returns a logger adding err to every message
+func (l *Logger) WithError(err error) *Logger {
+	return &Logger{sink: l.sink, fields: l.fields, err: err}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.log(LogDebug, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.log(LogInfo, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.log(LogWarn, format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.log(LogError, format, args...) }
+
+func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	if l.sink.format == LogFormatJSON {
+		l.writeJSON(level, msg)
+	} else {
+		l.writeText(level, msg)
+	}
+}
+
+func (l *Logger) sortedKeys() []string {
+	keys := []string{}
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Errors may span lines, such as lists of problems, so they follow the message
+// as they are. Field values are quoted when they contain spaces.
+func (l *Logger) writeText(level LogLevel, msg string) {
+	line := strings.ToUpper(logLevelNames[level]) + ": " + msg
+	if l.err != nil {
+		line += ": " + l.err.Error()
+	}
+	for _, k := range l.sortedKeys() {
+		value := fmt.Sprint(l.fields[k])
+		if d, ok := l.fields[k].(time.Duration); ok {
+			value = d.String()
+		}
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		line += " " + k + "=" + value
+	}
+	fmt.Fprintln(l.sink.out, line)
+}
+
+func (l *Logger) writeJSON(level LogLevel, msg string) {
+	entry := map[string]interface{}{}
+	for k, v := range l.fields {
+		// Durations are written in seconds, which aggregators can sum
+		if d, ok := v.(time.Duration); ok {
+			v = d.Seconds()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = logLevelNames[level]
+	entry["msg"] = msg
+	if l.err != nil {
+		entry["error"] = l.err.Error()
+	}
+
+	out, err := json.Marshal(entry)
+	if err != nil {
+		out, _ = json.Marshal(map[string]interface{}{"level": logLevelNames[level], "msg": msg})
+	}
+	fmt.Fprintf(l.sink.out, "%s\n", out)
+}
@@ -0,0 +1,107 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf)
+	pkgLog := log.With(Fields{"package": "kubernetes", "repo": "/out/kubernetes"})
+
+	log.Debugf("not written at the default level")
+	pkgLog.Infof("Cloning %v", "repository")
+	pkgLog.With(Fields{"patch": "a fix.patch", "duration": 1500 * time.Millisecond, "empty": ""}).Warnf("Slow")
+	pkgLog.WithError(errors.New("Problems:\n  first")).Errorf("Failed")
+	log.SetLevel(LogError)
+	pkgLog.Warnf("not written above the level set on the root logger")
+
+	want := `INFO: Cloning repository package=kubernetes repo=/out/kubernetes
+WARN: Slow duration=1.5s empty="" package=kubernetes patch="a fix.patch" repo=/out/kubernetes
+ERROR: Failed: Problems:
+  first package=kubernetes repo=/out/kubernetes
+`
+	if got := buf.String(); got != want {
+		t.Errorf("logged\n%v\nwant\n%v", got, want)
+	}
+	if !log.Enabled(LogError) || log.Enabled(LogWarn) {
+		t.Errorf("Enabled does not follow SetLevel")
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf)
+	if err := log.SetFormat(LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	log.SetLevel(LogDebug)
+	log.With(Fields{"package": "etcd", "duration": 2 * time.Second, "attempt": 1}).WithError(errors.New("reset")).Debugf("Retrying")
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %s", err, buf.Bytes())
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+		t.Errorf("time: %v", err)
+	}
+	delete(entry, "time")
+	want := map[string]interface{}{
+		"level":    "debug",
+		"msg":      "Retrying",
+		"error":    "reset",
+		"package":  "etcd",
+		"duration": 2.0,
+		"attempt":  1.0,
+	}
+	if len(entry) != len(want) {
+		t.Errorf("logged %v, want %v", entry, want)
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%v = %v, want %v", k, entry[k], v)
+		}
+	}
+	if !strings.HasSuffix(buf.String(), "}\n") || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("logged %q, want one line", buf.String())
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]LogLevel{
+		"debug":   LogDebug,
+		"INFO":    LogInfo,
+		"warn":    LogWarn,
+		"Warning": LogWarn,
+		"error":   LogError,
+	} {
+		if level, err := ParseLogLevel(name); err != nil || level != want {
+			t.Errorf("ParseLogLevel(%q) = %v, %v, want %v", name, level, err, want)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("ParseLogLevel accepted an unknown level")
+	}
+	if err := NewLogger(nil).SetFormat("xml"); err == nil {
+		t.Error("SetFormat accepted an unknown format")
+	}
+}
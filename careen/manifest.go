@@ -0,0 +1,290 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+type Manifest struct {
+	Version  string            `json:"version"`
+	Include  []string          `yaml:",omitempty" json:"include,omitempty"`
+	Vars     map[string]string `yaml:",omitempty" json:"vars,omitempty"`
+	Hooks    *Hooks            `yaml:",omitempty" json:"hooks,omitempty"` // Run for every package
+	Packages []Package         `json:"packages"`
+}
+
+type Package struct {
+	Name            string         `json:"name"`
+	Repo            string         `yaml:",omitempty" json:"repo,omitempty"`
+	Revision        string         `yaml:",omitempty" json:"revision,omitempty"`
+	Tag             string         `yaml:",omitempty" json:"tag,omitempty"`
+	Submodules      *Submodules    `yaml:",omitempty" json:"submodules,omitempty"`
+	Lfs             bool           `yaml:",omitempty" json:"lfs,omitempty"`
+	VerifySignature string         `yaml:"verify_signature,omitempty" json:"verify_signature,omitempty"`
+	Source          string         `yaml:",omitempty" json:"source,omitempty"`
+	Archive         *ArchiveSource `yaml:",omitempty" json:"archive,omitempty"`
+	Local           *LocalSource   `yaml:",omitempty" json:"local,omitempty"`
+	DependsOn       []string       `yaml:"depends_on,omitempty" json:"depends_on,omitempty"`
+	Hooks           *Hooks         `yaml:",omitempty" json:"hooks,omitempty"`
+	Patches         []Patch        `yaml:",omitempty" json:"patches,omitempty"`
+}
+
+// Release tarball or zip file used in place of a git repository
+type ArchiveSource struct {
+	Url             string `json:"url"`
+	Digest          string `json:"digest"`
+	StripComponents int    `yaml:"strip_components,omitempty" json:"strip_components,omitempty"`
+}
+
+// Directory, such as a developer's checkout, used in place of a git repository
+type LocalSource struct {
+	Path    string `json:"path"`
+	Symlink bool   `yaml:",omitempty" json:"symlink,omitempty"`
+}
+
+type Patch struct {
+	Name          string   `json:"name"`
+	Filename      string   `json:"filename"`
+	Hash          string   `json:"hash"`
+	Documentation []string `yaml:",omitempty" json:"documentation,omitempty"`
+}
+
+// Reads a single manifest in any supported format, upgrading it to the current
+// format version. Includes, overlays and variables are not resolved.
+func ReadManifestFile(filename string) (*Manifest, error) {
+	manifest := Manifest{}
+
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest %v: %v", filename, err)
+	}
+
+	file, err = ConvertToYAML(file, ManifestFormatFromFilename(filename))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing manifest %v: %v", filename, err)
+	}
+
+	file, _, err = MigrateManifest(file, false)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing manifest %v: %v", filename, err)
+	}
+
+	err = yaml.Unmarshal([]byte(file), &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing manifest %v: %v", filename, err)
+	}
+
+	return &manifest, nil
+}
+
+// Checks the settings of every package
+func (m *Manifest) Validate() error {
+	problems := m.Hooks.problems()
+	for i := range m.Packages {
+		pkg := &m.Packages[i]
+		// Names and filenames become paths below the output and patch
+		// directories, which they must not leave
+		if err := validateFileName("package name", pkg.Name); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if err := pkg.ValidateSource(); err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, problem := range pkg.Hooks.problems() {
+			problems = append(problems, fmt.Sprintf("package %v: %v", pkg.Name, problem))
+		}
+		for _, patch := range pkg.Patches {
+			if err := validateRelativePath("filename", patch.Filename); err != nil {
+				problems = append(problems, fmt.Sprintf("package %v: patch %v: %v", pkg.Name, patch.Name, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Manifest is invalid:\n  %v", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Tracks state while resolving the includes of one or more manifests
+type manifestLoader struct {
+	// Manifests currently being loaded, used to detect include cycles
+	loading []string
+	// Every package seen so far and the file that first defined it
+	packages map[string]Package
+	origins  map[string]string
+	// Every manifest read, in the order first read
+	files []string
+}
+
+func newManifestLoader() *manifestLoader {
+	return &manifestLoader{
+		packages: map[string]Package{},
+		origins:  map[string]string{},
+	}
+}
+
+// Reads filename and merges the packages of any manifests it includes. Included
+// paths are relative to the directory of the including manifest.
+func (l *manifestLoader) load(filename string) (*Manifest, error) {
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range l.loading {
+		if f == absFilename {
+			cycle := strings.Join(l.loading[i:], " -> ")
+			return nil, fmt.Errorf("Include cycle in manifest %v: %v -> %v", filename, cycle, absFilename)
+		}
+	}
+	l.loading = append(l.loading, absFilename)
+	defer func() {
+		l.loading = l.loading[:len(l.loading)-1]
+	}()
+
+	manifest, err := ReadManifestFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	l.addFile(filename)
+
+	merged := Manifest{Version: manifest.Version, Vars: map[string]string{}}
+	for _, include := range manifest.Include {
+		includeFilename := include
+		if !filepath.IsAbs(includeFilename) {
+			includeFilename = filepath.Join(filepath.Dir(filename), includeFilename)
+		}
+		included, err := l.load(includeFilename)
+		if err != nil {
+			return nil, err
+		}
+		if merged.Version == "" {
+			merged.Version = included.Version
+		}
+		mergeVars(merged.Vars, included.Vars)
+		merged.Hooks = MergeHooks(merged.Hooks, included.Hooks)
+		merged.Packages = appendPackages(merged.Packages, included.Packages)
+	}
+	mergeVars(merged.Vars, manifest.Vars)
+	merged.Hooks = MergeHooks(merged.Hooks, manifest.Hooks)
+
+	for _, pkg := range manifest.Packages {
+		if err := l.addPackage(pkg, filename); err != nil {
+			return nil, err
+		}
+	}
+	merged.Packages = appendPackages(merged.Packages, manifest.Packages)
+
+	return &merged, nil
+}
+
+func (l *manifestLoader) addFile(filename string) {
+	for _, f := range l.files {
+		if f == filename {
+			return
+		}
+	}
+	l.files = append(l.files, filename)
+}
+
+// Records pkg as defined in filename. Defining the same package identically in
+// several files is allowed, anything else with the same name is an error.
+func (l *manifestLoader) addPackage(pkg Package, filename string) error {
+	other, exists := l.packages[pkg.Name]
+	if !exists {
+		l.packages[pkg.Name] = pkg
+		l.origins[pkg.Name] = filename
+		return nil
+	}
+	if reflect.DeepEqual(other, pkg) {
+		return nil
+	}
+
+	origin := l.origins[pkg.Name]
+	if other.Revision != pkg.Revision || other.Tag != pkg.Tag {
+		return fmt.Errorf("Conflicting pins for package %v: %v has revision %q tag %q but %v has revision %q tag %q",
+			pkg.Name, origin, other.Revision, other.Tag, filename, pkg.Revision, pkg.Tag)
+	}
+	return fmt.Errorf("Duplicate package %v defined differently in %v and %v", pkg.Name, origin, filename)
+}
+
+// Merges the manifest with the packages of all manifests it includes
+func GetManifestFromFile(filename string) (*Manifest, error) {
+	return newManifestLoader().load(filename)
+}
+
+// Merges several manifests into one, as if a manifest included each of them in order
+func GetManifestFromFiles(filenames []string) (*Manifest, error) {
+	loader := newManifestLoader()
+	merged := Manifest{Vars: map[string]string{}}
+
+	for _, filename := range filenames {
+		manifest, err := loader.load(filename)
+		if err != nil {
+			return nil, err
+		}
+		if merged.Version == "" {
+			merged.Version = manifest.Version
+		}
+		mergeVars(merged.Vars, manifest.Vars)
+		merged.Hooks = MergeHooks(merged.Hooks, manifest.Hooks)
+		merged.Packages = appendPackages(merged.Packages, manifest.Packages)
+	}
+
+	return &merged, nil
+}
+
+// Returns the manifests and every manifest they include, directly or not
+func ManifestSources(filenames []string) ([]string, error) {
+	loader := newManifestLoader()
+	for _, filename := range filenames {
+		if _, err := loader.load(filename); err != nil {
+			return nil, err
+		}
+	}
+	return loader.files, nil
+}
+
+// Appends the packages not already present by name. Callers have already
+// checked that packages sharing a name are identical.
+func appendPackages(packages []Package, more []Package) []Package {
+	for _, pkg := range more {
+		found := false
+		for _, p := range packages {
+			if p.Name == pkg.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages
+}
+
+// Copies vars into dest. Later definitions win, so an including manifest can
+// override the defaults of the manifests it includes.
+func mergeVars(dest map[string]string, vars map[string]string) {
+	for name, value := range vars {
+		dest[name] = value
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Writes the files, by slash separated path, below dir
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func packageNames(packages []Package) []string {
+	names := []string{}
+	for _, pkg := range packages {
+		names = append(names, pkg.Name)
+	}
+	return names
+}
+
+func TestGetManifestFromFileDiamondIncludes(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{
+		"top.yaml": `version: "0.0.1"
+include: [parts/a.yaml, parts/b.yaml]
+vars: {TOP: top}
+packages:
+  - {name: top, repo: "https://example.com/top.git", tag: v1}
+`,
+		"parts/a.yaml": `version: "0.0.1"
+include: [common.yaml]
+vars: {SHARED: a, A: a}
+packages:
+  - {name: a, repo: "https://example.com/a.git", tag: v1}
+`,
+		"parts/b.yaml": `version: "0.0.1"
+include: [common.yaml]
+vars: {SHARED: b}
+packages:
+  - {name: b, repo: "https://example.com/b.git", tag: v1}
+`,
+		"parts/common.yaml": `version: "0.0.1"
+vars: {SHARED: common, COMMON: common}
+packages:
+  - {name: common, repo: "https://example.com/common.git", tag: v1}
+`,
+	})
+
+	manifest, err := GetManifestFromFile(filepath.Join(dir, "top.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := packageNames(manifest.Packages); !reflect.DeepEqual(names, []string{"common", "a", "b", "top"}) {
+		t.Errorf("packages = %q", names)
+	}
+	// Later includes override earlier ones, and the including manifest
+	// overrides them all
+	wantVars := map[string]string{"SHARED": "b", "A": "a", "COMMON": "common", "TOP": "top"}
+	if !reflect.DeepEqual(manifest.Vars, wantVars) {
+		t.Errorf("vars = %v, want %v", manifest.Vars, wantVars)
+	}
+
+	sources, err := ManifestSources([]string{filepath.Join(dir, "top.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sources {
+		sources[i], _ = filepath.Rel(dir, sources[i])
+	}
+	wantSources := []string{"top.yaml", filepath.FromSlash("parts/a.yaml"), filepath.FromSlash("parts/common.yaml"), filepath.FromSlash("parts/b.yaml")}
+	if !reflect.DeepEqual(sources, wantSources) {
+		t.Errorf("sources = %q, want %q", sources, wantSources)
+	}
+}
+
+func TestGetManifestFromFilesErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{
+		"cycle-a.yaml":     "version: \"0.0.1\"\ninclude: [cycle-b.yaml]\npackages: []\n",
+		"cycle-b.yaml":     "version: \"0.0.1\"\ninclude: [sub/cycle-c.yaml]\npackages: []\n",
+		"sub/cycle-c.yaml": "version: \"0.0.1\"\ninclude: [../cycle-a.yaml]\npackages: []\n",
+		"self.yaml":        "version: \"0.0.1\"\ninclude: [self.yaml]\npackages: []\n",
+		"v1.yaml":          "version: \"0.0.1\"\npackages:\n  - {name: docker, repo: \"https://example.com/docker.git\", tag: v1}\n",
+		"v2.yaml":          "version: \"0.0.1\"\npackages:\n  - {name: docker, repo: \"https://example.com/docker.git\", tag: v2}\n",
+		"mirror.yaml":      "version: \"0.0.1\"\npackages:\n  - {name: docker, repo: \"https://mirror.example.com/docker.git\", tag: v1}\n",
+		"same.yaml":        "version: \"0.0.1\"\ninclude: [v1.yaml]\npackages:\n  - {name: docker, repo: \"https://example.com/docker.git\", tag: v1}\n",
+	})
+
+	tests := []struct {
+		files []string
+		want  string
+	}{
+		{[]string{"cycle-a.yaml"}, "Include cycle"},
+		{[]string{"self.yaml"}, "Include cycle"},
+		{[]string{"v1.yaml", "v2.yaml"}, `Conflicting pins for package docker`},
+		{[]string{"v1.yaml", "mirror.yaml"}, "Duplicate package docker defined differently"},
+		{[]string{"same.yaml", "v1.yaml"}, ""},
+	}
+	for _, test := range tests {
+		filenames := []string{}
+		for _, f := range test.files {
+			filenames = append(filenames, filepath.Join(dir, f))
+		}
+		manifest, err := GetManifestFromFiles(filenames)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%v: %v", test.files, err)
+		case test.want == "" && len(manifest.Packages) != 1:
+			t.Errorf("%v: packages = %q, want one docker", test.files, packageNames(manifest.Packages))
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%v: error = %v, want %q", test.files, err, test.want)
+		}
+	}
+}
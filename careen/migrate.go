@@ -0,0 +1,196 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"strconv"
+	"strings"
+)
+
+// Version of the manifest format written by this version of careen
+const CurrentManifestVersion = "0.0.1"
+
+// Version assumed for manifests written before the version was checked
+const unversionedManifestVersion = "0.0.1"
+
+// Upgrades the root mapping of a manifest document from version From to
+// version To in place. Working on the document's nodes keeps its comments.
+type manifestMigration struct {
+	From    string
+	To      string
+	Migrate func(root *yamlNode) error
+}
+
+// Migrations in order, each From being the To of the one before. Append a
+// migration here whenever CurrentManifestVersion changes.
+var manifestMigrations = []manifestMigration{}
+
+// Returns the versions careen can read, oldest first
+func SupportedManifestVersions() []string {
+	versions := []string{}
+	for _, migration := range manifestMigrations {
+		versions = append(versions, migration.From)
+	}
+	return append(versions, CurrentManifestVersion)
+}
+
+// Compares dotted numeric versions, returning -1, 0 or 1
+func compareVersions(a string, b string) (int, error) {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aNum, bNum int
+		var err error
+		if i < len(aParts) {
+			if aNum, err = strconv.Atoi(aParts[i]); err != nil {
+				return 0, fmt.Errorf("Invalid version %q", a)
+			}
+		}
+		if i < len(bParts) {
+			if bNum, err = strconv.Atoi(bParts[i]); err != nil {
+				return 0, fmt.Errorf("Invalid version %q", b)
+			}
+		}
+		if aNum < bNum {
+			return -1, nil
+		} else if aNum > bNum {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// Checks that careen understands the manifest version
+func checkManifestVersion(version string) error {
+	if version == "" {
+		return fmt.Errorf("Manifest has no version, run 'careen manifest migrate' to add one")
+	}
+
+	for _, supported := range SupportedManifestVersions() {
+		if version == supported {
+			return nil
+		}
+	}
+
+	newer, err := compareVersions(version, CurrentManifestVersion)
+	if err != nil {
+		return err
+	}
+	if newer > 0 {
+		return fmt.Errorf("Manifest version %v is newer than the newest version %v supported by this careen, please upgrade careen",
+			version, CurrentManifestVersion)
+	}
+	return fmt.Errorf("Manifest version %v is not supported, supported versions are %v",
+		version, strings.Join(SupportedManifestVersions(), ", "))
+}
+
+func getManifestVersion(manifest yaml.MapSlice) string {
+	for _, item := range manifest {
+		if item.Key == "version" && item.Value != nil {
+			return fmt.Sprint(item.Value)
+		}
+	}
+	return ""
+}
+
+func setManifestVersion(root *yamlNode, version string) {
+	for _, entry := range root.Entries {
+		if entry.Key == "version" {
+			entry.Value = &yamlNode{Kind: yamlScalar, Value: encodeDoubleQuoted(version)}
+			return
+		}
+	}
+	// Keep version the first key, as in the README
+	entry := &yamlEntry{Key: "version", Value: &yamlNode{Kind: yamlScalar, Value: encodeDoubleQuoted(version)}}
+	root.Entries = append([]*yamlEntry{entry}, root.Entries...)
+}
+
+// Upgrades a manifest document to CurrentManifestVersion. Documents already at
+// the current version are returned unchanged. When assumeVersion is set, a
+// document without a version is treated as the oldest format. Comments, and
+// the order and quoting of the keys and values migrations leave alone, are
+// kept.
+func MigrateManifest(data []byte, assumeVersion bool) ([]byte, string, error) {
+	manifest := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, "", err
+	}
+
+	version := getManifestVersion(manifest)
+	if version == CurrentManifestVersion {
+		return data, version, nil
+	}
+	unversioned := version == "" && assumeVersion
+	if unversioned {
+		version = unversionedManifestVersion
+	}
+	if err := checkManifestVersion(version); err != nil {
+		return nil, version, err
+	}
+
+	doc, err := ParseYAMLDocument(data)
+	if err != nil {
+		return nil, version, err
+	}
+	if doc.Root.Kind != yamlMapping {
+		return nil, version, fmt.Errorf("manifest must be a mapping")
+	}
+	if unversioned {
+		setManifestVersion(doc.Root, version)
+	}
+	for _, migration := range manifestMigrations {
+		if migration.From != version {
+			continue
+		}
+		if err := migration.Migrate(doc.Root); err != nil {
+			return nil, version, fmt.Errorf("Error migrating from version %v to %v: %v", migration.From, migration.To, err)
+		}
+		setManifestVersion(doc.Root, migration.To)
+		version = migration.To
+	}
+
+	f := &manifestFormatter{}
+	f.writeDocument(doc, nil)
+	return f.buf.Bytes(), version, nil
+}
+
+// Migrates the contents of filename, keeping its format
+func MigrateManifestFile(filename string, data []byte) ([]byte, string, error) {
+	format := ManifestFormatFromFilename(filename)
+	yamlData, err := ConvertToYAML(data, format)
+	if err != nil {
+		return nil, "", err
+	}
+
+	migrated, version, err := MigrateManifest(yamlData, true)
+	if err != nil {
+		return nil, version, err
+	}
+	if string(migrated) == string(yamlData) {
+		return data, version, nil
+	}
+	if format == FormatYAML {
+		return migrated, version, nil
+	}
+
+	manifest := Manifest{}
+	if err := yaml.Unmarshal(migrated, &manifest); err != nil {
+		return nil, version, err
+	}
+	encoded, err := EncodeManifest(&manifest, format)
+	return encoded, version, err
+}
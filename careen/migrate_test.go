@@ -0,0 +1,177 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"github.com/go-yaml/yaml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const unversionedManifest = `# important comment
+packages:
+  # the docker package
+  - name: docker
+    repo: "https://github.com/docker/docker.git"
+    tag: v1.11.2 # pinned
+`
+
+func TestMigrateManifestKeepsComments(t *testing.T) {
+	migrated, version, err := MigrateManifest([]byte(unversionedManifest), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != CurrentManifestVersion {
+		t.Errorf("version = %q, want %q", version, CurrentManifestVersion)
+	}
+	want := `---
+# important comment
+version: "0.0.1"
+packages:
+  # the docker package
+  - name: docker
+    repo: "https://github.com/docker/docker.git"
+    tag: v1.11.2 # pinned
+`
+	if string(migrated) != want {
+		t.Errorf("migrated manifest:\n%s\nwant:\n%s", migrated, want)
+	}
+}
+
+func TestMigrateManifestCurrentVersionUnchanged(t *testing.T) {
+	data := []byte("version: \"0.0.1\" # current\npackages: []\n")
+	migrated, _, err := MigrateManifest(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(migrated) != string(data) {
+		t.Errorf("migrated manifest:\n%s\nwant it unchanged", migrated)
+	}
+}
+
+func TestMigrateManifestRejectsVersions(t *testing.T) {
+	for _, test := range []struct {
+		data          string
+		assumeVersion bool
+		err           string
+	}{
+		{"packages: []\n", false, "Manifest has no version"},
+		{"version: 99.0.0\npackages: []\n", true, "newer than the newest version"},
+		{"version: 0.0.0\npackages: []\n", true, "is not supported"},
+	} {
+		_, _, err := MigrateManifest([]byte(test.data), test.assumeVersion)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("MigrateManifest(%q) error = %v, want %q", test.data, err, test.err)
+		}
+	}
+}
+
+// Renames the deps key of every package to depends_on, as if 0.0.1 had
+// renamed it
+func renameDepsMigration(root *yamlNode) error {
+	for _, entry := range root.Entries {
+		if entry.Key != "packages" {
+			continue
+		}
+		for _, item := range entry.Value.Entries {
+			for _, field := range item.Value.Entries {
+				if field.Key == "deps" {
+					field.Key = "depends_on"
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestMigrateManifestRunsMigrations(t *testing.T) {
+	defer func(migrations []manifestMigration) {
+		manifestMigrations = migrations
+	}(manifestMigrations)
+	manifestMigrations = []manifestMigration{
+		{From: "0.0.0", To: "0.0.1", Migrate: renameDepsMigration},
+	}
+
+	data := `# important comment
+version: 0.0.0
+packages:
+  - name: docker
+    repo: "https://github.com/docker/docker.git"
+    tag: v1.11.2
+    # needs containerd first
+    deps: [containerd]
+`
+	migrated, version, err := MigrateManifest([]byte(data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "0.0.1" {
+		t.Errorf("version = %q, want 0.0.1", version)
+	}
+	want := `---
+# important comment
+version: "0.0.1"
+packages:
+  - name: docker
+    repo: "https://github.com/docker/docker.git"
+    tag: v1.11.2
+    # needs containerd first
+    depends_on:
+      - containerd
+`
+	if string(migrated) != want {
+		t.Errorf("migrated manifest:\n%s\nwant:\n%s", migrated, want)
+	}
+
+	manifest := Manifest{}
+	if err := yaml.Unmarshal(migrated, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(manifest.Packages[0].DependsOn, []string{"containerd"}) {
+		t.Errorf("depends_on = %q, want [containerd]", manifest.Packages[0].DependsOn)
+	}
+}
+
+func TestMigrateManifestFileKeepsFormat(t *testing.T) {
+	for _, test := range []struct {
+		filename string
+		data     string
+		prefix   string
+		version  string
+	}{
+		{
+			"docker.json",
+			`{"packages": [{"name": "docker", "repo": "https://github.com/docker/docker.git", "tag": "v1.11.2"}]}`,
+			"{",
+			`"version": "0.0.1"`,
+		},
+		{
+			"docker.toml",
+			"[[packages]]\nname = \"docker\"\nrepo = \"https://github.com/docker/docker.git\"\ntag = \"v1.11.2\"\n",
+			"version = ",
+			`version = "0.0.1"`,
+		},
+	} {
+		migrated, _, err := MigrateManifestFile(test.filename, []byte(test.data))
+		if err != nil {
+			t.Errorf("%v: %v", test.filename, err)
+			continue
+		}
+		if !strings.HasPrefix(string(migrated), test.prefix) || !strings.Contains(string(migrated), test.version) {
+			t.Errorf("%v: migrated manifest:\n%s\nwant one with %v", test.filename, migrated, test.version)
+		}
+	}
+}
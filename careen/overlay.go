@@ -0,0 +1,150 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"io/ioutil"
+)
+
+// An overlay patches the packages of a base manifest, e.g. for a dev or staging variant
+type Overlay struct {
+	Vars     map[string]string
+	Packages []PackageOverlay
+}
+
+type PackageOverlay struct {
+	Name          string
+	Revision      string
+	Tag           string
+	Drop          bool
+	AddPatches    []Patch  `yaml:"add_patches"`
+	RemovePatches []string `yaml:"remove_patches"`
+}
+
+func GetOverlayFromFile(filename string) (*Overlay, error) {
+	overlay := Overlay{}
+
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading overlay %v: %v", filename, err)
+	}
+
+	file, err = ConvertToYAML(file, ManifestFormatFromFilename(filename))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing overlay %v: %v", filename, err)
+	}
+
+	err = yaml.Unmarshal([]byte(file), &overlay)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing overlay %v: %v", filename, err)
+	}
+
+	return &overlay, nil
+}
+
+// Applies overlay to the manifest in place. Every package and patch the overlay
+// refers to must exist so that typos do not silently produce the base manifest.
+func (m *Manifest) ApplyOverlay(overlay *Overlay) error {
+	if m.Vars == nil {
+		m.Vars = map[string]string{}
+	}
+	mergeVars(m.Vars, overlay.Vars)
+
+	for _, o := range overlay.Packages {
+		index := -1
+		for i, pkg := range m.Packages {
+			if pkg.Name == o.Name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("Overlay refers to unknown package %v", o.Name)
+		}
+
+		if o.Drop {
+			m.Packages = append(m.Packages[:index], m.Packages[index+1:]...)
+			continue
+		}
+
+		pkg := &m.Packages[index]
+		if o.Revision != "" {
+			pkg.Revision = o.Revision
+		}
+		if o.Tag != "" {
+			pkg.Tag = o.Tag
+		}
+		for _, name := range o.RemovePatches {
+			if err := pkg.removePatch(name); err != nil {
+				return err
+			}
+		}
+		for _, patch := range o.AddPatches {
+			if pkg.findPatch(patch.Name) >= 0 {
+				return fmt.Errorf("Overlay adds patch %q to package %v which already has it", patch.Name, pkg.Name)
+			}
+			pkg.Patches = append(pkg.Patches, patch)
+		}
+	}
+
+	return nil
+}
+
+func (pkg *Package) findPatch(name string) int {
+	for i, patch := range pkg.Patches {
+		if patch.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (pkg *Package) removePatch(name string) error {
+	index := pkg.findPatch(name)
+	if index < 0 {
+		return fmt.Errorf("Overlay removes unknown patch %q from package %v", name, pkg.Name)
+	}
+	pkg.Patches = append(pkg.Patches[:index], pkg.Patches[index+1:]...)
+	return nil
+}
+
+// Merges the manifests, applies each overlay in order, substitutes variables and validates the result
+func GetEffectiveManifest(manifestFilenames []string, overlayFilenames []string, lookup VarLookup) (*Manifest, error) {
+	manifest, err := GetManifestFromFiles(manifestFilenames)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, filename := range overlayFilenames {
+		overlay, err := GetOverlayFromFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := manifest.ApplyOverlay(overlay); err != nil {
+			return nil, fmt.Errorf("Error applying overlay %v: %v", filename, err)
+		}
+	}
+
+	if err := manifest.ResolveVars(lookup); err != nil {
+		return nil, err
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
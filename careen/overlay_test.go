@@ -0,0 +1,108 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const overlayTestManifest = `version: "0.0.1"
+vars: {MIRROR: "https://example.com", ENV: base}
+packages:
+  - name: docker
+    repo: "${MIRROR}/docker.git"
+    tag: v1.11.2
+    patches:
+      - {name: a, filename: "a-${ENV}.patch", hash: "1"}
+      - {name: b, filename: b.patch, hash: "2"}
+  - name: etcd
+    repo: "${MIRROR}/etcd.git"
+    tag: v3.0.0
+`
+
+func TestGetEffectiveManifestOverlayPrecedence(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{
+		"manifest.yaml": overlayTestManifest,
+		"staging.yaml": `vars: {ENV: staging}
+packages:
+  - name: docker
+    tag: v1.12.0
+    remove_patches: [b]
+    add_patches:
+      - {name: c, filename: c.patch, hash: "3"}
+`,
+		"dev.yaml": `vars: {ENV: dev, MIRROR: "https://mirror.example.com"}
+packages:
+  - name: docker
+    revision: abc123
+    tag: v1.13.0
+  - name: etcd
+    drop: true
+`,
+	})
+
+	manifest, err := GetEffectiveManifest(
+		[]string{filepath.Join(dir, "manifest.yaml")},
+		[]string{filepath.Join(dir, "staging.yaml"), filepath.Join(dir, "dev.yaml")},
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := packageNames(manifest.Packages); !reflect.DeepEqual(names, []string{"docker"}) {
+		t.Fatalf("packages = %q, want docker", names)
+	}
+	docker := manifest.Packages[0]
+	// The last overlay wins, and its variables apply to the whole manifest
+	if docker.Tag != "v1.13.0" || docker.Revision != "abc123" {
+		t.Errorf("docker is at tag %q revision %q, want v1.13.0 abc123", docker.Tag, docker.Revision)
+	}
+	if docker.Repo != "https://mirror.example.com/docker.git" {
+		t.Errorf("docker repo = %q", docker.Repo)
+	}
+	wantPatches := []Patch{
+		{Name: "a", Filename: "a-dev.patch", Hash: "1"},
+		{Name: "c", Filename: "c.patch", Hash: "3"},
+	}
+	if !reflect.DeepEqual(docker.Patches, wantPatches) {
+		t.Errorf("docker patches = %+v, want %+v", docker.Patches, wantPatches)
+	}
+}
+
+func TestApplyOverlayErrors(t *testing.T) {
+	tests := []struct {
+		overlay string
+		want    string
+	}{
+		{"packages: [{name: kubernetes, tag: v1}]\n", "unknown package kubernetes"},
+		{"packages: [{name: docker, remove_patches: [z]}]\n", `removes unknown patch "z" from package docker`},
+		{"packages: [{name: docker, add_patches: [{name: a, filename: x.patch, hash: \"1\"}]}]\n", `adds patch "a" to package docker which already has it`},
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, test := range tests {
+		writeTestFiles(t, dir, map[string]string{"manifest.yaml": overlayTestManifest, "overlay.yaml": test.overlay})
+		_, err := GetEffectiveManifest([]string{filepath.Join(dir, "manifest.yaml")}, []string{filepath.Join(dir, "overlay.yaml")}, nil)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("overlay %q: error = %v, want %q", test.overlay, err, test.want)
+		}
+	}
+}
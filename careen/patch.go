@@ -0,0 +1,504 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The paths and modes of a file changed by a patch, from its headers. Paths are
+// relative to the package root, with the a/ and b/ prefixes removed, and empty
+// for /dev/null.
+type PatchFile struct {
+	OldPath string
+	NewPath string
+	OldMode string
+	NewMode string
+	Binary  bool
+}
+
+const symlinkMode = "120000"
+
+// A file changed by a patch, with the hunks or binary data changing it
+type FilePatch struct {
+	PatchFile
+	Rename bool
+	Copy   bool
+	// Object ids of the old and new contents, from the index line
+	OldIndex  string
+	NewIndex  string
+	IndexMode string // Mode of the index line of files keeping their mode
+	Hunks     []*Hunk
+	// Data of a git binary patch. "Binary files differ" patches set Binary
+	// without it, and cannot be applied.
+	BinaryData *BinaryFragment
+	Line       int // Line of the patch the file starts on
+}
+
+// A hunk of a text patch, with the lines it keeps, removes and adds
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Header   string // The @@ line
+	Line     int    // Line of the patch the hunk starts on
+	Lines    []HunkLine
+}
+
+type HunkLine struct {
+	Op   byte   // ' ' for context, '-' for removed and '+' for added lines
+	Text []byte // Including the newline, unless the line has none
+}
+
+// Contents of a git binary patch, either the new contents or a git delta
+// turning the old contents into them
+type BinaryFragment struct {
+	Delta bool
+	Data  []byte // Inflated
+}
+
+var hunkRange = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+var patchMode = regexp.MustCompile(`^[0-7]{6}$`)
+
+type patchParser struct {
+	lines [][]byte
+	i     int
+}
+
+// Returns the i-th line without its line ending
+func (p *patchParser) text(i int) string {
+	return strings.TrimSuffix(string(p.lines[i]), "\n")
+}
+
+func (p *patchParser) corrupt(format string, args ...interface{}) error {
+	return fmt.Errorf("Corrupt patch at line %v: %v", p.i+1, fmt.Sprintf(format, args...))
+}
+
+// Splits data into lines which keep their newlines
+func splitLines(data []byte) [][]byte {
+	lines := [][]byte{}
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, data[:i])
+		data = data[i:]
+	}
+	return lines
+}
+
+// Parses the files a patch changes and how, reading git and plain unified
+// diffs as git apply does. Text around the diffs, such as the message and
+// signature of git format-patch, is skipped.
+func ParsePatch(data []byte) ([]*FilePatch, error) {
+	p := &patchParser{lines: splitLines(data)}
+	files := []*FilePatch{}
+	for p.i < len(p.lines) {
+		line := p.text(p.i)
+		var file *FilePatch
+		var err error
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			file, err = p.parseGitHeader()
+		case strings.HasPrefix(line, "--- ") && p.i+2 < len(p.lines) &&
+			strings.HasPrefix(p.text(p.i+1), "+++ ") && strings.HasPrefix(p.text(p.i+2), "@@ -"):
+			file = p.parseTraditionalHeader()
+		default:
+			p.i++
+			continue
+		}
+		if err == nil {
+			err = p.parseChanges(file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (p *patchParser) parseGitHeader() (*FilePatch, error) {
+	file := &FilePatch{Line: p.i + 1}
+	// The paths may contain spaces, so prefer those of the other headers
+	// and fall back to splitting a/x b/x in the middle
+	names := strings.TrimPrefix(p.text(p.i), "diff --git ")
+	if half := len(names) / 2; len(names)%2 == 1 && names[half] == ' ' {
+		file.OldPath = patchPath(names[:half])
+		file.NewPath = patchPath(names[half+1:])
+	}
+	isNew, isDeleted := false, false
+
+	mode := func(line string, prefix string) (string, error) {
+		mode := strings.TrimPrefix(line, prefix)
+		if !patchMode.MatchString(mode) {
+			return "", p.corrupt("invalid mode %q", mode)
+		}
+		return mode, nil
+	}
+
+	var err error
+header:
+	for p.i++; p.i < len(p.lines); p.i++ {
+		line := p.text(p.i)
+		switch {
+		case strings.HasPrefix(line, "old mode "):
+			file.OldMode, err = mode(line, "old mode ")
+		case strings.HasPrefix(line, "new mode "):
+			file.NewMode, err = mode(line, "new mode ")
+		case strings.HasPrefix(line, "deleted file mode "):
+			file.OldMode, err = mode(line, "deleted file mode ")
+			isDeleted = true
+		case strings.HasPrefix(line, "new file mode "):
+			file.NewMode, err = mode(line, "new file mode ")
+			isNew = true
+		case strings.HasPrefix(line, "rename from "):
+			file.OldPath = patchPathNoPrefix(line)
+			file.Rename = true
+		case strings.HasPrefix(line, "rename to "):
+			file.NewPath = patchPathNoPrefix(line)
+			file.Rename = true
+		case strings.HasPrefix(line, "copy from "):
+			file.OldPath = patchPathNoPrefix(line)
+			file.Copy = true
+		case strings.HasPrefix(line, "copy to "):
+			file.NewPath = patchPathNoPrefix(line)
+			file.Copy = true
+		case strings.HasPrefix(line, "index "):
+			fields := strings.SplitN(strings.TrimPrefix(line, "index "), " ", 2)
+			if i := strings.Index(fields[0], ".."); i >= 0 {
+				file.OldIndex, file.NewIndex = fields[0][:i], fields[0][i+2:]
+			}
+			if len(fields) == 2 {
+				file.IndexMode, err = mode(fields[1], "")
+			}
+		case strings.HasPrefix(line, "--- "):
+			if name := patchPath(strings.TrimPrefix(line, "--- ")); name != "" {
+				file.OldPath = name
+			}
+		case strings.HasPrefix(line, "+++ "):
+			if name := patchPath(strings.TrimPrefix(line, "+++ ")); name != "" {
+				file.NewPath = name
+			}
+		case strings.HasPrefix(line, "similarity index "), strings.HasPrefix(line, "dissimilarity index "):
+		default:
+			break header
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if isNew {
+		file.OldPath = ""
+	}
+	if isDeleted {
+		file.NewPath = ""
+	}
+	if (!isNew && file.OldPath == "") || (!isDeleted && file.NewPath == "") {
+		return nil, fmt.Errorf("Corrupt patch at line %v: git diff header lacks file names", file.Line)
+	}
+	return file, nil
+}
+
+// Removes the first component, as git apply does by default, and decodes
+// the quoting git uses for unusual names
+func patchPath(field string) string {
+	field = strings.SplitN(field, "\t", 2)[0]
+	if strings.HasPrefix(field, `"`) {
+		if unquoted, err := strconv.Unquote(field); err == nil {
+			field = unquoted
+		}
+	}
+	if field == "/dev/null" {
+		return ""
+	}
+	if i := strings.Index(field, "/"); i >= 0 {
+		return field[i+1:]
+	}
+	return field
+}
+
+// Rename and copy headers name paths without the a/ and b/ prefixes
+func patchPathNoPrefix(line string) string {
+	field := strings.SplitN(line, " ", 3)[2]
+	if unquoted, err := strconv.Unquote(field); err == nil && strings.HasPrefix(field, `"`) {
+		return unquoted
+	}
+	return field
+}
+
+// Timestamp of the epoch, in any time zone, which diff -N gives files
+// missing on one side
+var epochTimestamp = regexp.MustCompile(`\t(1969-12-31|1970-01-01) ([0-2][0-9]):([0-5][0-9]):00(\.0+)? ([-+])([0-2][0-9]):?([0-5][0-9])$`)
+
+func hasEpochTimestamp(line string) bool {
+	m := epochTimestamp.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	atoi := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	epoch := 0
+	if m[1] == "1969-12-31" {
+		epoch = 24 * 60
+	}
+	zone := atoi(m[6])*60 + atoi(m[7])
+	if m[5] == "-" {
+		zone = -zone
+	}
+	return atoi(m[2])*60+atoi(m[3])-zone == epoch
+}
+
+// Plain unified diffs are read like git apply does: /dev/null or the epoch
+// as timestamp creates or removes the file, otherwise the new name is the
+// file changed
+func (p *patchParser) parseTraditionalHeader() *FilePatch {
+	file := &FilePatch{Line: p.i + 1}
+	oldLine, newLine := p.text(p.i), p.text(p.i+1)
+	oldPath := patchPath(strings.TrimPrefix(oldLine, "--- "))
+	newPath := patchPath(strings.TrimPrefix(newLine, "+++ "))
+	switch {
+	case oldPath == "":
+		file.NewPath = newPath
+	case newPath == "":
+		file.OldPath = oldPath
+	case hasEpochTimestamp(oldLine):
+		file.NewPath = newPath
+	case hasEpochTimestamp(newLine):
+		file.OldPath = oldPath
+	default:
+		file.OldPath, file.NewPath = newPath, newPath
+	}
+	p.i += 2
+	return file
+}
+
+// Parses the hunks or binary data following the header of file
+func (p *patchParser) parseChanges(file *FilePatch) error {
+	for p.i < len(p.lines) {
+		line := p.text(p.i)
+		switch {
+		case strings.HasPrefix(line, "@@ -"):
+			hunk, err := p.parseHunk()
+			if err != nil {
+				return err
+			}
+			file.Hunks = append(file.Hunks, hunk)
+		case line == "GIT binary patch" && len(file.Hunks) == 0:
+			file.Binary = true
+			p.i++
+			fragment, err := p.parseBinaryFragment()
+			if err != nil {
+				return err
+			}
+			if fragment == nil {
+				return p.corrupt("missing binary patch data")
+			}
+			file.BinaryData = fragment
+			// The reverse patch which may follow is not needed
+			_, err = p.parseBinaryFragment()
+			return err
+		case strings.HasPrefix(line, "Binary files ") && len(file.Hunks) == 0:
+			file.Binary = true
+			p.i++
+			return nil
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (p *patchParser) parseHunk() (*Hunk, error) {
+	header := p.text(p.i)
+	match := hunkRange.FindStringSubmatch(header)
+	if match == nil {
+		return nil, p.corrupt("invalid hunk header %q", header)
+	}
+	number := func(s string) int {
+		if s == "" {
+			return 1
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	hunk := &Hunk{
+		OldStart: number(match[1]),
+		OldLines: number(match[2]),
+		NewStart: number(match[3]),
+		NewLines: number(match[4]),
+		Header:   header,
+		Line:     p.i + 1,
+	}
+
+	// Drops the newline of the last line, which a "\ No newline at end of
+	// file" line follows. git does not translate the message, so only its
+	// start is certain.
+	noNewline := func(line []byte) bool {
+		return len(line) >= 12 && bytes.HasPrefix(line, []byte(`\ `))
+	}
+	dropNewline := func() {
+		last := &hunk.Lines[len(hunk.Lines)-1]
+		last.Text = bytes.TrimSuffix(last.Text, []byte("\n"))
+		if len(last.Text) == 0 {
+			hunk.Lines = hunk.Lines[:len(hunk.Lines)-1]
+		}
+	}
+
+	oldLines, newLines, changes := hunk.OldLines, hunk.NewLines, 0
+	for p.i++; oldLines > 0 || newLines > 0; p.i++ {
+		if p.i >= len(p.lines) {
+			return nil, p.corrupt("hunk %q ends early", header)
+		}
+		line := p.lines[p.i]
+		if line[len(line)-1] != '\n' {
+			return nil, p.corrupt("incomplete line")
+		}
+		switch line[0] {
+		case ' ':
+			hunk.Lines = append(hunk.Lines, HunkLine{Op: ' ', Text: line[1:]})
+			oldLines--
+			newLines--
+		case '\n':
+			// An empty context line, as newer GNU diffs write them
+			hunk.Lines = append(hunk.Lines, HunkLine{Op: ' ', Text: line})
+			oldLines--
+			newLines--
+		case '-':
+			hunk.Lines = append(hunk.Lines, HunkLine{Op: '-', Text: line[1:]})
+			oldLines--
+			changes++
+		case '+':
+			hunk.Lines = append(hunk.Lines, HunkLine{Op: '+', Text: line[1:]})
+			newLines--
+			changes++
+		case '\\':
+			if !noNewline(line) || len(hunk.Lines) == 0 {
+				return nil, p.corrupt("unexpected line %q", p.text(p.i))
+			}
+			dropNewline()
+		default:
+			return nil, p.corrupt("unexpected line %q", p.text(p.i))
+		}
+		if oldLines < 0 || newLines < 0 {
+			return nil, p.corrupt("hunk %q has more lines than its header says", header)
+		}
+	}
+	if changes == 0 {
+		return nil, fmt.Errorf("Corrupt patch at line %v: hunk %q changes nothing", hunk.Line, header)
+	}
+	if p.i < len(p.lines) && noNewline(p.lines[p.i]) {
+		dropNewline()
+		p.i++
+	}
+	return hunk, nil
+}
+
+// Parses a literal or delta fragment of a git binary patch, returning nil
+// if there is none
+func (p *patchParser) parseBinaryFragment() (*BinaryFragment, error) {
+	if p.i >= len(p.lines) {
+		return nil, nil
+	}
+	fragment := &BinaryFragment{}
+	header := p.text(p.i)
+	var size string
+	switch {
+	case strings.HasPrefix(header, "literal "):
+		size = strings.TrimPrefix(header, "literal ")
+	case strings.HasPrefix(header, "delta "):
+		size = strings.TrimPrefix(header, "delta ")
+		fragment.Delta = true
+	default:
+		return nil, nil
+	}
+	length, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return nil, p.corrupt("invalid binary patch size %q", size)
+	}
+
+	var deflated []byte
+	for p.i++; p.i < len(p.lines); p.i++ {
+		line := p.text(p.i)
+		if line == "" {
+			p.i++
+			break
+		}
+		data, err := decodeBase85Line(line)
+		if err != nil {
+			return nil, p.corrupt("%v", err)
+		}
+		deflated = append(deflated, data...)
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(deflated))
+	if err == nil {
+		fragment.Data, err = ioutil.ReadAll(reader)
+	}
+	if err != nil || uint64(len(fragment.Data)) != length {
+		return nil, p.corrupt("binary patch data does not inflate to %v bytes", length)
+	}
+	return fragment, nil
+}
+
+// Alphabet of git's base 85 encoding, which is not that of ascii85
+const base85Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+// Decodes a line of a git binary patch: a letter giving the number of bytes,
+// A-Z for 1 to 26 and a-z for 27 to 52, then 5 characters for every 4 bytes
+func decodeBase85Line(line string) ([]byte, error) {
+	var length int
+	switch c := line[0]; {
+	case 'A' <= c && c <= 'Z':
+		length = int(c-'A') + 1
+	case 'a' <= c && c <= 'z':
+		length = int(c-'a') + 27
+	default:
+		return nil, fmt.Errorf("invalid binary patch line length %q", c)
+	}
+	encoded := line[1:]
+	if len(encoded)%5 != 0 || len(encoded)/5*4 < length || len(encoded)/5*4 >= length+4 {
+		return nil, fmt.Errorf("binary patch line does not hold %v bytes", length)
+	}
+
+	data := make([]byte, 0, len(encoded)/5*4)
+	for i := 0; i < len(encoded); i += 5 {
+		var acc uint64
+		for _, c := range []byte(encoded[i : i+5]) {
+			digit := strings.IndexByte(base85Alphabet, c)
+			if digit < 0 {
+				return nil, fmt.Errorf("invalid base 85 character %q", c)
+			}
+			acc = acc*85 + uint64(digit)
+		}
+		if acc > 0xffffffff {
+			return nil, fmt.Errorf("invalid base 85 data")
+		}
+		data = append(data, byte(acc>>24), byte(acc>>16), byte(acc>>8), byte(acc))
+	}
+	return data[:length], nil
+}
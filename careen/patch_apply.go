@@ -0,0 +1,681 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A file of a tree patches are applied to. Mode is a git file mode, 100644,
+// 100755, or 120000 for a symlink, whose Data is the target of the link.
+type TreeFile struct {
+	Mode string
+	Data []byte
+}
+
+func (f *TreeFile) executable() bool {
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	return err == nil && mode&0100 != 0
+}
+
+// Files patches are applied to, by slash separated path from the root
+type FileTree interface {
+	// Returns the file at name, or nil if there is none
+	ReadFile(name string) (*TreeFile, error)
+}
+
+// Tree of files held in memory
+type MemoryTree map[string]*TreeFile
+
+func (t MemoryTree) ReadFile(name string) (*TreeFile, error) {
+	return t[name], nil
+}
+
+// Tree of the files below a directory
+type DirTree string
+
+func (t DirTree) ReadFile(name string) (*TreeFile, error) {
+	filename, err := t.path(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(filename)
+		if err != nil {
+			return nil, err
+		}
+		return &TreeFile{Mode: symlinkMode, Data: []byte(target)}, nil
+	case info.IsDir():
+		return nil, fmt.Errorf("%v is a directory", name)
+	case !info.Mode().IsRegular():
+		return nil, fmt.Errorf("%v is not a regular file", name)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	mode := "100644"
+	if info.Mode()&0100 != 0 {
+		mode = "100755"
+	}
+	return &TreeFile{Mode: mode, Data: data}, nil
+}
+
+// Returns the file name of name below the directory. Like git apply, careen
+// refuses to follow symlinks out of the tree.
+func (t DirTree) path(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		info, err := os.Lstat(filepath.Join(string(t), filepath.FromSlash(strings.Join(parts[:i], "/"))))
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%v is beyond a symbolic link", name)
+		}
+	}
+	return filepath.Join(string(t), filepath.FromSlash(name)), nil
+}
+
+// A tree with patches applied to it in memory. The tree below is left as it
+// is until the changes are written, so patches can be tried without changing
+// any files.
+type PatchedTree struct {
+	Base    FileTree
+	changes map[string]*TreeFile // nil for removed files
+}
+
+func NewPatchedTree(base FileTree) *PatchedTree {
+	return &PatchedTree{Base: base, changes: map[string]*TreeFile{}}
+}
+
+func (t *PatchedTree) ReadFile(name string) (*TreeFile, error) {
+	if file, ok := t.changes[name]; ok {
+		return file, nil
+	}
+	return t.Base.ReadFile(name)
+}
+
+// Returns the paths of the files changed, created or removed, sorted
+func (t *PatchedTree) Changed() []string {
+	names := []string{}
+	for name := range t.changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Error of a hunk which does not apply, with the lines it expected and those
+// found where it should have applied
+type HunkError struct {
+	Path      string
+	Hunk      int // Number of the hunk among the file's hunks, from 1
+	Header    string
+	PatchLine int // Line of the patch the hunk starts on
+	Line      int // Line of the file the hunk was expected at
+	// Hunks without leading or trailing context must start or end the file
+	AtStart  bool
+	AtEnd    bool
+	Expected []string
+	Found    []string
+}
+
+func (e *HunkError) Error() string {
+	quote := func(lines []string) string {
+		if len(lines) == 0 {
+			return "    (nothing)\n"
+		}
+		var b bytes.Buffer
+		for _, line := range lines {
+			if strings.HasSuffix(line, "\n") {
+				fmt.Fprintf(&b, "    |%v\n", strings.TrimSuffix(line, "\n"))
+			} else {
+				fmt.Fprintf(&b, "    |%v (no newline at end of file)\n", line)
+			}
+		}
+		return b.String()
+	}
+	where := ""
+	switch {
+	case e.AtStart && e.AtEnd:
+		where = ", where it must be the whole file"
+	case e.AtStart:
+		where = ", where it must start the file"
+	case e.AtEnd:
+		where = ", where it must end the file"
+	}
+	return fmt.Sprintf("Hunk %v of %v (%v, patch line %v) does not apply at line %v%v\n  expected:\n%v  found:\n%v",
+		e.Hunk, e.Path, e.Header, e.PatchLine, e.Line, where, quote(e.Expected), strings.TrimSuffix(quote(e.Found), "\n"))
+}
+
+// Reads the patch file and applies it, as Apply does, giving up after
+// timeout if not zero
+func (t *PatchedTree) ApplyFile(ctx context.Context, patchPath string, timeout time.Duration, log *Logger) error {
+	data, err := ioutil.ReadFile(patchPath)
+	if err != nil {
+		return err
+	}
+	files, err := ParsePatch(data)
+	if err != nil {
+		return fmt.Errorf("Error parsing patch %v: %v", patchPath, err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("Patch %v changes no files", patchPath)
+	}
+
+	applyCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		applyCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err = t.Apply(applyCtx, files, log)
+	if err == ErrInterrupted && ctx.Err() == nil {
+		return fmt.Errorf("Applying patch %v timed out after %v", patchPath, timeout)
+	}
+	return err
+}
+
+// Applies the files of a patch in order, as git apply does: hunks must match
+// their context exactly, but may apply at an offset from the line they name,
+// and binary patches must apply to the contents they were made from. Either
+// every file applies or the tree is left as it was.
+func (t *PatchedTree) Apply(ctx context.Context, files []*FilePatch, log *Logger) error {
+	pending := NewPatchedTree(t)
+	for _, file := range files {
+		if err := checkInterrupted(ctx); err != nil {
+			return err
+		}
+		if err := pending.applyFile(file, log); err != nil {
+			return err
+		}
+	}
+	for name, file := range pending.changes {
+		t.changes[name] = file
+	}
+	return nil
+}
+
+// Returns whether a path of a patch stays inside the tree and out of .git
+func validPatchPath(name string) bool {
+	if escapesRoot(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || strings.EqualFold(part, ".git") {
+			return false
+		}
+	}
+	return true
+}
+
+const gitlinkMode = "160000"
+
+func (t *PatchedTree) applyFile(file *FilePatch, log *Logger) error {
+	name := file.NewPath
+	if name == "" {
+		name = file.OldPath
+	}
+	for _, p := range []string{file.OldPath, file.NewPath} {
+		if p != "" && !validPatchPath(p) {
+			return fmt.Errorf("Invalid path %q in patch", p)
+		}
+	}
+	// git apply leaves the checkouts of submodules alone
+	if file.OldMode == gitlinkMode || file.NewMode == gitlinkMode || file.IndexMode == gitlinkMode {
+		log.With(Fields{"file": name}).Debugf("Skipping change to submodule")
+		return nil
+	}
+
+	var old *TreeFile
+	if file.OldPath != "" {
+		var err error
+		old, err = t.ReadFile(file.OldPath)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return fmt.Errorf("%v does not exist", file.OldPath)
+		}
+		expected := file.OldMode
+		if expected == "" {
+			expected = file.IndexMode
+		}
+		if expected != "" && (expected == symlinkMode) != (old.Mode == symlinkMode) {
+			return fmt.Errorf("%v has the wrong type, expected mode %v but found %v", file.OldPath, expected, old.Mode)
+		}
+		if expected != "" && expected != old.Mode {
+			log.With(Fields{"file": file.OldPath}).Warnf("File has mode %v, expected %v", old.Mode, expected)
+		}
+	}
+	if file.NewPath != "" && file.NewPath != file.OldPath {
+		existing, err := t.ReadFile(file.NewPath)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%v already exists", file.NewPath)
+		}
+	}
+
+	var data []byte
+	mode := "100644"
+	if old != nil {
+		data, mode = old.Data, old.Mode
+	}
+	var err error
+	if file.Binary {
+		data, err = applyBinaryPatch(file, name, data)
+	} else {
+		data, err = applyHunks(file, name, data, log)
+	}
+	if err != nil {
+		return err
+	}
+
+	if file.NewPath == "" {
+		if len(data) > 0 {
+			return fmt.Errorf("Patch removing %v leaves contents in it", file.OldPath)
+		}
+		t.changes[file.OldPath] = nil
+		return nil
+	}
+	if file.NewMode != "" {
+		mode = file.NewMode
+	}
+	if file.Rename {
+		t.changes[file.OldPath] = nil
+	}
+	t.changes[file.NewPath] = &TreeFile{Mode: mode, Data: data}
+	return nil
+}
+
+// A line of a file being patched, which later hunks may not match once a
+// hunk has put it there
+type patchedLine struct {
+	text    []byte
+	patched bool
+}
+
+func applyHunks(file *FilePatch, name string, data []byte, log *Logger) ([]byte, error) {
+	if len(file.Hunks) == 0 {
+		return data, nil
+	}
+	image := []patchedLine{}
+	for _, line := range splitLines(data) {
+		image = append(image, patchedLine{text: line})
+	}
+
+	for i, hunk := range file.Hunks {
+		var preimage, postimage [][]byte
+		trailing := 0
+		for _, line := range hunk.Lines {
+			switch line.Op {
+			case ' ':
+				preimage = append(preimage, line.Text)
+				postimage = append(postimage, line.Text)
+				trailing++
+			case '-':
+				preimage = append(preimage, line.Text)
+				trailing = 0
+			case '+':
+				postimage = append(postimage, line.Text)
+				trailing = 0
+			}
+		}
+
+		// Hunks at the start of the file must apply there, and hunks
+		// without trailing context at its end. Other hunks are tried at the
+		// line they name in the file as patched so far, then at growing
+		// offsets after and before it.
+		matchBeginning := hunk.OldStart <= 1
+		matchEnd := trailing == 0
+		start := 0
+		switch {
+		case matchBeginning:
+		case matchEnd:
+			start = len(image) - len(preimage)
+		case hunk.NewStart > 0:
+			start = hunk.NewStart - 1
+		}
+		if start < 0 {
+			start = 0
+		} else if start > len(image) {
+			start = len(image)
+		}
+		pos := findHunk(image, preimage, start, matchBeginning, matchEnd)
+		if pos < 0 {
+			hunkErr := &HunkError{
+				Path:      name,
+				Hunk:      i + 1,
+				Header:    hunk.Header,
+				PatchLine: hunk.Line,
+				Line:      start + 1,
+				AtStart:   matchBeginning,
+				AtEnd:     matchEnd,
+				Expected:  []string{},
+				Found:     []string{},
+			}
+			found := len(preimage)
+			if matchEnd {
+				// Show that the file goes on
+				found += 3
+			}
+			for j := start; j < start+found && j < len(image); j++ {
+				hunkErr.Found = append(hunkErr.Found, string(image[j].text))
+			}
+			for _, line := range preimage {
+				hunkErr.Expected = append(hunkErr.Expected, string(line))
+			}
+			return nil, hunkErr
+		}
+		if pos != start {
+			log.With(Fields{"file": name, "hunk": i + 1}).Infof("Hunk applied at line %v, offset %v lines", pos+1, pos-start)
+		}
+
+		lines := make([]patchedLine, 0, len(image)-len(preimage)+len(postimage))
+		lines = append(lines, image[:pos]...)
+		for _, line := range postimage {
+			lines = append(lines, patchedLine{text: line, patched: true})
+		}
+		image = append(lines, image[pos+len(preimage):]...)
+	}
+
+	var result bytes.Buffer
+	for _, line := range image {
+		result.Write(line.text)
+	}
+	return result.Bytes(), nil
+}
+
+// Returns the line at which preimage matches image, or -1, trying the
+// lines from start in the order git apply does
+func findHunk(image []patchedLine, preimage [][]byte, start int, matchBeginning bool, matchEnd bool) int {
+	if len(preimage) > len(image) {
+		return -1
+	}
+	backwards, forwards, try := start, start, start
+	for i := 0; ; i++ {
+		if hunkMatches(image, preimage, try, matchBeginning, matchEnd) {
+			return try
+		}
+		for {
+			if backwards == 0 && forwards == len(image) {
+				return -1
+			}
+			if i%2 == 1 {
+				if backwards == 0 {
+					i++
+					continue
+				}
+				backwards--
+				try = backwards
+			} else {
+				if forwards == len(image) {
+					i++
+					continue
+				}
+				forwards++
+				try = forwards
+			}
+			break
+		}
+	}
+}
+
+// Matches preimage at line pos of image as git apply does, which compares
+// the bytes of the whole preimage with the image from that line on, after
+// checking a hash of each line. A last line without a newline may so match a
+// line of the image which continues with whitespace, all of which the hunk
+// replaces.
+func hunkMatches(image []patchedLine, preimage [][]byte, pos int, matchBeginning bool, matchEnd bool) bool {
+	end := pos + len(preimage)
+	if end > len(image) || (matchEnd && end != len(image)) || (matchBeginning && pos != 0) {
+		return false
+	}
+	for i, line := range preimage {
+		imageLine := image[pos+i]
+		if imageLine.patched || lineHash(imageLine.text) != lineHash(line) {
+			return false
+		}
+		if i < len(preimage)-1 || matchEnd {
+			if !bytes.Equal(imageLine.text, line) {
+				return false
+			}
+		} else if !bytes.HasPrefix(imageLine.text, line) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hashes a line ignoring whitespace, as git apply does
+func lineHash(line []byte) uint32 {
+	var h uint32
+	for _, c := range line {
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			h = h*3 + uint32(c)
+		}
+	}
+	return h
+}
+
+// Returns the id git gives a blob of data, in the hash, SHA-1 or SHA-256,
+// whose ids are as long as like
+func blobId(data []byte, like string) string {
+	header := fmt.Sprintf("blob %v\x00", len(data))
+	if len(like) == 64 {
+		sum := sha256.Sum256(append([]byte(header), data...))
+		return hex.EncodeToString(sum[:])
+	}
+	sum := sha1.Sum(append([]byte(header), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+func isFullObjectId(id string) bool {
+	if len(id) != 40 && len(id) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Applies a git binary patch to data. Like git apply, careen requires the
+// full object ids of the old and new contents, and checks both.
+func applyBinaryPatch(file *FilePatch, name string, data []byte) ([]byte, error) {
+	if !isFullObjectId(file.OldIndex) || !isFullObjectId(file.NewIndex) {
+		return nil, fmt.Errorf("Cannot apply binary patch to %v without full index line", name)
+	}
+	if file.OldPath != "" {
+		if id := blobId(data, file.OldIndex); id != file.OldIndex {
+			return nil, fmt.Errorf("Binary patch applies to %v (%v), which does not match the current contents (%v)", name, file.OldIndex, id)
+		}
+	}
+	if strings.Trim(file.NewIndex, "0") == "" {
+		return []byte{}, nil
+	}
+	if file.BinaryData == nil {
+		return nil, fmt.Errorf("Missing binary patch data for %v", name)
+	}
+
+	result := file.BinaryData.Data
+	if file.BinaryData.Delta {
+		var err error
+		result, err = applyDelta(data, file.BinaryData.Data)
+		if err != nil {
+			return nil, fmt.Errorf("Binary patch does not apply to %v: %v", name, err)
+		}
+	}
+	if id := blobId(result, file.NewIndex); id != file.NewIndex {
+		return nil, fmt.Errorf("Binary patch to %v creates incorrect result (expecting %v, got %v)", name, file.NewIndex, id)
+	}
+	return result, nil
+}
+
+// Reads a size from the header of a git delta, 7 bits per byte with the
+// lowest first and the top bit set on all but the last byte
+func deltaSize(delta []byte) (uint64, []byte) {
+	var size uint64
+	for shift := uint(0); len(delta) > 0 && shift < 64; shift += 7 {
+		b := delta[0]
+		delta = delta[1:]
+		size |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return size, delta
+}
+
+// Applies a git delta to base: after the sizes of base and the result, each
+// instruction either copies a range of base or inserts the bytes following it
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	baseSize, delta := deltaSize(delta)
+	if baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("delta is for %v bytes, not %v", baseSize, len(base))
+	}
+	resultSize, delta := deltaSize(delta)
+	result := make([]byte, 0, resultSize)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			// The low 4 bits say which bytes of the offset follow, the
+			// next 3 which bytes of the size
+			var offset, size uint64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, fmt.Errorf("delta ends early")
+				}
+				if i < 4 {
+					offset |= uint64(delta[0]) << (8 * i)
+				} else {
+					size |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, fmt.Errorf("delta copies beyond the end of the old contents")
+			}
+			result = append(result, base[offset:offset+size]...)
+		case op != 0:
+			if int(op) > len(delta) {
+				return nil, fmt.Errorf("delta ends early")
+			}
+			result = append(result, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, fmt.Errorf("invalid delta instruction")
+		}
+	}
+	if uint64(len(result)) != resultSize {
+		return nil, fmt.Errorf("delta makes %v bytes, not %v", len(result), resultSize)
+	}
+	return result, nil
+}
+
+// Writes the changed files to the directory dir as git apply does: the old
+// files are removed first, along with the directories this leaves empty,
+// then the new ones created with mode 0666, or 0777 if executable, less the
+// umask
+func (t *PatchedTree) Write(dir string) error {
+	names := t.Changed()
+	tree := DirTree(dir)
+	for _, name := range names {
+		filename, err := tree.path(name)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filename); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+		if t.changes[name] == nil {
+			for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+				if os.Remove(filepath.Join(dir, filepath.FromSlash(parent))) != nil {
+					break
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		file := t.changes[name]
+		if file == nil {
+			continue
+		}
+		filename, err := tree.path(name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			return err
+		}
+		if file.Mode == symlinkMode {
+			if err := os.Symlink(string(file.Data), filename); err != nil {
+				return err
+			}
+			continue
+		}
+		perm := os.FileMode(0666)
+		if file.executable() {
+			perm = 0777
+		}
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(file.Data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,445 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A patch made with git diff from old to new, applied to base, or to old if
+// base is nil. git apply fails to apply it if fails is set.
+type gitApplyTest struct {
+	name     string
+	old      MemoryTree
+	new      MemoryTree
+	base     MemoryTree
+	diffArgs []string
+	fails    bool
+}
+
+func textFile(data string) *TreeFile {
+	return &TreeFile{Mode: "100644", Data: []byte(data)}
+}
+
+func numberedLines(from int, to int) string {
+	var b bytes.Buffer
+	for i := from; i <= to; i++ {
+		b.WriteString("line ")
+		b.WriteString(strings.Repeat("x", i%7))
+		b.WriteString(string('a' + rune(i%26)))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func gitApplyTests() []gitApplyTest {
+	lines := numberedLines(1, 40)
+	changed := strings.Replace(lines, "line xxxxxxu\n", "changed\n", 1)
+	blob := randomData(1, 8192)
+	changedBlob := append([]byte{}, blob...)
+	copy(changedBlob[4000:], "changed")
+
+	return []gitApplyTest{
+		{
+			name: "offset",
+			old:  MemoryTree{"a.txt": textFile(lines)},
+			new:  MemoryTree{"a.txt": textFile(changed)},
+			base: MemoryTree{"a.txt": textFile("added\nabove\n" + lines)},
+		},
+		{
+			name: "offset below",
+			old:  MemoryTree{"a.txt": textFile(lines)},
+			new:  MemoryTree{"a.txt": textFile(changed)},
+			base: MemoryTree{"a.txt": textFile(strings.Replace(lines, "line xxxd\n", "", 1))},
+		},
+		{
+			name:     "no context at end",
+			old:      MemoryTree{"a.txt": textFile(lines)},
+			new:      MemoryTree{"a.txt": textFile(lines + "appended\n")},
+			diffArgs: []string{"-U0"},
+		},
+		{
+			name:     "no context at start",
+			old:      MemoryTree{"a.txt": textFile(lines)},
+			new:      MemoryTree{"a.txt": textFile("prepended\n" + lines)},
+			diffArgs: []string{"-U0"},
+			fails:    true,
+		},
+		{
+			name:     "no context in the middle",
+			old:      MemoryTree{"a.txt": textFile(lines)},
+			new:      MemoryTree{"a.txt": textFile(changed)},
+			diffArgs: []string{"-U0"},
+			fails:    true,
+		},
+		{
+			name: "no newline at end",
+			old:  MemoryTree{"a.txt": textFile("a\nb\nc")},
+			new:  MemoryTree{"a.txt": textFile("a\nb\nC")},
+		},
+		{
+			name: "newline removed at end",
+			old:  MemoryTree{"a.txt": textFile("a\nb\nc\n")},
+			new:  MemoryTree{"a.txt": textFile("a\nb\nc")},
+		},
+		{
+			name: "newline added at end",
+			old:  MemoryTree{"a.txt": textFile("a\nb\nc")},
+			new:  MemoryTree{"a.txt": textFile("a\nb\nc\n")},
+		},
+		{
+			name: "crlf",
+			old:  MemoryTree{"a.txt": textFile("a\r\nb\r\nc\r\nd\r\n")},
+			new:  MemoryTree{"a.txt": textFile("a\r\nB\r\nc\r\nd\r\n")},
+		},
+		{
+			name:  "crlf applied to lf",
+			old:   MemoryTree{"a.txt": textFile("a\r\nb\r\nc\r\nd\r\n")},
+			new:   MemoryTree{"a.txt": textFile("a\r\nB\r\nc\r\nd\r\n")},
+			base:  MemoryTree{"a.txt": textFile("a\nb\nc\nd\n")},
+			fails: true,
+		},
+		{
+			name:     "rename",
+			old:      MemoryTree{"src/old.txt": textFile(lines)},
+			new:      MemoryTree{"dst/new.txt": textFile(changed)},
+			diffArgs: []string{"-M"},
+		},
+		{
+			name:     "copy",
+			old:      MemoryTree{"a.txt": textFile(lines)},
+			new:      MemoryTree{"a.txt": textFile(lines), "b.txt": textFile(changed)},
+			diffArgs: []string{"-C", "--find-copies-harder"},
+		},
+		{
+			name: "mode change",
+			old:  MemoryTree{"run.sh": textFile("echo hi\n")},
+			new:  MemoryTree{"run.sh": &TreeFile{Mode: "100755", Data: []byte("echo hi\n")}},
+		},
+		{
+			name: "mode and content change",
+			old:  MemoryTree{"run.sh": &TreeFile{Mode: "100755", Data: []byte("echo hi\n")}},
+			new:  MemoryTree{"run.sh": textFile("echo bye\n")},
+		},
+		{
+			name: "create and delete",
+			old:  MemoryTree{"dir/gone.txt": textFile(lines), "kept.txt": textFile("kept\n")},
+			new:  MemoryTree{"kept.txt": textFile("kept\n"), "new/file.txt": textFile("new\n")},
+		},
+		{
+			name: "symlink retarget",
+			old:  MemoryTree{"link": &TreeFile{Mode: symlinkMode, Data: []byte("a.txt")}, "a.txt": textFile("a\n")},
+			new:  MemoryTree{"link": &TreeFile{Mode: symlinkMode, Data: []byte("b.txt")}, "a.txt": textFile("a\n")},
+		},
+		{
+			name:     "binary literal",
+			old:      MemoryTree{"a.txt": textFile("a\n")},
+			new:      MemoryTree{"a.txt": textFile("a\n"), "small.bin": &TreeFile{Mode: "100644", Data: randomData(2, 100)}},
+			diffArgs: []string{"--binary"},
+		},
+		{
+			name:     "binary delta",
+			old:      MemoryTree{"big.bin": &TreeFile{Mode: "100644", Data: blob}},
+			new:      MemoryTree{"big.bin": &TreeFile{Mode: "100644", Data: changedBlob}},
+			diffArgs: []string{"--binary"},
+		},
+		{
+			name:     "binary delta applied to other contents",
+			old:      MemoryTree{"big.bin": &TreeFile{Mode: "100644", Data: blob}},
+			new:      MemoryTree{"big.bin": &TreeFile{Mode: "100644", Data: changedBlob}},
+			base:     MemoryTree{"big.bin": &TreeFile{Mode: "100644", Data: randomData(3, 8192)}},
+			diffArgs: []string{"--binary"},
+			fails:    true,
+		},
+		{
+			name:  "binary without data",
+			old:   MemoryTree{"big.bin": &TreeFile{Mode: "100644", Data: blob}},
+			new:   MemoryTree{"big.bin": &TreeFile{Mode: "100644", Data: changedBlob}},
+			fails: true,
+		},
+		{
+			name: "quoted names",
+			old:  MemoryTree{"café \"menu\".txt": textFile(lines), "tab\there": textFile("a\n")},
+			new:  MemoryTree{"café \"menu\".txt": textFile(changed), "tab\there": textFile("b\n")},
+		},
+		{
+			name:  "context mismatch",
+			old:   MemoryTree{"a.txt": textFile(lines)},
+			new:   MemoryTree{"a.txt": textFile(changed)},
+			base:  MemoryTree{"a.txt": textFile(strings.Replace(lines, "line xxxxxt\n", "other\n", 1))},
+			fails: true,
+		},
+	}
+}
+
+// Runs git with the user's and system's config ignored
+func runTestGit(t *testing.T, dir string, args ...string) []byte {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "HOME="+dir, "XDG_CONFIG_HOME="+dir,
+		"GIT_CEILING_DIRECTORIES="+filepath.Dir(dir))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", strings.Join(args, " "), err, stderr.Bytes())
+	}
+	return out
+}
+
+func writeTestTree(t *testing.T, dir string, tree MemoryTree) {
+	for name, file := range tree {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(filename)
+		if file.Mode == symlinkMode {
+			if err := os.Symlink(string(file.Data), filename); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		perm := os.FileMode(0644)
+		if file.executable() {
+			perm = 0755
+		}
+		if err := ioutil.WriteFile(filename, file.Data, perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filename, perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Reads the files below dir, leaving out .git and the empty directories
+func readTestTree(t *testing.T, dir string) MemoryTree {
+	tree := MemoryTree{}
+	err := filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		tree[name], err = DirTree(dir).ReadFile(name)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// Returns the patch git diff makes from old to new
+func makeTestPatch(t *testing.T, dir string, test gitApplyTest) []byte {
+	repoDir := filepath.Join(dir, "repo")
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, repoDir, "init", "-q")
+	writeTestTree(t, repoDir, test.old)
+	runTestGit(t, repoDir, "add", "-A")
+	runTestGit(t, repoDir, "-c", "user.name=careen", "-c", "user.email=careen@example.com", "commit", "-q", "-m", "old")
+	for name := range test.old {
+		if err := os.Remove(filepath.Join(repoDir, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestTree(t, repoDir, test.new)
+	runTestGit(t, repoDir, "add", "-A")
+	args := append([]string{"diff", "--cached", "--no-color", "--no-ext-diff"}, test.diffArgs...)
+	return runTestGit(t, repoDir, args...)
+}
+
+func TestApplyPatchFileMatchesGitApply(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	for _, test := range gitApplyTests() {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		patch := makeTestPatch(t, dir, test)
+		patchPath := filepath.Join(dir, "test.patch")
+		if err := ioutil.WriteFile(patchPath, patch, 0644); err != nil {
+			t.Fatal(err)
+		}
+		base := test.base
+		if base == nil {
+			base = test.old
+		}
+
+		gitDir := filepath.Join(dir, "git")
+		careenDir := filepath.Join(dir, "careen")
+		for _, d := range []string{gitDir, careenDir} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestTree(t, d, base)
+		}
+
+		cmd := exec.Command("git", "apply", patchPath)
+		cmd.Dir = gitDir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "HOME="+dir, "GIT_CEILING_DIRECTORIES="+dir)
+		gitOut, gitErr := cmd.CombinedOutput()
+		err := ApplyPatchFile(context.Background(), careenDir, patchPath, 0, discardLogger)
+
+		switch {
+		case (gitErr != nil) != test.fails:
+			t.Errorf("%v: git apply error = %v, want failure %v: %s\n%s", test.name, gitErr, test.fails, gitOut, patch)
+		case gitErr == nil && err != nil:
+			t.Errorf("%v: git apply succeeded, careen failed: %v\n%s", test.name, err, patch)
+		case gitErr != nil && err == nil:
+			t.Errorf("%v: careen succeeded, git apply failed: %s\n%s", test.name, gitOut, patch)
+		}
+		if got, want := readTestTree(t, careenDir), readTestTree(t, gitDir); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: careen made %v, git apply made %v", test.name, describeTestTree(got), describeTestTree(want))
+		}
+		if test.name == "context mismatch" {
+			if _, ok := err.(*HunkError); !ok {
+				t.Errorf("%v: error %v is not a HunkError", test.name, err)
+			}
+		}
+	}
+}
+
+func describeTestTree(tree MemoryTree) string {
+	names := []string{}
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n  %q %v %q", name, tree[name].Mode, tree[name].Data)
+	}
+	return b.String()
+}
+
+const dryRunPatch = `diff --git a/a.txt b/a.txt
+index de98044..0f7bc76 100644
+--- a/a.txt
++++ b/a.txt
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+diff --git a/gone.txt b/gone.txt
+deleted file mode 100644
+index 7898192..0000000
+--- a/gone.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-a
+diff --git a/new/file.txt b/new/file.txt
+new file mode 100755
+index 0000000..3e75765
+--- /dev/null
++++ b/new/file.txt
+@@ -0,0 +1 @@
++new
+`
+
+const failingDryRunPatch = `diff --git a/new/file.txt b/new/file.txt
+index 3e75765..6178079 100755
+--- a/new/file.txt
++++ b/new/file.txt
+@@ -1 +1 @@
+-new
++newer
+diff --git a/a.txt b/a.txt
+index de98044..0f7bc76 100644
+--- a/a.txt
++++ b/a.txt
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+`
+
+func TestPatchedTreeDryRun(t *testing.T) {
+	base := MemoryTree{"a.txt": textFile("a\nb\nc\n"), "gone.txt": textFile("a\n")}
+	tree := NewPatchedTree(base)
+
+	files, err := ParsePatch([]byte(dryRunPatch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Apply(context.Background(), files, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	want := MemoryTree{
+		"a.txt":        textFile("a\nB\nc\n"),
+		"gone.txt":     nil,
+		"new/file.txt": &TreeFile{Mode: "100755", Data: []byte("new\n")},
+	}
+	checkDryRun := func() {
+		for name, wantFile := range want {
+			if file, err := tree.ReadFile(name); err != nil || !reflect.DeepEqual(file, wantFile) {
+				t.Errorf("%v is %+v, %v, want %+v", name, file, err, wantFile)
+			}
+		}
+		if changed := tree.Changed(); !reflect.DeepEqual(changed, []string{"a.txt", "gone.txt", "new/file.txt"}) {
+			t.Errorf("Changed() = %q", changed)
+		}
+	}
+	checkDryRun()
+	if !reflect.DeepEqual(base, MemoryTree{"a.txt": textFile("a\nb\nc\n"), "gone.txt": textFile("a\n")}) {
+		t.Errorf("dry run changed the base tree: %v", describeTestTree(base))
+	}
+
+	// A patch which does not apply whole changes nothing, even the files
+	// before the one failing
+	files, err = ParsePatch([]byte(failingDryRunPatch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Apply(context.Background(), files, discardLogger); err == nil {
+		t.Error("patch applied twice")
+	} else if hunkErr, ok := err.(*HunkError); !ok || hunkErr.Path != "a.txt" {
+		t.Errorf("error %v is not a HunkError of a.txt", err)
+	}
+	checkDryRun()
+}
@@ -0,0 +1,183 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Checks that name can be used as a single file name, so that it cannot refer
+// to another directory
+func validateFileName(kind string, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%v is empty", kind)
+	case name == "." || name == "..":
+		return fmt.Errorf("%v %q is not a valid name", kind, name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("%v %q must not contain path separators", kind, name)
+	}
+	return nil
+}
+
+// Checks that p is a relative path which stays below the directory it is
+// relative to
+func validateRelativePath(kind string, p string) error {
+	switch {
+	case p == "":
+		return fmt.Errorf("%v is empty", kind)
+	case filepath.IsAbs(p) || strings.HasPrefix(p, "/") || strings.HasPrefix(p, "\\"):
+		return fmt.Errorf("%v %q must be a relative path", kind, p)
+	case strings.ContainsRune(p, 0):
+		return fmt.Errorf("%v %q contains a NUL character", kind, p)
+	}
+	for _, part := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return fmt.Errorf("%v %q must not contain ..", kind, p)
+		}
+	}
+	return nil
+}
+
+// Joins the relative path rel to root, failing if the result is not below root
+func SafeJoin(root string, rel string) (string, error) {
+	if err := validateRelativePath("path", rel); err != nil {
+		return "", err
+	}
+	joined := filepath.Join(root, rel)
+	if inside, err := isInside(filepath.Clean(root), joined); err != nil {
+		return "", err
+	} else if !inside {
+		return "", fmt.Errorf("path %q is outside %v", rel, root)
+	}
+	return joined, nil
+}
+
+// Reports whether p is root or below it, comparing paths without resolving
+// symlinks
+func isInside(root string, p string) (bool, error) {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false, err
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// Most symlinks followed resolving one path, as Linux allows
+const maxSymlinks = 40
+
+// Resolves the symlinks of p as the system would when opening it, checking
+// each component with Lstat. Unlike filepath.Clean, ".." after a symlink
+// refers to the parent of where the symlink points. Components which do not
+// exist yet are taken as they are.
+func resolvePath(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		p = wd + string(filepath.Separator) + p
+	}
+	root := filepath.VolumeName(p) + string(filepath.Separator)
+	resolved := root
+	pending := splitPath(p[len(filepath.VolumeName(p)):])
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			resolved = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%v: too many levels of symlinks", p)
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = filepath.VolumeName(target) + string(filepath.Separator)
+			target = target[len(filepath.VolumeName(target)):]
+		}
+		pending = append(splitPath(target), pending...)
+	}
+	return resolved, nil
+}
+
+// Returns the non-empty components of p
+func splitPath(p string) []string {
+	return strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == filepath.Separator })
+}
+
+// Checks that no symlink at or below root redirects p, which is below root,
+// to somewhere outside root. p need not exist yet.
+func CheckNoSymlinkEscape(root string, p string) error {
+	realRoot, err := resolvePath(root)
+	if err != nil {
+		return err
+	}
+	realPath, err := resolvePath(p)
+	if err != nil {
+		return err
+	}
+	if inside, err := isInside(realRoot, realPath); err != nil {
+		return err
+	} else if !inside {
+		return fmt.Errorf("%v leads outside %v through a symlink, to %v", p, root, realPath)
+	}
+	return nil
+}
+
+// Returns the directory of the package within outputDir, checking that no
+// symlink redirects it elsewhere. Only local packages with symlink set may be
+// links, which cloneLocal checks point to their path.
+func packageDir(outputDir string, pkg *Package) (string, error) {
+	repoDir, err := SafeJoin(outputDir, pkg.Name)
+	if err != nil {
+		return "", fmt.Errorf("package %v: %v", pkg.Name, err)
+	}
+	if pkg.SourceType() == SourceLocal && pkg.Local != nil && pkg.Local.Symlink {
+		return repoDir, CheckNoSymlinkEscape(outputDir, filepath.Dir(repoDir))
+	}
+	return repoDir, CheckNoSymlinkEscape(outputDir, repoDir)
+}
+
+// Returns the path of the patch file within patchDir
+func patchFilename(patchDir string, patch *Patch) (string, error) {
+	patchName, err := SafeJoin(patchDir, patch.Filename)
+	if err != nil {
+		return "", fmt.Errorf("patch %v: %v", patch.Name, err)
+	}
+	return patchName, nil
+}
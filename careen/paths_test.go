@@ -0,0 +1,162 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"fix.patch", ""},
+		{"..fix", ""},
+		{"", "is empty"},
+		{".", "is not a valid name"},
+		{"..", "is not a valid name"},
+		{"../fix.patch", "must not contain path separators"},
+		{"/etc/passwd", "must not contain path separators"},
+		{`..\fix.patch`, "must not contain path separators"},
+		{"fix\x00.patch", "must not contain path separators"},
+	}
+	for _, test := range tests {
+		err := validateFileName("filename", test.name)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("validateFileName(%q): %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("validateFileName(%q) = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	root := filepath.FromSlash("/out/pkg")
+	tests := []struct {
+		rel  string
+		want string
+		err  string
+	}{
+		{"file.c", "/out/pkg/file.c", ""},
+		{"src/./lib/file.c", "/out/pkg/src/lib/file.c", ""},
+		{"..file", "/out/pkg/..file", ""},
+		{"", "", "is empty"},
+		{"..", "", "must not contain .."},
+		{"../other/file.c", "", "must not contain .."},
+		{"src/../../file.c", "", "must not contain .."},
+		{`src\..\..\file.c`, "", "must not contain .."},
+		{"/etc/passwd", "", "must be a relative path"},
+		{`\etc\passwd`, "", "must be a relative path"},
+		{"file\x00.c", "", "contains a NUL character"},
+	}
+	for _, test := range tests {
+		got, err := SafeJoin(root, test.rel)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("SafeJoin(%q): %v", test.rel, err)
+		case test.err == "" && got != filepath.FromSlash(test.want):
+			t.Errorf("SafeJoin(%q) = %q, want %q", test.rel, got, test.want)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("SafeJoin(%q) = %q, %v, want %q", test.rel, got, err, test.err)
+		}
+	}
+}
+
+func TestCheckNoSymlinkEscape(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	pkg := filepath.Join(dir, "out", "pkg")
+	writeTestTree(t, dir, MemoryTree{
+		"out/pkg/src/file.c":  textFile("int x;\n"),
+		"out/pkg/inside":      {Mode: symlinkMode, Data: []byte("src")},
+		"out/pkg/up":          {Mode: symlinkMode, Data: []byte("src/..")},
+		"out/pkg/escape":      {Mode: symlinkMode, Data: []byte("../../secret")},
+		"out/pkg/absolute":    {Mode: symlinkMode, Data: []byte(filepath.Join(dir, "secret"))},
+		"out/pkg/src/sibling": {Mode: symlinkMode, Data: []byte("../../other")},
+		"out/pkg/chain":       {Mode: symlinkMode, Data: []byte("src/sibling")},
+		"out/pkg/loop":        {Mode: symlinkMode, Data: []byte("loop")},
+		"out/other/file.c":    textFile("int y;\n"),
+		"secret/key":          textFile("secret\n"),
+	})
+	// Through inside, .. refers to the parent of src, not of inside
+	writeTestTree(t, dir, MemoryTree{
+		"out/pkg/src/deep/file.c": textFile("int z;\n"),
+		"out/pkg/deep":            {Mode: symlinkMode, Data: []byte("src/deep")},
+	})
+
+	tests := []struct {
+		path string
+		err  string
+	}{
+		{"src/file.c", ""},
+		{"inside/file.c", ""},
+		{"up/src/file.c", ""},
+		{"deep/../file.c", ""},
+		{"missing/file.c", ""},
+		{"escape/key", "leads outside"},
+		{"escape", "leads outside"},
+		{"absolute/key", "leads outside"},
+		{"src/sibling/file.c", "leads outside"},
+		{"chain/file.c", "leads outside"},
+		{"inside/../../other/file.c", "leads outside"},
+		{"loop/file.c", "too many levels of symlinks"},
+	}
+	for _, test := range tests {
+		err := CheckNoSymlinkEscape(pkg, filepath.Join(pkg, filepath.FromSlash(test.path)))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("CheckNoSymlinkEscape(%v): %v", test.path, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("CheckNoSymlinkEscape(%v) = %v, want %q", test.path, err, test.err)
+		}
+	}
+}
+
+func TestPackageDirRejectsSymlinks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	outputDir := filepath.Join(dir, "out")
+	writeTestTree(t, dir, MemoryTree{
+		"out/linked":       {Mode: symlinkMode, Data: []byte("../elsewhere")},
+		"elsewhere/file.c": textFile("int x;\n"),
+	})
+
+	tests := []struct {
+		pkg Package
+		err string
+	}{
+		{Package{Name: "plain"}, ""},
+		{Package{Name: "linked"}, "leads outside"},
+		// Local packages with symlink set are the link itself
+		{Package{Name: "linked", Source: SourceLocal, Local: &LocalSource{Path: "../elsewhere", Symlink: true}}, ""},
+		{Package{Name: "../escape"}, "must not contain .."},
+	}
+	for _, test := range tests {
+		_, err := packageDir(outputDir, &test.pkg)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("packageDir(%v): %v", test.pkg.Name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("packageDir(%v) = %v, want %q", test.pkg.Name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Limits on what patches may change, read from the file named by
+// patches.policy. Binary patches, mode changes and symlinks are refused unless
+// allowed.
+type PatchPolicy struct {
+	// Globs of paths patches must not touch. * and ? do not match /, **
+	// matches any number of directories, a trailing / matches everything below
+	// a directory and globs without a / match the file name in any directory.
+	ForbiddenPaths   []string `yaml:"forbidden_paths,omitempty" json:"forbidden_paths,omitempty"`
+	AllowBinary      bool     `yaml:"allow_binary,omitempty" json:"allow_binary,omitempty"`
+	AllowModeChanges bool     `yaml:"allow_mode_changes,omitempty" json:"allow_mode_changes,omitempty"`
+	AllowSymlinks    bool     `yaml:"allow_symlinks,omitempty" json:"allow_symlinks,omitempty"`
+
+	forbidden []*regexp.Regexp
+}
+
+// Reads the policy file, in any manifest format
+func GetPatchPolicyFromFile(filename string) (*PatchPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	data, err = ConvertToYAML(data, ManifestFormatFromFilename(filename))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing patch policy %v: %v", filename, err)
+	}
+
+	policy := PatchPolicy{}
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("Error parsing patch policy %v: %v", filename, err)
+	}
+	for _, glob := range policy.ForbiddenPaths {
+		re, err := globRegexp(glob)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid forbidden path %q in patch policy %v: %v", glob, filename, err)
+		}
+		policy.forbidden = append(policy.forbidden, re)
+	}
+	return &policy, nil
+}
+
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	if glob == "" {
+		return nil, fmt.Errorf("empty glob")
+	}
+
+	var re bytes.Buffer
+	if !strings.Contains(strings.TrimSuffix(glob, "/"), "/") {
+		re.WriteString("^(.*/)?")
+	} else {
+		re.WriteString("^")
+	}
+	glob = strings.TrimPrefix(glob, "/")
+	dir := strings.HasSuffix(glob, "/")
+	glob = strings.TrimSuffix(glob, "/")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if dir {
+		re.WriteString("/.*$")
+	} else {
+		// Forbidding a directory forbids what is below it too
+		re.WriteString("(/.*)?$")
+	}
+	return regexp.Compile(re.String())
+}
+
+// Returns whether the path leaves the package root, e.g. ../x or /x
+func escapesRoot(p string) bool {
+	if path.IsAbs(p) {
+		return true
+	}
+	clean := path.Clean(p)
+	return clean == ".." || strings.HasPrefix(clean, "../")
+}
+
+// Returns a description of each way the patch's files break the policy
+func (p *PatchPolicy) Violations(files []*FilePatch) []string {
+	violations := []string{}
+	for _, file := range files {
+		paths := []string{}
+		for _, f := range []string{file.OldPath, file.NewPath} {
+			if f != "" && (len(paths) == 0 || paths[0] != f) {
+				paths = append(paths, f)
+			}
+		}
+
+		for _, f := range paths {
+			if escapesRoot(f) {
+				violations = append(violations, fmt.Sprintf("%v is outside the package root", f))
+				continue
+			}
+			for i, re := range p.forbidden {
+				if re.MatchString(path.Clean(f)) {
+					violations = append(violations, fmt.Sprintf("%v matches forbidden path %v", f, p.ForbiddenPaths[i]))
+					break
+				}
+			}
+		}
+
+		name := file.NewPath
+		if name == "" {
+			name = file.OldPath
+		}
+		if file.Binary && !p.AllowBinary {
+			violations = append(violations, fmt.Sprintf("%v is changed by a binary patch", name))
+		}
+		// The index line gives the mode of files keeping it, e.g. a symlink
+		// being retargeted
+		isSymlink := file.OldMode == symlinkMode || file.NewMode == symlinkMode || file.IndexMode == symlinkMode
+		if isSymlink && !p.AllowSymlinks {
+			violations = append(violations, fmt.Sprintf("%v is a symlink", name))
+		} else if file.OldMode != "" && file.NewMode != "" && file.OldMode != file.NewMode && !p.AllowModeChanges {
+			violations = append(violations, fmt.Sprintf("%v changes mode from %v to %v", name, file.OldMode, file.NewMode))
+		}
+	}
+	return violations
+}
+
+// Checks the patch file against the policy, reporting every violation
+func CheckPatchPolicy(patchPath string, policy *PatchPolicy) error {
+	data, err := ioutil.ReadFile(patchPath)
+	if err != nil {
+		return err
+	}
+	// Parsed like it is applied, so the check sees what the apply changes
+	files, err := ParsePatch(data)
+	if err != nil {
+		return fmt.Errorf("Error parsing patch %v: %v", patchPath, err)
+	}
+	if violations := policy.Violations(files); len(violations) > 0 {
+		return fmt.Errorf("Patch %v breaks the patch policy:\n  %v", patchPath, strings.Join(violations, "\n  "))
+	}
+	return nil
+}
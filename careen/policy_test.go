@@ -0,0 +1,118 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const symlinkRetargetPatch = `diff --git a/link b/link
+index 12a8d8a..3b7781e 120000
+--- a/link
++++ b/link
+@@ -1 +1 @@
+-target
+\ No newline at end of file
++/etc/passwd
+\ No newline at end of file
+`
+
+const policyTestPatch = `diff --git a/docs/README b/docs/README
+index 3b18e51..a042389 100644
+--- a/docs/README
++++ b/docs/README
+@@ -1,2 +1,2 @@
+--- a/vendor/x.go
+-old
++new
++--- b/vendor/x.go
+diff --git a/vendor/lib.go b/vendor/lib.go
+deleted file mode 100644
+index 3b18e51..0000000
+--- a/vendor/lib.go
++++ /dev/null
+@@ -1 +0,0 @@
+-package lib
+diff --git a/run.sh b/run.sh
+old mode 100644
+new mode 100755
+diff --git a/logo.png b/logo.png
+index 3b18e51..a042389 100644
+Binary files a/logo.png and b/logo.png differ
+`
+
+func testPatchPolicy(t *testing.T, dir string, policy string) *PatchPolicy {
+	filename := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(filename, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := GetPatchPolicyFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPatchPolicyViolations(t *testing.T) {
+	tests := []struct {
+		policy string
+		patch  string
+		want   []string
+	}{
+		{"allow_symlinks: false\n", symlinkRetargetPatch, []string{"link is a symlink"}},
+		{"allow_symlinks: true\n", symlinkRetargetPatch, []string{}},
+		{"forbidden_paths: [vendor/]\n", policyTestPatch, []string{
+			"vendor/lib.go matches forbidden path vendor/",
+			"run.sh changes mode from 100644 to 100755",
+			"logo.png is changed by a binary patch",
+		}},
+		{"{forbidden_paths: ['*.go'], allow_mode_changes: true, allow_binary: true}\n", policyTestPatch, []string{
+			"vendor/lib.go matches forbidden path *.go",
+		}},
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, test := range tests {
+		policy := testPatchPolicy(t, dir, test.policy)
+		files, err := ParsePatch([]byte(test.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := policy.Violations(files); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("policy %q: Violations = %q, want %q", test.policy, got, test.want)
+		}
+	}
+}
+
+func TestCheckPatchPolicyRejectsSymlinkRetarget(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	patchPath := filepath.Join(dir, "retarget.patch")
+	if err := ioutil.WriteFile(patchPath, []byte(symlinkRetargetPatch), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := testPatchPolicy(t, dir, "allow_symlinks: false\n")
+	err := CheckPatchPolicy(patchPath, policy)
+	if err == nil || !strings.Contains(err.Error(), "link is a symlink") {
+		t.Errorf("CheckPatchPolicy error = %v, want link is a symlink", err)
+	}
+}
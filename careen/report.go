@@ -0,0 +1,372 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	ReportFormatJSON  = "json"
+	ReportFormatJUnit = "junit"
+)
+
+const (
+	ReportPassed  = "passed"
+	ReportFailed  = "failed"
+	ReportSkipped = "skipped"
+)
+
+// Result of cloning, patching or verifying one package or patch
+type Result struct {
+	Package  string
+	Patch    string // Empty for the package itself
+	File     string
+	Hash     string // Hash, digest or revision checked
+	Status   string
+	Duration time.Duration
+	Message  string
+	Error    string
+	Output   string       // What the failed command wrote, such as git's diagnostics
+	Hooks    []HookResult // Hooks run for the package, in order
+	started  time.Time
+}
+
+func (e *Result) Start() {
+	e.started = time.Now()
+}
+
+func (e *Result) Pass() {
+	e.finish(ReportPassed)
+}
+
+func (e *Result) Fail(err error) {
+	e.Error = err.Error()
+	if cmdErr, ok := err.(*CommandError); ok {
+		e.Output = cmdErr.Output
+	}
+	e.finish(ReportFailed)
+}
+
+func (e *Result) Skip(message string) {
+	e.Message = message
+	e.finish(ReportSkipped)
+}
+
+func (e *Result) finish(status string) {
+	e.Status = status
+	if !e.started.IsZero() {
+		e.Duration = time.Since(e.started)
+	}
+}
+
+type reportPackage struct {
+	entry   *Result
+	patches []*Result
+}
+
+// Results of a clone, apply or verify run. Every package and patch has an
+// entry from the start, skipped unless it is run, so a run which stops at
+// the first failure still reports what it did not get to.
+type Report struct {
+	Command  string
+	Started  time.Time
+	Duration time.Duration
+	Errors   []string // Failures not specific to a package, such as a bad manifest
+	Entries  []*Result
+	packages map[string]*reportPackage
+}
+
+func NewReport(command string) *Report {
+	return &Report{
+		Command:  command,
+		Started:  time.Now(),
+		packages: map[string]*reportPackage{},
+	}
+}
+
+// Adds skipped entries for the packages and, if withPatches, their patches
+func (r *Report) AddPackages(packages []Package, withPatches bool) {
+	for i := range packages {
+		pkg := &packages[i]
+		rp := &reportPackage{entry: &Result{
+			Package: pkg.Name,
+			Hash:    packageHash(pkg),
+			Status:  ReportSkipped,
+		}}
+		r.Entries = append(r.Entries, rp.entry)
+		if withPatches {
+			for _, patch := range pkg.Patches {
+				entry := &Result{
+					Package: pkg.Name,
+					Patch:   patch.Name,
+					File:    patch.Filename,
+					Hash:    patch.Hash,
+					Status:  ReportSkipped,
+				}
+				rp.patches = append(rp.patches, entry)
+				r.Entries = append(r.Entries, entry)
+			}
+		}
+		r.packages[pkg.Name] = rp
+	}
+}
+
+// Returns the entry of the named package
+func (r *Report) Package(name string) *Result {
+	return r.packages[name].entry
+}
+
+// Returns the entry of the i-th patch of the named package
+func (r *Report) Patch(name string, i int) *Result {
+	return r.packages[name].patches[i]
+}
+
+// Records the results of finished packages and patches, for use as or in
+// Workspace.Events
+func (r *Report) HandleEvent(event Event) {
+	var entry *Result
+	switch event.Type {
+	case PackageFinished:
+		if rp, ok := r.packages[event.Package]; ok {
+			entry = rp.entry
+		}
+	case PatchFinished:
+		if rp, ok := r.packages[event.Package]; ok && event.Patch < len(rp.patches) {
+			entry = rp.patches[event.Patch]
+		}
+	default:
+		return
+	}
+	if entry == nil {
+		r.Entries = append(r.Entries, event.Result)
+		return
+	}
+	*entry = *event.Result
+}
+
+// Records a failure not specific to a package
+func (r *Report) Fail(err error) {
+	r.Errors = append(r.Errors, err.Error())
+}
+
+func (r *Report) Status() string {
+	if len(r.Errors) > 0 {
+		return ReportFailed
+	}
+	for _, entry := range r.Entries {
+		if entry.Status == ReportFailed {
+			return ReportFailed
+		}
+	}
+	return ReportPassed
+}
+
+// What a package entry records as checked: the archive digest or the git
+// revision
+func packageHash(pkg *Package) string {
+	switch pkg.SourceType() {
+	case SourceArchive:
+		if pkg.Archive != nil {
+			return pkg.Archive.Digest
+		}
+	case SourceGit:
+		return pkg.Revision
+	}
+	return ""
+}
+
+type jsonReport struct {
+	Command  string       `json:"command"`
+	Status   string       `json:"status"`
+	Started  string       `json:"started"`
+	Duration float64      `json:"duration"`
+	Errors   []string     `json:"errors,omitempty"`
+	Results  []jsonResult `json:"results"`
+}
+
+type jsonResult struct {
+	Package  string           `json:"package"`
+	Patch    string           `json:"patch,omitempty"`
+	File     string           `json:"file,omitempty"`
+	Hash     string           `json:"hash,omitempty"`
+	Status   string           `json:"status"`
+	Duration float64          `json:"duration"`
+	Message  string           `json:"message,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Output   string           `json:"output,omitempty"`
+	Hooks    []jsonHookResult `json:"hooks,omitempty"`
+}
+
+type jsonHookResult struct {
+	Hook     string  `json:"hook"`
+	Command  string  `json:"command"`
+	Duration float64 `json:"duration"`
+	Output   string  `json:"output,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Durations are in seconds, as in JSON logs
+func (r *Report) MarshalJSON() ([]byte, error) {
+	out := jsonReport{
+		Command:  r.Command,
+		Status:   r.Status(),
+		Started:  r.Started.UTC().Format(time.RFC3339Nano),
+		Duration: r.Duration.Seconds(),
+		Errors:   r.Errors,
+		Results:  []jsonResult{},
+	}
+	for _, e := range r.Entries {
+		result := jsonResult{
+			Package:  e.Package,
+			Patch:    e.Patch,
+			File:     e.File,
+			Hash:     e.Hash,
+			Status:   e.Status,
+			Duration: e.Duration.Seconds(),
+			Message:  e.Message,
+			Error:    e.Error,
+			Output:   e.Output,
+		}
+		for _, hook := range e.Hooks {
+			result.Hooks = append(result.Hooks, jsonHookResult{
+				Hook:     hook.Hook,
+				Command:  hook.Command,
+				Duration: hook.Duration.Seconds(),
+				Output:   hook.Output,
+				Error:    hook.Error,
+			})
+		}
+		out.Results = append(out.Results, result)
+	}
+	return json.MarshalIndent(out, "", "  ")
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// Writes a JUnit XML report with a test case per package and per patch, named
+// after the package, so CI systems show failed patches as failed tests
+func (r *Report) MarshalJUnit() ([]byte, error) {
+	suite := junitTestSuite{
+		Name:      "careen " + r.Command,
+		Time:      junitTime(r.Duration),
+		Timestamp: r.Started.UTC().Format("2006-01-02T15:04:05"),
+	}
+	for _, msg := range r.Errors {
+		suite.Errors++
+		suite.Cases = append(suite.Cases, junitTestCase{
+			ClassName: "careen",
+			Name:      r.Command,
+			Time:      junitTime(0),
+			Error:     &junitMessage{Message: msg},
+		})
+	}
+	for _, e := range r.Entries {
+		tc := junitTestCase{
+			ClassName: e.Package,
+			Name:      r.Command,
+			Time:      junitTime(e.Duration),
+		}
+		if e.Patch != "" {
+			tc.Name = e.Patch
+		}
+		var out []string
+		if e.File != "" {
+			out = append(out, "file: "+e.File)
+		}
+		if e.Hash != "" {
+			out = append(out, "hash: "+e.Hash)
+		}
+		for _, hook := range e.Hooks {
+			out = append(out, fmt.Sprintf("%v hook: %v (%vs)", hook.Hook, hook.Command, junitTime(hook.Duration)))
+			if hook.Output != "" {
+				out = append(out, strings.TrimRight(hook.Output, "\n"))
+			}
+			if hook.Error != "" {
+				out = append(out, "error: "+hook.Error)
+			}
+		}
+		tc.SystemOut = strings.Join(out, "\n")
+		switch e.Status {
+		case ReportFailed:
+			suite.Failures++
+			tc.Failure = &junitMessage{Message: e.Error, Text: e.Output}
+		case ReportSkipped:
+			suite.Skipped++
+			tc.Skipped = &junitMessage{Message: e.Message}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Tests = len(suite.Cases)
+
+	out, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+func (r *Report) WriteFile(filename string, format string) error {
+	var out []byte
+	var err error
+	switch format {
+	case ReportFormatJUnit:
+		out, err = r.MarshalJUnit()
+	default:
+		out, err = r.MarshalJSON()
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(out, '\n'), 0644)
+}
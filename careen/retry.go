@@ -0,0 +1,151 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Classes of errors a retry policy may retry
+const (
+	RetryNetwork = "network" // Connections refused, reset or cut short
+	RetryTimeout = "timeout"
+	RetryServer  = "server" // HTTP 5xx and 429 responses
+)
+
+var RetryErrorClasses = []string{RetryNetwork, RetryTimeout, RetryServer}
+
+// Operations with retry policies of their own, set under retry.<operation>
+const (
+	RetryClone    = "clone"    // Cloning git repositories
+	RetryFetch    = "fetch"    // Fetching submodules and LFS objects
+	RetryDownload = "download" // Downloading archives
+)
+
+// How often and how long to retry an operation which failed
+type RetryPolicy struct {
+	Attempts     int // Attempts in all, 1 for no retries
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64  // Each delay is the previous one times this
+	Errors       []string // Classes of errors retried
+}
+
+// Retry policy of every operation unless configured otherwise
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:     3,
+	InitialDelay: 2 * time.Second,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Errors:       RetryErrorClasses,
+}
+
+type RetryPolicies struct {
+	Clone    RetryPolicy
+	Fetch    RetryPolicy
+	Download RetryPolicy
+}
+
+// Error of an HTTP request answered with an unexpected status, which tells
+// retry policies whether the server may do better next time
+type HTTPStatusError struct {
+	Message    string
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return e.Message
+}
+
+// Reports whether values contains value
+func ContainsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the class of a transient error which a retry may not meet, or ""
+// for errors which would only happen again, such as a wrong digest
+func retryableClass(err error) string {
+	switch e := err.(type) {
+	case *HTTPStatusError:
+		if e.StatusCode >= 500 || e.StatusCode == 429 {
+			return RetryServer
+		}
+		return ""
+	case *url.Error:
+		if e.Timeout() {
+			return RetryTimeout
+		}
+		return retryableClass(e.Err)
+	case net.Error:
+		if e.Timeout() {
+			return RetryTimeout
+		}
+		return RetryNetwork
+	}
+	if err == io.ErrUnexpectedEOF {
+		return RetryNetwork
+	}
+	for _, classify := range gitErrorClassifiers {
+		if class := classify(err); class != "" {
+			return class
+		}
+	}
+	return ""
+}
+
+// Return the retry class of errors of the git backends careen was built
+// with, or "" for errors they do not know
+var gitErrorClassifiers = []func(error) string{cliGitErrorClass}
+
+// Runs op until it succeeds, fails with an error the policy does not retry
+// or has been attempted Attempts times. The first retry waits InitialDelay,
+// each next one Multiplier times longer, up to MaxDelay. op must undo what a
+// failed attempt left behind, so the next attempt starts afresh.
+func (p RetryPolicy) Do(ctx context.Context, log *Logger, op func() error) error {
+	delay := p.InitialDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || ctx.Err() != nil {
+			return interruptedError(ctx, err)
+		}
+		class := retryableClass(err)
+		if attempt >= p.Attempts || !ContainsString(p.Errors, class) {
+			return err
+		}
+
+		log.With(Fields{"attempt": attempt, "attempts": p.Attempts, "delay": delay, "error_class": class}).WithError(err).Warnf("Attempt failed, retrying")
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ErrInterrupted
+		}
+
+		delay = time.Duration(float64(delay) * p.Multiplier)
+		if delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryableClass(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&HTTPStatusError{StatusCode: 500}, RetryServer},
+		{&HTTPStatusError{StatusCode: 503}, RetryServer},
+		{&HTTPStatusError{StatusCode: 429}, RetryServer},
+		{&HTTPStatusError{StatusCode: 404}, ""},
+		{&HTTPStatusError{StatusCode: 403}, ""},
+		{refused, RetryNetwork},
+		{timeoutError{}, RetryTimeout},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: timeoutError{}}, RetryTimeout},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: refused}, RetryNetwork},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: errors.New("unsupported protocol scheme")}, ""},
+		{io.ErrUnexpectedEOF, RetryNetwork},
+		{&gitCommandError{Output: "fatal: unable to access: Could not resolve host: example.com"}, RetryNetwork},
+		{&gitCommandError{Output: "fatal: the remote end hung up unexpectedly"}, RetryNetwork},
+		{&gitCommandError{Output: "Operation timed out after 30000 milliseconds"}, RetryTimeout},
+		{&gitCommandError{Output: "The requested URL returned error: 502"}, RetryServer},
+		{&gitCommandError{Output: "The requested URL returned error: 404"}, ""},
+		{&gitCommandError{Output: "fatal: repository not found"}, ""},
+		// Errors which would only happen again
+		{errors.New("Computed hash a does not equal expected hash b"), ""},
+	}
+	for _, test := range tests {
+		if got := retryableClass(test.err); got != test.want {
+			t.Errorf("retryableClass(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+// Returns the delays of the retries logged as JSON in buf
+func loggedRetryDelays(t *testing.T, buf *bytes.Buffer) []time.Duration {
+	delays := []time.Duration{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		entry := struct {
+			Delay float64 `json:"delay"`
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		delays = append(delays, time.Duration(entry.Delay*float64(time.Second)))
+	}
+	return delays
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{
+		Attempts:     5,
+		InitialDelay: time.Millisecond,
+		MaxDelay:     5 * time.Millisecond,
+		Multiplier:   3,
+		Errors:       []string{RetryNetwork, RetryServer},
+	}
+	tests := []struct {
+		errs     []error
+		attempts int
+		err      error
+		delays   []time.Duration
+	}{
+		{nil, 1, nil, []time.Duration{}},
+		// Retried until success, each delay longer up to MaxDelay
+		{
+			[]error{io.ErrUnexpectedEOF, &HTTPStatusError{StatusCode: 503}, io.ErrUnexpectedEOF},
+			4, nil,
+			[]time.Duration{time.Millisecond, 3 * time.Millisecond, 5 * time.Millisecond},
+		},
+		// Given up after Attempts
+		{
+			[]error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, nil},
+			5, io.ErrUnexpectedEOF,
+			[]time.Duration{time.Millisecond, 3 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond},
+		},
+		// Classes the policy does not list, and errors of no class, are not retried
+		{[]error{timeoutError{}}, 1, timeoutError{}, []time.Duration{}},
+		{[]error{io.ErrUnexpectedEOF, &HTTPStatusError{StatusCode: 404}}, 2, &HTTPStatusError{StatusCode: 404}, []time.Duration{time.Millisecond}},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		log := NewLogger(&buf)
+		log.SetFormat(LogFormatJSON)
+
+		attempts := 0
+		err := policy.Do(context.Background(), log, func() error {
+			attempts++
+			if attempts <= len(test.errs) {
+				return test.errs[attempts-1]
+			}
+			return nil
+		})
+		if !reflect.DeepEqual(err, test.err) {
+			t.Errorf("%v: Do = %v, want %v", i, err, test.err)
+		}
+		if attempts != test.attempts {
+			t.Errorf("%v: %v attempts, want %v", i, attempts, test.attempts)
+		}
+		if delays := loggedRetryDelays(t, &buf); !reflect.DeepEqual(delays, test.delays) {
+			t.Errorf("%v: delays %v, want %v", i, delays, test.delays)
+		}
+	}
+}
+
+func TestRetryPolicyDoCancelledDuringDelay(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, InitialDelay: time.Hour, MaxDelay: time.Hour, Multiplier: 1, Errors: RetryErrorClasses}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- policy.Do(ctx, discardLogger, func() error {
+			attempts++
+			return io.ErrUnexpectedEOF
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != ErrInterrupted {
+			t.Errorf("Do = %v, want ErrInterrupted", err)
+		}
+		if attempts != 1 {
+			t.Errorf("%v attempts, want 1", attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Do kept waiting after the context was cancelled")
+	}
+
+	// An attempt failing because of the cancellation is not retried either
+	attempts = 0
+	err := policy.Do(ctx, discardLogger, func() error {
+		attempts++
+		return io.ErrUnexpectedEOF
+	})
+	if err != ErrInterrupted || attempts != 1 {
+		t.Errorf("Do with a cancelled context = %v after %v attempts, want ErrInterrupted after 1", err, attempts)
+	}
+}
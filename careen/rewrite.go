@@ -0,0 +1,85 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rewrites repository URLs matching either Prefix or Regex, similar to git's
+// url.<base>.insteadOf. Regex replacements may refer to groups as $1.
+type URLRewrite struct {
+	Prefix      string
+	Regex       string
+	Replacement string
+
+	regex *regexp.Regexp
+}
+
+// Checks the rules and compiles their regular expressions. Rules must be
+// compiled before they are used.
+func CompileURLRewrites(rewrites []URLRewrite) ([]URLRewrite, error) {
+	for i := range rewrites {
+		rewrite := &rewrites[i]
+		if (rewrite.Prefix == "") == (rewrite.Regex == "") {
+			return nil, fmt.Errorf("url.rewrites[%v] must have exactly one of prefix or regex", i)
+		}
+		if rewrite.Regex != "" {
+			regex, err := regexp.Compile(rewrite.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("url.rewrites[%v] has invalid regex: %v", i, err)
+			}
+			rewrite.regex = regex
+		}
+	}
+	return rewrites, nil
+}
+
+// Returns url rewritten by the rule matching the longest part of it, as git
+// picks the longest insteadOf prefix, or url itself if none match. Of rules
+// matching equally long parts, the first wins.
+func RewriteURL(url string, rewrites []URLRewrite) string {
+	best, bestLength := -1, -1
+	for i, rewrite := range rewrites {
+		if length := rewrite.matchLength(url); length > bestLength {
+			best, bestLength = i, length
+		}
+	}
+	if best < 0 {
+		return url
+	}
+	rewrite := rewrites[best]
+	if rewrite.regex != nil {
+		return rewrite.regex.ReplaceAllString(url, rewrite.Replacement)
+	}
+	return rewrite.Replacement + strings.TrimPrefix(url, rewrite.Prefix)
+}
+
+// Returns the length of the prefix or of the leftmost regex match in url, or
+// -1 if the rule does not match
+func (r *URLRewrite) matchLength(url string) int {
+	if r.regex != nil {
+		if loc := r.regex.FindStringIndex(url); loc != nil {
+			return loc[1] - loc[0]
+		}
+		return -1
+	}
+	if strings.HasPrefix(url, r.Prefix) {
+		return len(r.Prefix)
+	}
+	return -1
+}
@@ -0,0 +1,61 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"testing"
+)
+
+func TestRewriteURL(t *testing.T) {
+	rewrites, err := CompileURLRewrites([]URLRewrite{
+		{Prefix: "https://github.com/", Replacement: "https://mirror.example.com/github/"},
+		{Prefix: "https://github.com/samsung-cnct/", Replacement: "git@git.example.com:cnct/"},
+		{Regex: `^https://gitlab\.com/([^/]+)/`, Replacement: "https://mirror.example.com/gitlab-$1/"},
+		{Prefix: "https://gitlab.com/", Replacement: "https://other.example.com/"},
+		{Prefix: "https://github.com/samsung-cnct/", Replacement: "https://unused.example.com/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		// The longest prefix wins, whatever the order of the rules
+		{"https://github.com/samsung-cnct/careen.git", "git@git.example.com:cnct/careen.git"},
+		{"https://github.com/docker/docker.git", "https://mirror.example.com/github/docker/docker.git"},
+		// The regex matches more of the URL than the prefix does
+		{"https://gitlab.com/group/project.git", "https://mirror.example.com/gitlab-group/project.git"},
+		{"https://bitbucket.org/x/y.git", "https://bitbucket.org/x/y.git"},
+	}
+	for _, test := range tests {
+		if got := RewriteURL(test.url, rewrites); got != test.want {
+			t.Errorf("RewriteURL(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestCompileURLRewritesErrors(t *testing.T) {
+	for _, rewrite := range []URLRewrite{
+		{Replacement: "x"},
+		{Prefix: "a", Regex: "b", Replacement: "x"},
+		{Regex: "(", Replacement: "x"},
+	} {
+		if _, err := CompileURLRewrites([]URLRewrite{rewrite}); err == nil {
+			t.Errorf("%+v compiled without error", rewrite)
+		}
+	}
+}
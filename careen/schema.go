@@ -0,0 +1,134 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Descriptions shown by editors, keyed by type and JSON field name. Keep in
+// sync with the specification in the README.
+var schemaDescriptions = map[string]string{
+	"Manifest.version":         "Version of the manifest format",
+	"Manifest.include":         "Paths of manifests whose packages are merged into this one, relative to this manifest",
+	"Manifest.vars":            "Default values of variables used as ${NAME} in this and included manifests",
+	"Manifest.hooks":           "Hooks run for every package, before the package's own",
+	"Manifest.packages":        "Array of package",
+	"Package.name":             "Name of package",
+	"Package.repo":             "URL of the repository",
+	"Package.revision":         "Commit hash from the repository",
+	"Package.tag":              "Tag in repository",
+	"Package.submodules":       "Submodules to check out: none, recursive, or an array of submodule paths",
+	"Package.lfs":              "Replace Git LFS pointer files with the objects they name",
+	"Package.verify_signature": "Require the tag, the commit, or any of the two to be signed by a trusted key: none, tag, commit or any",
+	"Package.depends_on":       "Names of packages which must be cloned and patched before this one",
+	"Package.hooks":            "Hooks run for this package",
+	"Package.patches":          "Array of patch",
+	"Patch.name":               "Name of patch",
+	"Patch.filename":           "Filename of patch",
+	"Patch.hash":               "SHA-1 hash of file referred to by filename",
+	"Patch.documentation":      "Optional array of URLs to PR requests, bug reports, or other documentation",
+	"Hooks.pre_clone":          "Shell commands run in the output directory before cloning the package",
+	"Hooks.post_clone":         "Shell commands run in the package directory after cloning it",
+	"Hooks.pre_apply":          "Shell commands run in the package directory before applying its patches",
+	"Hooks.post_apply":         "Shell commands run in the package directory after applying its patches",
+}
+
+// Builds a JSON Schema for the manifest from the JSON tags of Manifest and the
+// types it refers to. Fields without omitempty are required.
+func ManifestSchema() map[string]interface{} {
+	definitions := map[string]interface{}{}
+	schema := schemaForStruct(reflect.TypeOf(Manifest{}), definitions)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "careen manifest"
+	schema["definitions"] = definitions
+	return schema
+}
+
+func schemaForStruct(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		options := strings.Split(tag, ",")
+		name := options[0]
+
+		property := schemaForType(field.Type, definitions)
+		if description, ok := schemaDescriptions[t.Name()+"."+name]; ok {
+			property["description"] = description
+		}
+		properties[name] = property
+
+		omitempty := false
+		for _, option := range options[1:] {
+			if option == "omitempty" {
+				omitempty = true
+			}
+		}
+		if !omitempty {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func schemaForType(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(Submodules{}) {
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "string", "enum": []string{SubmodulesNone, SubmodulesRecursive}},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		}}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem(), definitions)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaForType(t.Elem(), definitions)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaForType(t.Elem(), definitions)}
+	case reflect.Struct:
+		if _, ok := definitions[t.Name()]; !ok {
+			// Reserve the name first in case the type refers to itself
+			definitions[t.Name()] = nil
+			definitions[t.Name()] = schemaForStruct(t, definitions)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	default:
+		panic(fmt.Sprintf("No JSON Schema for manifest field of type %v", t))
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Returns the named packages and everything they depend on, minus the skipped
+// packages, in dependency order. No names selects every package.
+func SelectPackages(manifest *Manifest, names []string, skip []string) ([]Package, error) {
+	ordered, err := SortPackages(manifest.Packages)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]Package{}
+	for _, pkg := range manifest.Packages {
+		byName[pkg.Name] = pkg
+	}
+	for _, name := range append(append([]string{}, names...), skip...) {
+		if _, ok := byName[name]; !ok {
+			return nil, fmt.Errorf("Unknown package %v", name)
+		}
+	}
+
+	selected := map[string]bool{}
+	var selectWithDependencies func(name string)
+	selectWithDependencies = func(name string) {
+		if selected[name] {
+			return
+		}
+		selected[name] = true
+		for _, dependency := range byName[name].DependsOn {
+			selectWithDependencies(dependency)
+		}
+	}
+	if len(names) == 0 {
+		for _, pkg := range manifest.Packages {
+			selected[pkg.Name] = true
+		}
+	}
+	for _, name := range names {
+		selectWithDependencies(name)
+	}
+	for _, name := range skip {
+		selected[name] = false
+	}
+
+	packages := []Package{}
+	for _, pkg := range ordered {
+		if selected[pkg.Name] {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages, nil
+}
+
+// Orders packages so that each comes after the packages it depends on, keeping
+// the manifest order otherwise
+func SortPackages(packages []Package) ([]Package, error) {
+	byName := map[string]Package{}
+	for _, pkg := range packages {
+		byName[pkg.Name] = pkg
+	}
+	for _, pkg := range packages {
+		for _, dependency := range pkg.DependsOn {
+			if _, ok := byName[dependency]; !ok {
+				return nil, fmt.Errorf("Package %v depends on unknown package %v", pkg.Name, dependency)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	sorted := []Package{}
+	path := []string{}
+
+	var visit func(pkg Package) error
+	visit = func(pkg Package) error {
+		switch state[pkg.Name] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, name := range path {
+				if name == pkg.Name {
+					start = i
+				}
+			}
+			cycle := append(append([]string{}, path[start:]...), pkg.Name)
+			return fmt.Errorf("Dependency cycle between packages: %v", strings.Join(cycle, " -> "))
+		}
+
+		state[pkg.Name] = visiting
+		path = append(path, pkg.Name)
+		for _, dependency := range pkg.DependsOn {
+			if err := visit(byName[dependency]); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[pkg.Name] = visited
+		sorted = append(sorted, pkg)
+		return nil
+	}
+
+	for _, pkg := range packages {
+		if err := visit(pkg); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
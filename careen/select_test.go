@@ -0,0 +1,101 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelectPackages(t *testing.T) {
+	manifest := &Manifest{Packages: []Package{
+		{Name: "app", DependsOn: []string{"lib", "tools"}},
+		{Name: "lib", DependsOn: []string{"base"}},
+		{Name: "base"},
+		{Name: "tools"},
+		{Name: "docs"},
+	}}
+
+	tests := []struct {
+		names []string
+		skip  []string
+		want  []string
+	}{
+		// Dependencies come first, otherwise the manifest order is kept
+		{nil, nil, []string{"base", "lib", "tools", "app", "docs"}},
+		{[]string{"lib"}, nil, []string{"base", "lib"}},
+		// Transitive dependencies are selected too
+		{[]string{"app"}, nil, []string{"base", "lib", "tools", "app"}},
+		{[]string{"docs", "tools"}, nil, []string{"tools", "docs"}},
+		{[]string{"app"}, []string{"lib"}, []string{"base", "tools", "app"}},
+		{nil, []string{"docs", "base"}, []string{"lib", "tools", "app"}},
+	}
+	for _, test := range tests {
+		packages, err := SelectPackages(manifest, test.names, test.skip)
+		if err != nil {
+			t.Errorf("SelectPackages(%v, %v): %v", test.names, test.skip, err)
+			continue
+		}
+		if got := packageNames(packages); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SelectPackages(%v, %v) = %v, want %v", test.names, test.skip, got, test.want)
+		}
+	}
+}
+
+func TestSelectPackagesErrors(t *testing.T) {
+	tests := []struct {
+		packages []Package
+		names    []string
+		skip     []string
+		err      string
+	}{
+		{
+			[]Package{{Name: "a"}},
+			[]string{"b"}, nil,
+			"Unknown package b",
+		},
+		{
+			[]Package{{Name: "a"}},
+			nil, []string{"b"},
+			"Unknown package b",
+		},
+		{
+			[]Package{{Name: "a", DependsOn: []string{"missing"}}},
+			nil, nil,
+			"Package a depends on unknown package missing",
+		},
+		{
+			[]Package{
+				{Name: "a", DependsOn: []string{"b"}},
+				{Name: "b", DependsOn: []string{"c"}},
+				{Name: "c", DependsOn: []string{"b"}},
+			},
+			[]string{"a"}, nil,
+			"Dependency cycle between packages: b -> c -> b",
+		},
+		{
+			[]Package{{Name: "a", DependsOn: []string{"a"}}},
+			nil, nil,
+			"Dependency cycle between packages: a -> a",
+		},
+	}
+	for _, test := range tests {
+		_, err := SelectPackages(&Manifest{Packages: test.packages}, test.names, test.skip)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("SelectPackages(%v, %v, %v) = %v, want %q", packageNames(test.packages), test.names, test.skip, err, test.err)
+		}
+	}
+}
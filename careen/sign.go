@@ -0,0 +1,79 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	SignatureGPG = "gpg"
+	SignatureSSH = "ssh"
+)
+
+// Writes a detached signature of filename to filename.sig with gpg, using key
+// as the local user if given, or with ssh-keygen using the private key file key
+func SignFile(filename string, format string, key string) error {
+	sigFilename := SignatureFilename(filename)
+
+	switch format {
+	case SignatureGPG:
+		args := []string{"--yes", "--armor", "--detach-sign", "--output", sigFilename}
+		if key != "" {
+			args = append(args, "--local-user", key)
+		}
+		cmd := exec.Command("gpg", append(args, filename)...)
+		// gpg may ask for the passphrase of the key
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		return cmd.Run()
+	case SignatureSSH:
+		if key == "" {
+			return fmt.Errorf("Signing with ssh-keygen needs the private key file given with --key")
+		}
+		in, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		// ssh-keygen will not replace an existing signature file, so the
+		// signature is read from its output
+		tmp, err := ioutil.TempFile(filepath.Dir(sigFilename), ".careen-sig-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+
+		cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", key, "-n", sshSignatureNamespace)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = in, tmp, os.Stderr
+		err = cmd.Run()
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp.Name(), 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), sigFilename)
+	default:
+		return fmt.Errorf("Unknown signature format %v, expected %v or %v", format, SignatureGPG, SignatureSSH)
+	}
+}
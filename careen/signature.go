@@ -0,0 +1,237 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	VerifySignatureNone   = "none"
+	VerifySignatureTag    = "tag"
+	VerifySignatureCommit = "commit"
+	VerifySignatureAny    = "any"
+)
+
+// Public keys whose signatures careen trusts, from the trust section of the
+// configuration
+type TrustedKeys struct {
+	GPGKeyring        string // File of GPG public keys, armored or binary
+	SSHAllowedSigners string // ssh-keygen allowed signers file
+}
+
+// Checks that the package's policy is known
+func validateSignaturePolicy(policy string) error {
+	switch policy {
+	case "", VerifySignatureNone, VerifySignatureTag, VerifySignatureCommit, VerifySignatureAny:
+		return nil
+	}
+	return fmt.Errorf("verify_signature must be %v, %v, %v or %v, not %v",
+		VerifySignatureNone, VerifySignatureTag, VerifySignatureCommit, VerifySignatureAny, policy)
+}
+
+// Creates a GPG home holding just the keys of the keyring, which the caller
+// removes
+func trustedGPGHome(keys TrustedKeys) (string, error) {
+	gpgHome, err := ioutil.TempDir("", "careen-gnupg-")
+	if err != nil {
+		return "", err
+	}
+
+	// Every key of the keyring is trusted, so gpg need not warn that keys are
+	// not certified
+	if err := ioutil.WriteFile(filepath.Join(gpgHome, "gpg.conf"), []byte("trust-model always\n"), 0600); err != nil {
+		os.RemoveAll(gpgHome)
+		return "", err
+	}
+	if keys.GPGKeyring != "" {
+		output, err := exec.Command("gpg", "--batch", "--homedir", gpgHome, "--import", keys.GPGKeyring).CombinedOutput()
+		if err != nil {
+			os.RemoveAll(gpgHome)
+			return "", fmt.Errorf("Failed to import GPG keyring %v: %v\n%s", keys.GPGKeyring, err, output)
+		}
+	}
+	return gpgHome, nil
+}
+
+// Environment in which git trusts only keys: a GPG home holding just the
+// keyring and the allowed signers file. Call the returned function to remove
+// the GPG home.
+func trustedKeysGitEnv(keys TrustedKeys) (args []string, env []string, cleanup func(), err error) {
+	gpgHome, err := trustedGPGHome(keys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cleanup = func() {
+		os.RemoveAll(gpgHome)
+	}
+
+	// An empty file, so signers the user trusts elsewhere are not accepted
+	allowedSigners := filepath.Join(gpgHome, "allowed_signers")
+	if keys.SSHAllowedSigners != "" {
+		allowedSigners = keys.SSHAllowedSigners
+	} else if err := ioutil.WriteFile(allowedSigners, nil, 0600); err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+
+	args = []string{"-c", "gpg.ssh.allowedSignersFile=" + allowedSigners}
+	env = append(os.Environ(), "GNUPGHOME="+gpgHome)
+	return args, env, cleanup, nil
+}
+
+// Runs git verify-tag or verify-commit on rev in repoDir, returning git's
+// description of the signature
+func gitVerifySignature(repoDir string, verb string, rev string, keys TrustedKeys) (string, error) {
+	args, env, cleanup, err := trustedKeysGitEnv(keys)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	cmd := exec.Command("git", append(args, verb, rev)...)
+	cmd.Dir = repoDir
+	cmd.Env = env
+	output, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
+
+// Checks that the tag in the repository in repoDir, or the commit it names, is
+// signed by one of the trusted keys, as the policy requires. The tag need not
+// be checked out.
+func VerifyRevisionSignature(repoDir string, tag string, policy string, keys TrustedKeys, log *Logger) error {
+	if policy == "" || policy == VerifySignatureNone {
+		return nil
+	}
+	if keys.GPGKeyring == "" && keys.SSHAllowedSigners == "" {
+		return fmt.Errorf("Verifying signatures needs trust.gpg_keyring or trust.ssh_allowed_signers in the configuration")
+	}
+
+	failures := []string{}
+	if policy == VerifySignatureTag || policy == VerifySignatureAny {
+		output, err := gitVerifySignature(repoDir, "verify-tag", tag, keys)
+		if err == nil {
+			log.With(Fields{"repo": repoDir, "tag": tag, "signature": output}).Infof("Tag is signed by a trusted key")
+			return nil
+		}
+		failures = append(failures, fmt.Sprintf("tag %v: %v\n%v", tag, err, output))
+	}
+	if policy == VerifySignatureCommit || policy == VerifySignatureAny {
+		output, err := gitVerifySignature(repoDir, "verify-commit", tag+"^{commit}", keys)
+		if err == nil {
+			log.With(Fields{"repo": repoDir, "tag": tag, "signature": output}).Infof("Commit of tag is signed by a trusted key")
+			return nil
+		}
+		failures = append(failures, fmt.Sprintf("commit of tag %v: %v\n%v", tag, err, output))
+	}
+
+	return fmt.Errorf("Repository directory %v is not signed by a trusted key:\n%v", repoDir, strings.Join(failures, "\n"))
+}
+
+// Namespace of the ssh-keygen signatures careen makes and accepts, so that
+// signatures made for other purposes cannot be reused
+const sshSignatureNamespace = "careen"
+
+// Returns the detached signature file of filename
+func SignatureFilename(filename string) string {
+	return filename + ".sig"
+}
+
+// Checks filename against its detached signature, an OpenPGP or ssh-keygen
+// signature in filename.sig, using only the trusted keys. A missing signature
+// is an error only when required.
+func VerifyDetachedSignature(filename string, keys TrustedKeys, required bool, log *Logger) error {
+	sigFilename := SignatureFilename(filename)
+	sig, err := ioutil.ReadFile(sigFilename)
+	if os.IsNotExist(err) {
+		if required {
+			return fmt.Errorf("%v has no signature %v, which trust.require_signatures requires", filename, sigFilename)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var output string
+	if strings.HasPrefix(strings.TrimSpace(string(sig)), "-----BEGIN SSH SIGNATURE-----") {
+		output, err = verifySSHSignature(filename, sigFilename, keys)
+	} else {
+		output, err = verifyGPGSignature(filename, sigFilename, keys)
+	}
+	if err != nil {
+		return fmt.Errorf("Signature %v of %v is not valid or not by a trusted key: %v\n%v", sigFilename, filename, err, output)
+	}
+	log.With(Fields{"file": filename, "signature": output}).Infof("File is signed by a trusted key")
+	return nil
+}
+
+func verifyGPGSignature(filename string, sigFilename string, keys TrustedKeys) (string, error) {
+	if keys.GPGKeyring == "" {
+		return "", fmt.Errorf("no trust.gpg_keyring is configured")
+	}
+	gpgHome, err := trustedGPGHome(keys)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(gpgHome)
+
+	output, err := exec.Command("gpg", "--batch", "--homedir", gpgHome, "--verify", sigFilename, filename).CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
+
+func verifySSHSignature(filename string, sigFilename string, keys TrustedKeys) (string, error) {
+	if keys.SSHAllowedSigners == "" {
+		return "", fmt.Errorf("no trust.ssh_allowed_signers is configured")
+	}
+
+	output, err := exec.Command("ssh-keygen", "-Y", "find-principals",
+		"-f", keys.SSHAllowedSigners, "-s", sigFilename).CombinedOutput()
+	if err != nil {
+		return strings.TrimSpace(string(output)), err
+	}
+	principal := strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)[0]
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	cmd := exec.Command("ssh-keygen", "-Y", "verify", "-f", keys.SSHAllowedSigners,
+		"-I", principal, "-n", sshSignatureNamespace, "-s", sigFilename)
+	cmd.Stdin = f
+	output, err = cmd.CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
+
+// Checks the signatures of the manifests, including those they include, and
+// of the overlays
+func verifyManifestSignatures(manifestFilenames []string, overlayFilenames []string, keys TrustedKeys, required bool, log *Logger) error {
+	filenames, err := ManifestSources(manifestFilenames)
+	if err != nil {
+		return err
+	}
+	for _, filename := range append(filenames, overlayFilenames...) {
+		if err := VerifyDetachedSignature(filename, keys, required, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func skipWithout(t *testing.T, commands ...string) {
+	for _, command := range commands {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("%v is not installed", command)
+		}
+	}
+}
+
+// Generates an SSH key in dir, returning the private key file and an allowed
+// signers file trusting it for the committer of test repositories
+func sshTestKey(t *testing.T, dir string, name string) (string, string) {
+	key := filepath.Join(dir, name)
+	output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", name, "-f", key).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen: %v\n%s", err, output)
+	}
+	pub, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedSigners := key + ".allowed_signers"
+	if err := ioutil.WriteFile(allowedSigners, []byte("careen@example.com "+string(pub)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return key, allowedSigners
+}
+
+// Makes a repository whose history is a signed commit, an unsigned one and an
+// unsigned one at HEAD. The tags are signed-tag, a signed tag of the first
+// commit, plain, an unsigned tag of it, and unsigned-commit, an unsigned tag
+// of the second commit.
+func makeSignedTestRepo(t *testing.T, dir string, key string) {
+	sign := []string{"-c", "gpg.format=ssh", "-c", "user.signingkey=" + key,
+		"-c", "user.name=careen", "-c", "user.email=careen@example.com"}
+	makeTestRepo(t, dir, MemoryTree{"file": textFile("signed\n")})
+	runTestGit(t, dir, append(sign, "commit", "-q", "--amend", "-S", "--no-edit")...)
+	runTestGit(t, dir, append(sign, "tag", "-s", "-m", "signed", "signed-tag")...)
+	runTestGit(t, dir, append(sign, "tag", "-a", "-m", "plain", "plain")...)
+	writeTestTree(t, dir, MemoryTree{"file": textFile("unsigned\n")})
+	commitTestRepo(t, dir, "unsigned")
+	runTestGit(t, dir, append(sign, "tag", "-a", "-m", "unsigned", "unsigned-commit")...)
+	writeTestTree(t, dir, MemoryTree{"file": textFile("head\n")})
+	commitTestRepo(t, dir, "head")
+}
+
+func TestVerifyRevisionSignature(t *testing.T) {
+	skipWithout(t, "git", "ssh-keygen")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	key, allowedSigners := sshTestKey(t, dir, "trusted")
+	_, otherSigners := sshTestKey(t, dir, "other")
+	repoDir := filepath.Join(dir, "repo")
+	makeSignedTestRepo(t, repoDir, key)
+	trusted := TrustedKeys{SSHAllowedSigners: allowedSigners}
+
+	tests := []struct {
+		tag    string
+		policy string
+		keys   TrustedKeys
+		err    string
+	}{
+		{"signed-tag", VerifySignatureTag, trusted, ""},
+		{"plain", VerifySignatureTag, trusted, "not signed by a trusted key"},
+		// Commits are checked at the tag, whatever is checked out
+		{"plain", VerifySignatureCommit, trusted, ""},
+		{"plain", VerifySignatureAny, trusted, ""},
+		{"unsigned-commit", VerifySignatureAny, trusted, "not signed by a trusted key"},
+		{"signed-tag", VerifySignatureTag, TrustedKeys{SSHAllowedSigners: otherSigners}, "not signed by a trusted key"},
+		{"signed-tag", VerifySignatureTag, TrustedKeys{}, "needs trust.gpg_keyring or trust.ssh_allowed_signers"},
+		{"unsigned-commit", VerifySignatureNone, TrustedKeys{}, ""},
+		{"unsigned-commit", "", TrustedKeys{}, ""},
+	}
+	for _, test := range tests {
+		err := VerifyRevisionSignature(repoDir, test.tag, test.policy, test.keys, discardLogger)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v with policy %q: %v", test.tag, test.policy, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%v with policy %q: error = %v, want %q", test.tag, test.policy, err, test.err)
+		}
+	}
+}
+
+func TestCloneChecksSignatureBeforeCheckout(t *testing.T) {
+	skipWithout(t, "git", "ssh-keygen")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	key, allowedSigners := sshTestKey(t, dir, "trusted")
+	upstreamDir := filepath.Join(dir, "upstream")
+	makeSignedTestRepo(t, upstreamDir, key)
+	unsignedCommit := strings.TrimSpace(string(runTestGit(t, upstreamDir, "rev-parse", "unsigned-commit^{commit}")))
+
+	w := NewWorkspace(filepath.Join(dir, "out"), filepath.Join(dir, "patches"))
+	w.Git = &cliGitBackend{}
+	w.Keys = TrustedKeys{SSHAllowedSigners: allowedSigners}
+	w.Retries = RetryPolicies{Clone: noRetries, Fetch: noRetries, Download: noRetries}
+	ctx := context.Background()
+
+	unsigned := &Package{Name: "unsigned", Repo: upstreamDir, Tag: "unsigned-commit", VerifySignature: VerifySignatureAny}
+	if _, err := w.Clone(ctx, unsigned); err == nil || !strings.Contains(err.Error(), "not signed by a trusted key") {
+		t.Fatalf("Clone of an unsigned tag = %v, want a signature error", err)
+	}
+	repoDir := filepath.Join(dir, "out", "unsigned")
+	head := strings.TrimSpace(string(runTestGit(t, repoDir, "rev-parse", "HEAD")))
+	if head == unsignedCommit {
+		t.Errorf("Clone checked out the tag which failed verification")
+	}
+	if _, err := w.ApplyPackage(ctx, unsigned); err == nil || !strings.Contains(err.Error(), "not tag unsigned-commit") {
+		t.Errorf("ApplyPackage of a package which failed verification = %v, want it refused", err)
+	}
+	// Checking out the tag by hand does not get it patched either
+	runTestGit(t, repoDir, "checkout", "-q", "unsigned-commit")
+	if _, err := w.ApplyPackage(ctx, unsigned); err == nil || !strings.Contains(err.Error(), "not signed by a trusted key") {
+		t.Errorf("ApplyPackage of an unsigned tag = %v, want it refused", err)
+	}
+
+	signed := &Package{Name: "signed", Repo: upstreamDir, Tag: "signed-tag", VerifySignature: VerifySignatureTag}
+	if _, err := w.Clone(ctx, signed); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CheckPackage(signed); err != nil {
+		t.Errorf("CheckPackage of a signed tag: %v", err)
+	}
+	if _, err := w.ApplyPackage(ctx, signed); err != nil {
+		t.Errorf("ApplyPackage of a signed tag: %v", err)
+	}
+}
+
+// Sets the environment variable for the rest of the test, returning the
+// function restoring it
+func setTestEnv(key string, value string) func() {
+	old, had := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// Generates a GPG key in the GPG home gpgHome, returning a keyring file
+// holding its public key
+func gpgTestKey(t *testing.T, gpgHome string, email string) string {
+	if err := os.MkdirAll(gpgHome, 0700); err != nil {
+		t.Fatal(err)
+	}
+	gpg := func(args ...string) []byte {
+		cmd := exec.Command("gpg", append([]string{"--batch", "--homedir", gpgHome}, args...)...)
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("gpg %v: %v", strings.Join(args, " "), err)
+		}
+		return output
+	}
+	gpg("--passphrase", "", "--quick-generate-key", "careen <"+email+">", "ed25519", "sign", "never")
+	keyring := filepath.Join(gpgHome, email+".asc")
+	if err := ioutil.WriteFile(keyring, gpg("--armor", "--export", email), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func writeSignedTestFile(t *testing.T, filename string, contents string, format string, key string) {
+	if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SignFile(filename, format, key); err != nil {
+		t.Fatalf("SignFile(%v, %v): %v", filename, format, err)
+	}
+}
+
+func TestVerifyDetachedSignatureSSH(t *testing.T) {
+	skipWithout(t, "ssh-keygen")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	key, allowedSigners := sshTestKey(t, dir, "trusted")
+	_, otherSigners := sshTestKey(t, dir, "other")
+	trusted := TrustedKeys{SSHAllowedSigners: allowedSigners}
+
+	signed := filepath.Join(dir, "signed.patch")
+	writeSignedTestFile(t, signed, "patch\n", SignatureSSH, key)
+	tampered := filepath.Join(dir, "tampered.patch")
+	writeSignedTestFile(t, tampered, "patch\n", SignatureSSH, key)
+	if err := ioutil.WriteFile(tampered, []byte("tampered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Signatures made for other purposes, such as git commits, are refused
+	otherNamespace := filepath.Join(dir, "namespace.patch")
+	if err := ioutil.WriteFile(otherNamespace, []byte("patch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command("ssh-keygen", "-Y", "sign", "-f", key, "-n", "git", otherNamespace).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen: %v\n%s", err, output)
+	}
+	unsigned := filepath.Join(dir, "unsigned.patch")
+	if err := ioutil.WriteFile(unsigned, []byte("patch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename string
+		keys     TrustedKeys
+		required bool
+		err      string
+	}{
+		{signed, trusted, true, ""},
+		{tampered, trusted, false, "is not valid or not by a trusted key"},
+		{otherNamespace, trusted, false, "is not valid or not by a trusted key"},
+		{signed, TrustedKeys{SSHAllowedSigners: otherSigners}, false, "is not valid or not by a trusted key"},
+		{signed, TrustedKeys{}, false, "no trust.ssh_allowed_signers is configured"},
+		{unsigned, trusted, false, ""},
+		{unsigned, trusted, true, "which trust.require_signatures requires"},
+	}
+	for _, test := range tests {
+		err := VerifyDetachedSignature(test.filename, test.keys, test.required, discardLogger)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: %v", filepath.Base(test.filename), err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%v: error = %v, want %q", filepath.Base(test.filename), err, test.err)
+		}
+	}
+}
+
+func TestVerifyDetachedSignatureGPG(t *testing.T) {
+	skipWithout(t, "gpg", "gpgconf")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	otherKeyring := gpgTestKey(t, filepath.Join(dir, "other"), "other@example.com")
+	gpgHome := filepath.Join(dir, "gnupg")
+	keyring := gpgTestKey(t, gpgHome, "trusted@example.com")
+	// SignFile signs with the user's own GPG home
+	defer setTestEnv("GNUPGHOME", gpgHome)()
+	defer exec.Command("gpgconf", "--kill", "all").Run()
+
+	signed := filepath.Join(dir, "signed.patch")
+	writeSignedTestFile(t, signed, "patch\n", SignatureGPG, "trusted@example.com")
+	tampered := filepath.Join(dir, "tampered.patch")
+	writeSignedTestFile(t, tampered, "patch\n", SignatureGPG, "")
+	if err := ioutil.WriteFile(tampered, []byte("tampered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename string
+		keys     TrustedKeys
+		err      string
+	}{
+		{signed, TrustedKeys{GPGKeyring: keyring}, ""},
+		{tampered, TrustedKeys{GPGKeyring: keyring}, "is not valid or not by a trusted key"},
+		// The user's own keyring, which holds the key, is not consulted
+		{signed, TrustedKeys{GPGKeyring: otherKeyring}, "is not valid or not by a trusted key"},
+		{signed, TrustedKeys{SSHAllowedSigners: filepath.Join(dir, "allowed_signers")}, "no trust.gpg_keyring is configured"},
+	}
+	for _, test := range tests {
+		err := VerifyDetachedSignature(test.filename, test.keys, true, discardLogger)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: %v", filepath.Base(test.filename), err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%v: error = %v, want %q", filepath.Base(test.filename), err, test.err)
+		}
+	}
+}
+
+func TestCheckManifestsChecksIncludes(t *testing.T) {
+	skipWithout(t, "ssh-keygen")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	key, allowedSigners := sshTestKey(t, dir, "trusted")
+	writeSignedTestFile(t, filepath.Join(dir, "manifest.yaml"), "version: \"0.0.1\"\ninclude:\n  - common.yaml\n", SignatureSSH, key)
+	writeSignedTestFile(t, filepath.Join(dir, "common.yaml"), "version: \"0.0.1\"\n", SignatureSSH, key)
+	writeSignedTestFile(t, filepath.Join(dir, "overlay.yaml"), "version: \"0.0.1\"\n", SignatureSSH, key)
+
+	w := NewWorkspace(filepath.Join(dir, "out"), dir)
+	w.ManifestFiles = []string{filepath.Join(dir, "manifest.yaml")}
+	w.OverlayFiles = []string{filepath.Join(dir, "overlay.yaml")}
+	w.Keys = TrustedKeys{SSHAllowedSigners: allowedSigners}
+	w.RequireSignatures = true
+	if err := w.CheckManifests(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"common.yaml", "overlay.yaml"} {
+		sigFilename := SignatureFilename(filepath.Join(dir, name))
+		sig, err := ioutil.ReadFile(sigFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(sigFilename)
+		if err := w.CheckManifests(); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("CheckManifests without the signature of %v = %v", name, err)
+		}
+		if err := ioutil.WriteFile(sigFilename, sig, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCloneChecksManifestsBeforeHooks(t *testing.T) {
+	skipWithout(t, "ssh-keygen", "sh")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	key, allowedSigners := sshTestKey(t, dir, "trusted")
+	manifestFilename := filepath.Join(dir, "manifest.yaml")
+	if err := ioutil.WriteFile(manifestFilename, []byte("version: \"0.0.1\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := filepath.Join(dir, "out")
+	w := NewWorkspace(outputDir, dir)
+	w.ManifestFiles = []string{manifestFilename}
+	w.Keys = TrustedKeys{SSHAllowedSigners: allowedSigners}
+	w.RequireSignatures = true
+	w.Git = &goGitBackend{}
+	w.Retries = RetryPolicies{Clone: noRetries, Fetch: noRetries, Download: noRetries}
+	w.Log = discardLogger
+	pkg := &Package{Name: "pkg", Repo: filepath.Join(dir, "missing"), Revision: "HEAD", Hooks: &Hooks{PreClone: []string{"touch hook-ran"}}}
+	hookRan := func() bool {
+		_, err := os.Stat(filepath.Join(outputDir, "hook-ran"))
+		return err == nil
+	}
+
+	if _, err := w.Clone(context.Background(), pkg); err == nil || !strings.Contains(err.Error(), "manifest.yaml") {
+		t.Errorf("Clone with an unsigned manifest = %v, want a signature error", err)
+	}
+	if hookRan() {
+		t.Errorf("pre_clone hook of an unsigned manifest ran")
+	}
+
+	writeSignedTestFile(t, manifestFilename, "version: \"0.0.1\"\n", SignatureSSH, key)
+	w.Clone(context.Background(), pkg)
+	if !hookRan() {
+		t.Errorf("pre_clone hook of a signed manifest did not run")
+	}
+}
@@ -0,0 +1,433 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	SourceGit     = "git"
+	SourceArchive = "archive"
+	SourceLocal   = "local"
+)
+
+// Returns the source type of the package, git unless given
+func (pkg *Package) SourceType() string {
+	if pkg.Source == "" {
+		return SourceGit
+	}
+	return pkg.Source
+}
+
+// Checks that the package has the settings its source type needs
+func (pkg *Package) ValidateSource() error {
+	switch pkg.SourceType() {
+	case SourceGit:
+		if pkg.Repo == "" || pkg.Tag == "" {
+			return fmt.Errorf("package %v: git packages need a repo and a tag", pkg.Name)
+		}
+		if pkg.Archive != nil || pkg.Local != nil {
+			return fmt.Errorf("package %v: archive and local settings need source archive or local", pkg.Name)
+		}
+		if pkg.Submodules != nil {
+			if err := pkg.Submodules.Validate(); err != nil {
+				return fmt.Errorf("package %v: %v", pkg.Name, err)
+			}
+		}
+		if err := validateSignaturePolicy(pkg.VerifySignature); err != nil {
+			return fmt.Errorf("package %v: %v", pkg.Name, err)
+		}
+	case SourceArchive:
+		if pkg.Archive == nil || pkg.Archive.Url == "" {
+			return fmt.Errorf("package %v: archive packages need archive.url", pkg.Name)
+		}
+		if _, _, err := parseDigest(pkg.Archive.Digest); err != nil {
+			return fmt.Errorf("package %v: %v", pkg.Name, err)
+		}
+		if _, err := archiveFormat(pkg.Archive.Url); err != nil {
+			return fmt.Errorf("package %v: %v", pkg.Name, err)
+		}
+		if pkg.Local != nil {
+			return fmt.Errorf("package %v: local settings need source local", pkg.Name)
+		}
+	case SourceLocal:
+		if pkg.Local == nil || pkg.Local.Path == "" {
+			return fmt.Errorf("package %v: local packages need local.path", pkg.Name)
+		}
+		if pkg.Archive != nil {
+			return fmt.Errorf("package %v: archive settings need source archive", pkg.Name)
+		}
+	default:
+		return fmt.Errorf("package %v: unknown source %q, expected git, archive or local", pkg.Name, pkg.Source)
+	}
+	if pkg.SourceType() != SourceGit && (pkg.Submodules != nil || pkg.Lfs || pkg.VerifySignature != "") {
+		return fmt.Errorf("package %v: submodules, lfs and verify_signature need source git", pkg.Name)
+	}
+	return nil
+}
+
+// Parses a digest such as sha256:<hex>
+func parseDigest(digest string) (func() hash.Hash, string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("digest %q must look like sha256:<hex>", digest)
+	}
+
+	algorithms := map[string]func() hash.Hash{
+		"sha1":   sha1.New,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+	newHash, ok := algorithms[parts[0]]
+	if !ok {
+		return nil, "", fmt.Errorf("digest %q uses unknown algorithm %v", digest, parts[0])
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil || len(parts[1]) != 2*newHash().Size() {
+		return nil, "", fmt.Errorf("digest %q is not a valid %v digest", digest, parts[0])
+	}
+	return newHash, strings.ToLower(parts[1]), nil
+}
+
+// Returns the archive format from the extension of the URL or path
+func archiveFormat(location string) (string, error) {
+	name := location
+	if u, err := url.Parse(location); err == nil && u.Scheme != "" {
+		name = u.Path
+	}
+	name = strings.ToLower(path.Base(name))
+
+	for _, format := range []string{".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar", ".zip"} {
+		if strings.HasSuffix(name, format) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("archive %v is not a .tar, .tar.gz, .tgz, .tar.bz2, .tbz2 or .zip file", location)
+}
+
+// Downloads or opens the archive into a temporary file and verifies its digest.
+// The caller removes the returned file.
+func fetchArchive(ctx context.Context, archive *ArchiveSource) (string, error) {
+	newHash, expected, err := parseDigest(archive.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	var reader io.ReadCloser
+	if u, err := url.Parse(archive.Url); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		request, err := http.NewRequest("GET", archive.Url, nil)
+		if err != nil {
+			return "", err
+		}
+		response, err := http.DefaultClient.Do(request.WithContext(ctx))
+		if err != nil {
+			return "", interruptedError(ctx, err)
+		}
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return "", &HTTPStatusError{
+				Message:    fmt.Sprintf("Downloading archive %v failed with %v", archive.Url, response.Status),
+				StatusCode: response.StatusCode,
+			}
+		}
+		reader = response.Body
+	} else {
+		if reader, err = os.Open(archive.Url); err != nil {
+			return "", err
+		}
+	}
+	defer reader.Close()
+
+	file, err := ioutil.TempFile("", "careen-archive-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	digest := newHash()
+	if _, err := io.Copy(io.MultiWriter(file, digest), reader); err != nil {
+		os.Remove(file.Name())
+		return "", interruptedError(ctx, err)
+	}
+
+	computed := hex.EncodeToString(digest.Sum(nil))
+	if computed != expected {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("Archive %v has digest %v, expected %v", archive.Url, computed, expected)
+	}
+
+	return file.Name(), nil
+}
+
+// Returns where an archive entry is extracted to, or "" if the entry is
+// removed entirely by stripComponents. Entries may not escape destDir.
+func archiveEntryPath(destDir string, name string, stripComponents int) (string, error) {
+	parts := []string{}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("archive entry %v is outside the archive", name)
+		}
+		parts = append(parts, part)
+	}
+	if strings.HasPrefix(filepath.ToSlash(name), "/") {
+		return "", fmt.Errorf("archive entry %v has an absolute path", name)
+	}
+
+	if len(parts) <= stripComponents {
+		return "", nil
+	}
+	return filepath.Join(append([]string{destDir}, parts[stripComponents:]...)...), nil
+}
+
+// Checks that an archive entry extracted to entryPath stays within destDir,
+// following the symlinks extracted before it
+func checkArchiveEntry(destDir string, name string, entryPath string) error {
+	if err := CheckNoSymlinkEscape(destDir, entryPath); err != nil {
+		return fmt.Errorf("archive entry %v is outside the archive: %v", name, err)
+	}
+	return nil
+}
+
+// Creates a symlink at linkPath, refusing targets outside destDir. The target
+// is resolved from the directory the link actually lands in, through any
+// symlinks extracted before it.
+func extractSymlink(destDir string, linkPath string, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("archive symlink %v has absolute target %v", linkPath, target)
+	}
+	linkDir, err := resolvePath(filepath.Dir(linkPath))
+	if err != nil {
+		return err
+	}
+	if err := CheckNoSymlinkEscape(destDir, linkDir+string(filepath.Separator)+target); err != nil {
+		return fmt.Errorf("archive symlink %v points outside the archive: %v", linkPath, err)
+	}
+	return os.Symlink(target, linkPath)
+}
+
+func extractFile(filePath string, mode os.FileMode, reader io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Extracts the archive at archivePath into destDir
+func ExtractArchive(archivePath string, format string, destDir string, stripComponents int) error {
+	destDir, err := filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+
+	if format == ".zip" {
+		return extractZip(archivePath, destDir, stripComponents)
+	}
+	return extractTar(archivePath, format, destDir, stripComponents)
+}
+
+func extractTar(archivePath string, format string, destDir string, stripComponents int) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	switch format {
+	case ".tar.gz", ".tgz":
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case ".tar.bz2", ".tbz2":
+		reader = bzip2.NewReader(file)
+	}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entryPath, err := archiveEntryPath(destDir, header.Name, stripComponents)
+		if err != nil {
+			return err
+		}
+		if entryPath == "" {
+			continue
+		}
+		if err := checkArchiveEntry(destDir, header.Name, entryPath); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(entryPath, os.FileMode(header.Mode).Perm()|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(entryPath, os.FileMode(header.Mode), tarReader)
+		case tar.TypeSymlink:
+			err = extractSymlink(destDir, entryPath, header.Linkname)
+		case tar.TypeLink:
+			var target string
+			target, err = archiveEntryPath(destDir, header.Linkname, stripComponents)
+			if err == nil && target != "" {
+				err = checkArchiveEntry(destDir, header.Linkname, target)
+			}
+			if err == nil && target != "" {
+				err = os.Link(target, entryPath)
+			}
+		default:
+			// Devices, FIFOs and the like have no place in source trees
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(archivePath string, destDir string, stripComponents int) error {
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+
+	for _, entry := range zipReader.File {
+		entryPath, err := archiveEntryPath(destDir, entry.Name, stripComponents)
+		if err != nil {
+			return err
+		}
+		if entryPath == "" {
+			continue
+		}
+		if err := checkArchiveEntry(destDir, entry.Name, entryPath); err != nil {
+			return err
+		}
+
+		mode := entry.Mode()
+		if mode.IsDir() {
+			if err := os.MkdirAll(entryPath, mode.Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+
+		reader, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		if mode&os.ModeSymlink != 0 {
+			var target []byte
+			if target, err = ioutil.ReadAll(reader); err == nil {
+				err = extractSymlink(destDir, entryPath, string(target))
+			}
+		} else {
+			err = extractFile(entryPath, mode, reader)
+		}
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the directory tree at srcDir to destDir, keeping modes and symlinks.
+// Nothing is written through a symlink in destDir leading outside it.
+func CopyTree(srcDir string, destDir string) error {
+	destDir, err := filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(srcDir, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDir, srcPath)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(destDir, relPath)
+
+		switch {
+		case info.IsDir():
+			if err := CheckNoSymlinkEscape(destDir, destPath); err != nil {
+				return err
+			}
+			return os.MkdirAll(destPath, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			// The link is copied as it is, but must not be created elsewhere
+			if err := CheckNoSymlinkEscape(destDir, filepath.Dir(destPath)); err != nil {
+				return err
+			}
+			return os.Symlink(target, destPath)
+		case info.Mode().IsRegular():
+			if err := CheckNoSymlinkEscape(destDir, destPath); err != nil {
+				return err
+			}
+			file, err := os.Open(srcPath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			return extractFile(destPath, info.Mode(), file)
+		default:
+			return nil
+		}
+	})
+}
@@ -0,0 +1,290 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An entry of a test archive: a file with data, a symlink or hard link to
+// link, or a directory if name ends in /
+type testArchiveEntry struct {
+	name     string
+	data     string
+	symlink  string
+	hardlink string
+}
+
+func writeTestTar(t *testing.T, path string, entries []testArchiveEntry) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w := tar.NewWriter(file)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.data))}
+		switch {
+		case entry.symlink != "":
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.symlink}
+		case entry.hardlink != "":
+			header = &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeLink, Linkname: entry.hardlink}
+		case strings.HasSuffix(entry.name, "/"):
+			header = &tar.Header{Name: entry.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := w.Write([]byte(entry.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestZip(t *testing.T, path string, entries []testArchiveEntry) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w := zip.NewWriter(file)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name}
+		data := entry.data
+		if entry.symlink != "" {
+			header.SetMode(os.ModeSymlink | 0777)
+			data = entry.symlink
+		} else {
+			header.SetMode(0644)
+		}
+		fw, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "careen-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resolve links such as /tmp -> /private/tmp so paths compare equal
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestExtractArchiveRejectsSymlinkEscapes(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		entries []testArchiveEntry
+	}{
+		{"symlink through symlink", []testArchiveEntry{
+			{name: "s", symlink: "."},
+			{name: "s/z", symlink: ".."},
+			{name: "z/evil.txt", data: "evil"},
+		}},
+		{"symlink outside", []testArchiveEntry{
+			{name: "d/", data: ""},
+			{name: "d/up", symlink: "../.."},
+		}},
+		{"absolute symlink", []testArchiveEntry{
+			{name: "abs", symlink: "/etc"},
+		}},
+		{"dotdot entry", []testArchiveEntry{
+			{name: "../evil.txt", data: "evil"},
+		}},
+	} {
+		for _, format := range []string{".tar", ".zip"} {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			archivePath := filepath.Join(dir, "archive"+format)
+			if format == ".zip" {
+				entries := []testArchiveEntry{}
+				for _, entry := range test.entries {
+					// Zip has no directory entries with modes to test
+					if !strings.HasSuffix(entry.name, "/") {
+						entries = append(entries, entry)
+					}
+				}
+				writeTestZip(t, archivePath, entries)
+			} else {
+				writeTestTar(t, archivePath, test.entries)
+			}
+
+			destDir := filepath.Join(dir, "out", "pkg")
+			err := ExtractArchive(archivePath, format, destDir, 0)
+			if err == nil {
+				t.Errorf("%v%v: extracted without error", test.name, format)
+			}
+			for _, outside := range []string{filepath.Join(dir, "out", "evil.txt"), filepath.Join(dir, "evil.txt")} {
+				if _, err := os.Lstat(outside); err == nil {
+					t.Errorf("%v%v: wrote %v outside the package directory", test.name, format, outside)
+				}
+			}
+		}
+	}
+}
+
+func TestExtractArchiveRejectsWritesThroughExistingSymlinks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entries := range [][]testArchiveEntry{
+		{{name: "out/evil.txt", data: "evil"}},
+		{{name: "out/sub/"}},
+		{{name: "h", hardlink: "out/secret"}},
+	} {
+		destDir := filepath.Join(dir, "pkg")
+		os.RemoveAll(destDir)
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("../outside", filepath.Join(destDir, "out")); err != nil {
+			t.Fatal(err)
+		}
+		archivePath := filepath.Join(dir, "archive.tar")
+		writeTestTar(t, archivePath, entries)
+
+		if err := ExtractArchive(archivePath, ".tar", destDir, 0); err == nil {
+			t.Errorf("%v: extracted without error", entries[0].name)
+		}
+		if names, _ := ioutil.ReadDir(outside); len(names) != 1 {
+			t.Errorf("%v: changed %v", entries[0].name, outside)
+		}
+		if _, err := os.Lstat(filepath.Join(destDir, "h")); err == nil {
+			t.Errorf("%v: linked a file outside the package directory", entries[0].name)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar")
+	writeTestTar(t, archivePath, []testArchiveEntry{
+		{name: "docker-1.12.6/"},
+		{name: "docker-1.12.6/src/"},
+		{name: "docker-1.12.6/src/main.go", data: "package main\n"},
+		{name: "docker-1.12.6/main.go", symlink: "src/main.go"},
+		{name: "docker-1.12.6/src/self", symlink: "."},
+		{name: "docker-1.12.6/src/up", symlink: ".."},
+		{name: "docker-1.12.6/copy.go", hardlink: "docker-1.12.6/src/main.go"},
+	})
+
+	destDir := filepath.Join(dir, "pkg")
+	if err := ExtractArchive(archivePath, ".tar", destDir, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"src/main.go", "main.go", "copy.go", "src/self/main.go", "src/up/main.go"} {
+		data, err := ioutil.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Error(err)
+		} else if string(data) != "package main\n" {
+			t.Errorf("%v contains %q", name, data)
+		}
+	}
+}
+
+func TestCopyTreeRejectsWritesThroughExistingSymlinks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	srcDir := filepath.Join(dir, "src")
+	for _, d := range []string{outside, filepath.Join(srcDir, "out", "sub")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"out/evil.txt", "out/sub/evil.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte("evil"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../elsewhere", filepath.Join(srcDir, "out", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := filepath.Join(dir, "pkg")
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../outside", filepath.Join(destDir, "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CopyTree(srcDir, destDir); err == nil {
+		t.Error("copied without error")
+	}
+	if names, _ := ioutil.ReadDir(outside); len(names) != 0 {
+		t.Errorf("changed %v", outside)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	srcDir := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "src", "main.go"), []byte("package main\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("src/main.go", filepath.Join(srcDir, "main.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := filepath.Join(dir, "pkg")
+	if err := CopyTree(srcDir, destDir); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(destDir, "src", "main.go")); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0755 {
+		t.Errorf("src/main.go has mode %v", info.Mode())
+	}
+	if target, err := os.Readlink(filepath.Join(destDir, "main.go")); err != nil || target != "src/main.go" {
+		t.Errorf("main.go links to %q, %v", target, err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Name of the file in the output directory recording unfinished work
+const stateFilename = ".careen-state"
+
+// Work started in an output directory and not yet finished, recorded before
+// it starts so that the next run can resume after an interruption, even one
+// careen could not clean up after, such as a kill or power loss
+type RunState struct {
+	Packages map[string]*PackageState `json:"packages"`
+	filename string
+}
+
+type PackageState struct {
+	// The package directory is being cloned, extracted or copied, so its
+	// contents are incomplete
+	Cloning bool `json:"cloning,omitempty"`
+	// Hashes of the patches applied so far, by index, while the package's
+	// patches are being applied. Patches not applied have an empty hash.
+	Applied []string `json:"applied,omitempty"`
+}
+
+func LoadRunState(outputDir string) (*RunState, error) {
+	state := &RunState{
+		Packages: map[string]*PackageState{},
+		filename: filepath.Join(outputDir, stateFilename),
+	}
+	data, err := ioutil.ReadFile(state.filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Packages == nil {
+		state.Packages = map[string]*PackageState{}
+	}
+	return state, nil
+}
+
+// Writes the state, or removes the file once nothing is unfinished
+func (s *RunState) save() error {
+	for name, pkg := range s.Packages {
+		if !pkg.Cloning && len(pkg.Applied) == 0 {
+			delete(s.Packages, name)
+		}
+	}
+	if len(s.Packages) == 0 {
+		if err := os.Remove(s.filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.filename), 0755); err != nil {
+		return err
+	}
+	// Written whole and renamed, so a kill never leaves half a file
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+func (s *RunState) pkg(name string) *PackageState {
+	if s.Packages[name] == nil {
+		s.Packages[name] = &PackageState{}
+	}
+	return s.Packages[name]
+}
+
+// Reports whether an earlier run was interrupted while cloning the package
+func (s *RunState) Cloning(name string) bool {
+	return s.Packages[name] != nil && s.Packages[name].Cloning
+}
+
+// Records that the package directory is being filled. A new clone makes any
+// patches recorded as applied to the old one irrelevant.
+func (s *RunState) StartClone(name string) error {
+	s.pkg(name).Cloning = true
+	s.pkg(name).Applied = nil
+	return s.save()
+}
+
+func (s *RunState) FinishClone(name string) error {
+	s.pkg(name).Cloning = false
+	return s.save()
+}
+
+// Reports whether an earlier, unfinished run applied the i-th patch of the
+// package, which has the given hash, and every patch before it
+func (s *RunState) PatchApplied(name string, i int, hash string) bool {
+	pkg := s.Packages[name]
+	if pkg == nil || i >= len(pkg.Applied) || pkg.Applied[i] != hash {
+		return false
+	}
+	for _, earlier := range pkg.Applied[:i] {
+		if earlier == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Records the i-th patch of the package as applied. Patches may be applied
+// one at a time in any order.
+func (s *RunState) ApplyPatch(name string, i int, hash string) error {
+	pkg := s.pkg(name)
+	for len(pkg.Applied) <= i {
+		pkg.Applied = append(pkg.Applied, "")
+	}
+	pkg.Applied[i] = hash
+	return s.save()
+}
+
+// Records that all the package's patches are applied
+func (s *RunState) FinishApply(name string) error {
+	s.pkg(name).Applied = nil
+	return s.save()
+}
+
+// Fills the empty or missing package directory repoDir with fill, recording
+// that it is doing so. If fill fails, or careen is interrupted, the
+// directory is removed, so it is not mistaken for a complete clone.
+func (s *RunState) fillDir(name string, repoDir string, log *Logger, fill func() error) error {
+	if err := s.StartClone(name); err != nil {
+		return err
+	}
+	err := fill()
+	if _, statErr := os.Lstat(repoDir); err != nil && statErr == nil {
+		log.Infof("Removing incomplete package directory")
+		if removeErr := os.RemoveAll(repoDir); removeErr != nil {
+			log.WithError(removeErr).Errorf("Failed to remove incomplete package directory")
+			return err
+		}
+	}
+	if finishErr := s.FinishClone(name); err == nil {
+		err = finishErr
+	}
+	return err
+}
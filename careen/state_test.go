@@ -0,0 +1,118 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRunStateRecordsPatchesByIndex(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	state, err := LoadRunState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single patch applied out of order says nothing of those before it
+	if err := state.ApplyPatch("pkg", 2, "c"); err != nil {
+		t.Fatal(err)
+	}
+	for i, hash := range []string{"a", "b", "c"} {
+		if state.PatchApplied("pkg", i, hash) {
+			t.Errorf("patch %v recorded as applied before the patches before it", i)
+		}
+	}
+	if state.PatchApplied("pkg", 0, "c") {
+		t.Errorf("patch 2 recorded as patch 0")
+	}
+
+	if err := state.ApplyPatch("pkg", 0, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.ApplyPatch("pkg", 1, "b"); err != nil {
+		t.Fatal(err)
+	}
+	// The state is read back as written
+	state, err = LoadRunState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(state.Packages["pkg"].Applied, want) {
+		t.Errorf("applied = %q, want %q", state.Packages["pkg"].Applied, want)
+	}
+	for i, hash := range []string{"a", "b", "c"} {
+		if !state.PatchApplied("pkg", i, hash) {
+			t.Errorf("patch %v not recorded as applied", i)
+		}
+	}
+	if state.PatchApplied("pkg", 1, "changed") || state.PatchApplied("pkg", 3, "") || state.PatchApplied("other", 0, "a") {
+		t.Errorf("a patch not applied is recorded as applied")
+	}
+
+	if err := state.FinishApply("pkg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stateFilename)); !os.IsNotExist(err) {
+		t.Errorf("state file left once nothing is unfinished: %v", err)
+	}
+}
+
+func TestApplyPackageResumesAfterSinglePatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := NewWorkspace(filepath.Join(dir, "out"), filepath.Join(dir, "patches"))
+	if err := os.MkdirAll(filepath.Join(dir, "out", "pkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pkg := &Package{Name: "pkg"}
+	for _, name := range []string{"a", "b", "c"} {
+		patch := fmt.Sprintf("diff --git a/%v.txt b/%v.txt\nnew file mode 100644\n--- /dev/null\n+++ b/%v.txt\n@@ -0,0 +1 @@\n+%v\n", name, name, name, name)
+		digest := sha1.Sum([]byte(patch))
+		pkg.Patches = append(pkg.Patches, Patch{Name: name, Filename: name + ".patch", Hash: hex.EncodeToString(digest[:])})
+		writeTestTree(t, filepath.Join(dir, "patches"), MemoryTree{name + ".patch": textFile(patch)})
+	}
+	ctx := context.Background()
+
+	if _, err := w.Apply(ctx, pkg, &pkg.Patches[2]); err != nil {
+		t.Fatal(err)
+	}
+	results := []*Result{}
+	w.Events = func(event Event) {
+		if event.Type == PatchFinished {
+			results = append(results, event.Result)
+		}
+	}
+	if _, err := w.ApplyPackage(ctx, pkg); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"", "", "Applied by an unfinished run"} {
+		if i >= len(results) || results[i].Message != want {
+			t.Errorf("patch %v: results %+v, want message %q", i, results, want)
+		}
+	}
+	tree := readTestTree(t, filepath.Join(dir, "out", "pkg"))
+	if len(tree) != 3 {
+		t.Errorf("package has %v", describeTestTree(tree))
+	}
+}
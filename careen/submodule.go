@@ -0,0 +1,217 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	SubmodulesNone      = "none"
+	SubmodulesRecursive = "recursive"
+)
+
+// Which submodules of a git package are checked out: none, recursive for all
+// of them and their own submodules, or the listed submodule paths. Written in
+// manifests as the mode or as the list of paths.
+type Submodules struct {
+	Mode  string
+	Paths []string
+}
+
+func (s *Submodules) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var mode string
+	if err := unmarshal(&mode); err == nil {
+		s.Mode, s.Paths = mode, nil
+		return nil
+	}
+	var paths []string
+	if err := unmarshal(&paths); err != nil {
+		return fmt.Errorf("submodules must be %v, %v or a list of paths", SubmodulesNone, SubmodulesRecursive)
+	}
+	s.Mode, s.Paths = "", paths
+	return nil
+}
+
+func (s Submodules) MarshalYAML() (interface{}, error) {
+	if s.Mode == "" {
+		return s.Paths, nil
+	}
+	return s.Mode, nil
+}
+
+func (s *Submodules) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		s.Mode, s.Paths = mode, nil
+		return nil
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return fmt.Errorf("submodules must be %v, %v or a list of paths", SubmodulesNone, SubmodulesRecursive)
+	}
+	s.Mode, s.Paths = "", paths
+	return nil
+}
+
+func (s Submodules) MarshalJSON() ([]byte, error) {
+	if s.Mode == "" {
+		if s.Paths == nil {
+			return []byte("[]"), nil
+		}
+		return json.Marshal(s.Paths)
+	}
+	return json.Marshal(s.Mode)
+}
+
+// Returns the setting as written in manifests, or "" when not set
+func (s *Submodules) String() string {
+	if s == nil {
+		return ""
+	}
+	if s.Mode == "" {
+		return "[" + strings.Join(s.Paths, ", ") + "]"
+	}
+	return s.Mode
+}
+
+// Reports whether any submodules are checked out
+func (s *Submodules) Enabled() bool {
+	return s != nil && s.Mode != SubmodulesNone
+}
+
+func (s *Submodules) Validate() error {
+	switch s.Mode {
+	case "":
+		for _, path := range s.Paths {
+			if err := validateRelativePath("submodule path", path); err != nil {
+				return err
+			}
+		}
+	case SubmodulesNone, SubmodulesRecursive:
+	default:
+		return fmt.Errorf("submodules must be %v, %v or a list of paths, not %v", SubmodulesNone, SubmodulesRecursive, s.Mode)
+	}
+	return nil
+}
+
+// Calls fn for each submodule selected by submodules, in the repository in
+// repoDir and, when recursive, in the submodules below it once fn returns
+func walkSubmodules(git GitBackend, repoDir string, submodules *Submodules, fn func(repoDir string, path string) error) error {
+	paths := submodules.Paths
+	recursive := submodules.Mode == SubmodulesRecursive
+	if recursive {
+		var err error
+		paths, err = git.SubmodulePaths(repoDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, path := range paths {
+		if err := fn(repoDir, path); err != nil {
+			return fmt.Errorf("Submodule %v of repository directory %v: %v", path, repoDir, err)
+		}
+		if recursive {
+			if err := walkSubmodules(git, filepath.Join(repoDir, path), submodules, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Initializes and checks out the selected submodules of the repository in
+// repoDir at the commits recorded by its checked out revision. Failed fetches
+// are retried as policy allows. The objects fetched are reported to progress,
+// if not nil.
+func UpdateSubmodules(ctx context.Context, git GitBackend, repoDir string, submodules *Submodules, policy RetryPolicy, progress ProgressFunc, log *Logger) error {
+	if !submodules.Enabled() {
+		return nil
+	}
+
+	return walkSubmodules(git, repoDir, submodules, func(repoDir string, path string) error {
+		if err := checkInterrupted(ctx); err != nil {
+			return err
+		}
+		subLog := log.With(Fields{"repo": repoDir, "submodule": path})
+		subLog.Infof("Updating submodule")
+
+		workDir, err := SafeJoin(repoDir, path)
+		if err != nil {
+			return err
+		}
+		gitDir, err := git.SubmoduleGitDir(repoDir, path)
+		if err != nil {
+			return err
+		}
+		// A submodule not cloned before is removed after a failed attempt,
+		// so the next one clones it afresh
+		fresh, err := isEmptyOrMissing(workDir)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(gitDir); !os.IsNotExist(err) {
+			fresh = false
+		}
+
+		return policy.Do(ctx, subLog, func() error {
+			err := git.UpdateSubmodule(ctx, repoDir, path, progress)
+			if err != nil && fresh {
+				subLog.Debugf("Removing incomplete submodule")
+				if removeErr := os.RemoveAll(gitDir); removeErr != nil {
+					return removeErr
+				}
+				if removeErr := os.RemoveAll(workDir); removeErr != nil {
+					return removeErr
+				}
+				if mkdirErr := os.MkdirAll(workDir, 0755); mkdirErr != nil {
+					return mkdirErr
+				}
+			}
+			return err
+		})
+	})
+}
+
+// Checks that the selected submodules of the repository in repoDir are checked
+// out at the commits recorded by its checked out revision
+func VerifySubmodules(git GitBackend, repoDir string, submodules *Submodules) error {
+	if !submodules.Enabled() {
+		return nil
+	}
+
+	return walkSubmodules(git, repoDir, submodules, func(repoDir string, path string) error {
+		recorded, checkedOut, err := git.SubmoduleCommits(repoDir, path)
+		if err != nil {
+			return err
+		}
+		if recorded == "" {
+			return fmt.Errorf("not recorded by the checked out revision")
+		}
+		if checkedOut == "" {
+			return fmt.Errorf("not checked out, expected commit %v", recorded)
+		}
+		if checkedOut != recorded {
+			return fmt.Errorf("commit %v is checked out, expected %v", checkedOut, recorded)
+		}
+		return nil
+	})
+}
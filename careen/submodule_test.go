@@ -0,0 +1,167 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Commits the files in dir to a new repository there, returning the commit id
+func makeTestRepo(t *testing.T, dir string, tree MemoryTree) string {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, dir, "init", "-q")
+	writeTestTree(t, dir, tree)
+	return commitTestRepo(t, dir, "initial")
+}
+
+func commitTestRepo(t *testing.T, dir string, message string) string {
+	runTestGit(t, dir, "add", "-A")
+	runTestGit(t, dir, "-c", "user.name=careen", "-c", "user.email=careen@example.com", "commit", "-q", "-m", message)
+	return strings.TrimSpace(string(runTestGit(t, dir, "rev-parse", "HEAD")))
+}
+
+func addTestSubmodule(t *testing.T, dir string, url string, path string) {
+	runTestGit(t, dir, "-c", "protocol.file.allow=always", "submodule", "add", "-q", url, path)
+}
+
+func TestUpdateSubmodules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	for _, name := range []string{GitBackendCLI, GitBackendGoGit} {
+		git, err := NewGitBackend(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) { testUpdateSubmodules(t, git) })
+	}
+}
+
+func testUpdateSubmodules(t *testing.T, git GitBackend) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Submodules are cloned from local paths, which git refuses by default
+	oldAllow, hadAllow := os.LookupEnv("GIT_ALLOW_PROTOCOL")
+	os.Setenv("GIT_ALLOW_PROTOCOL", "file")
+	defer func() {
+		if hadAllow {
+			os.Setenv("GIT_ALLOW_PROTOCOL", oldAllow)
+		} else {
+			os.Unsetenv("GIT_ALLOW_PROTOCOL")
+		}
+	}()
+
+	nestedDir := filepath.Join(dir, "nested")
+	makeTestRepo(t, nestedDir, MemoryTree{"nested.txt": textFile("nested\n")})
+	libDir := filepath.Join(dir, "lib")
+	makeTestRepo(t, libDir, MemoryTree{"lib.txt": textFile("lib v1\n")})
+	addTestSubmodule(t, libDir, nestedDir, "nested")
+	libCommit := commitTestRepo(t, libDir, "add nested")
+	otherDir := filepath.Join(dir, "other")
+	makeTestRepo(t, otherDir, MemoryTree{"other.txt": textFile("other\n")})
+
+	upstreamDir := filepath.Join(dir, "upstream")
+	makeTestRepo(t, upstreamDir, MemoryTree{"README": textFile("upstream\n")})
+	addTestSubmodule(t, upstreamDir, libDir, "vendor/lib")
+	addTestSubmodule(t, upstreamDir, otherDir, "other")
+	upstreamCommit := commitTestRepo(t, upstreamDir, "add submodules")
+
+	// A later commit to lib must not be picked up, only the recorded one
+	writeTestTree(t, libDir, MemoryTree{"lib.txt": textFile("lib v2\n")})
+	commitTestRepo(t, libDir, "v2")
+
+	ctx := context.Background()
+	readFile := func(path string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "work", filepath.FromSlash(path)))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	repoDir := filepath.Join(dir, "work")
+	if err := git.Clone(ctx, upstreamDir, repoDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.Checkout(ctx, repoDir, upstreamCommit); err != nil {
+		t.Fatal(err)
+	}
+
+	none := &Submodules{Mode: SubmodulesNone}
+	if err := UpdateSubmodules(ctx, git, repoDir, none, noRetries, nil, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySubmodules(git, repoDir, none); err != nil {
+		t.Errorf("VerifySubmodules with none: %v", err)
+	}
+	if got := readFile("vendor/lib/lib.txt"); got != "" {
+		t.Errorf("submodules none checked out vendor/lib")
+	}
+
+	paths := &Submodules{Paths: []string{"vendor/lib"}}
+	if err := VerifySubmodules(git, repoDir, paths); err == nil || !strings.Contains(err.Error(), "not checked out") {
+		t.Errorf("VerifySubmodules before update = %v, want not checked out", err)
+	}
+	if err := UpdateSubmodules(ctx, git, repoDir, paths, noRetries, nil, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile("vendor/lib/lib.txt"); got != "lib v1\n" {
+		t.Errorf("vendor/lib/lib.txt = %q, want the recorded commit's contents", got)
+	}
+	if got := readFile("other/other.txt"); got != "" {
+		t.Errorf("unlisted submodule other was checked out")
+	}
+	if got := readFile("vendor/lib/nested/nested.txt"); got != "" {
+		t.Errorf("nested submodule was checked out without recursive")
+	}
+	if err := VerifySubmodules(git, repoDir, paths); err != nil {
+		t.Errorf("VerifySubmodules after update: %v", err)
+	}
+
+	recursive := &Submodules{Mode: SubmodulesRecursive}
+	if err := UpdateSubmodules(ctx, git, repoDir, recursive, noRetries, nil, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"vendor/lib/lib.txt":           "lib v1\n",
+		"vendor/lib/nested/nested.txt": "nested\n",
+		"other/other.txt":              "other\n",
+	} {
+		if got := readFile(path); got != want {
+			t.Errorf("%v = %q, want %q", path, got, want)
+		}
+	}
+	if err := VerifySubmodules(git, repoDir, recursive); err != nil {
+		t.Errorf("VerifySubmodules after recursive update: %v", err)
+	}
+
+	// Moving a submodule off its recorded commit fails verification
+	subDir := filepath.Join(repoDir, "vendor", "lib")
+	runTestGit(t, subDir, "fetch", "-q", "origin")
+	runTestGit(t, subDir, "checkout", "-q", "FETCH_HEAD")
+	err := VerifySubmodules(git, repoDir, paths)
+	if err == nil || !strings.Contains(err.Error(), "expected "+libCommit) {
+		t.Errorf("VerifySubmodules with a moved submodule = %v, want an error expecting %v", err, libCommit)
+	}
+}
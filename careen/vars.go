@@ -0,0 +1,102 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Matches ${NAME} references in manifest values
+var varReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Looks up a variable defined outside of the manifest. Values found this way
+// take precedence over the vars section of the manifest.
+type VarLookup func(name string) (string, bool)
+
+// Replaces ${NAME} in value, recording the names of any undefined variables
+func expandVars(value string, vars map[string]string, lookup VarLookup, undefined map[string]bool) string {
+	return varReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := varReference.FindStringSubmatch(ref)[1]
+		if lookup != nil {
+			if v, ok := lookup(name); ok {
+				return v
+			}
+		}
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		undefined[name] = true
+		return ref
+	})
+}
+
+// Substitutes variables in the hooks and every package and patch of the
+// manifest. All references to undefined variables are reported together in
+// the error, except in hooks, where they are left for the shell to expand.
+func (m *Manifest) ResolveVars(lookup VarLookup) error {
+	var problems []string
+
+	resolve := func(where string, value *string) {
+		undefined := map[string]bool{}
+		*value = expandVars(*value, m.Vars, lookup, undefined)
+		for name := range undefined {
+			problems = append(problems, fmt.Sprintf("%v: undefined variable %v", where, name))
+		}
+	}
+
+	// Hooks may use ${HOME}, ${CAREEN_REPO_DIR} and the like in the shell
+	resolveHooks := func(hooks *Hooks) {
+		for _, hook := range HookNames {
+			commands := hooks.Commands(hook)
+			for k := range commands {
+				commands[k] = expandVars(commands[k], m.Vars, lookup, map[string]bool{})
+			}
+		}
+	}
+
+	resolveHooks(m.Hooks)
+	for i := range m.Packages {
+		pkg := &m.Packages[i]
+		resolve(pkg.Name+": repo", &pkg.Repo)
+		resolve(pkg.Name+": revision", &pkg.Revision)
+		resolve(pkg.Name+": tag", &pkg.Tag)
+		if pkg.Archive != nil {
+			resolve(pkg.Name+": archive: url", &pkg.Archive.Url)
+			resolve(pkg.Name+": archive: digest", &pkg.Archive.Digest)
+		}
+		if pkg.Local != nil {
+			resolve(pkg.Name+": local: path", &pkg.Local.Path)
+		}
+		resolveHooks(pkg.Hooks)
+		for j := range pkg.Patches {
+			patch := &pkg.Patches[j]
+			resolve(fmt.Sprintf("%v: patch %q: filename", pkg.Name, patch.Name), &patch.Filename)
+			resolve(fmt.Sprintf("%v: patch %q: hash", pkg.Name, patch.Name), &patch.Hash)
+			for k := range patch.Documentation {
+				resolve(fmt.Sprintf("%v: patch %q: documentation", pkg.Name, patch.Name), &patch.Documentation[k])
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("Manifest has unresolved variables:\n  %v", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveVarsSources(t *testing.T) {
+	manifest := &Manifest{
+		Vars: map[string]string{"MIRROR": "https://mirror.example.com", "VERSION": "1.12.6"},
+		Packages: []Package{
+			{Name: "docker", Source: SourceArchive, Archive: &ArchiveSource{
+				Url:    "${MIRROR}/docker-${VERSION}.tar.gz",
+				Digest: "sha256:${DIGEST}",
+			}},
+			{Name: "etcd", Source: SourceLocal, Local: &LocalSource{Path: "${HOME_DIR}/etcd"}},
+		},
+	}
+	lookup := func(name string) (string, bool) {
+		if name == "DIGEST" {
+			return "abc", true
+		}
+		return "", false
+	}
+
+	err := manifest.ResolveVars(lookup)
+	if err == nil || !strings.Contains(err.Error(), "etcd: local: path: undefined variable HOME_DIR") {
+		t.Errorf("ResolveVars error = %v, want undefined HOME_DIR in local path", err)
+	}
+	archive := manifest.Packages[0].Archive
+	if archive.Url != "https://mirror.example.com/docker-1.12.6.tar.gz" {
+		t.Errorf("archive url = %q", archive.Url)
+	}
+	if archive.Digest != "sha256:abc" {
+		t.Errorf("archive digest = %q", archive.Digest)
+	}
+}
+
+func TestResolveVarsHooks(t *testing.T) {
+	manifest := &Manifest{
+		Vars:  map[string]string{"GO": "/usr/local/go/bin/go"},
+		Hooks: &Hooks{PostClone: []string{"${GO} generate ./..."}},
+		Packages: []Package{
+			{Name: "docker", Hooks: &Hooks{PostApply: []string{"echo $CAREEN_PACKAGE", "${HOME}/check.sh ${CAREEN_REPO_DIR}"}}},
+		},
+	}
+
+	// Names the manifest does not define are left for the shell
+	if err := manifest.ResolveVars(nil); err != nil {
+		t.Errorf("ResolveVars error = %v, want none", err)
+	}
+	if command := manifest.Hooks.PostClone[0]; command != "/usr/local/go/bin/go generate ./..." {
+		t.Errorf("post_clone = %q", command)
+	}
+	if command := manifest.Packages[0].Hooks.PostApply[0]; command != "echo $CAREEN_PACKAGE" {
+		t.Errorf("post_apply = %q", command)
+	}
+	if command := manifest.Packages[0].Hooks.PostApply[1]; command != "${HOME}/check.sh ${CAREEN_REPO_DIR}" {
+		t.Errorf("post_apply = %q", command)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+import (
+	"context"
+	"fmt"
+)
+
+// Runs the checks applying makes before patching on the packages and every
+// one of their patches, without applying them. Every problem is reported, not
+// just the first: the results of all packages and patches are returned, with
+// an error if any failed.
+func (w *Workspace) Verify(ctx context.Context, packages ...Package) ([]*Result, error) {
+	results := []*Result{}
+	failed := 0
+	for i := range packages {
+		if err := checkInterrupted(ctx); err != nil {
+			return results, err
+		}
+		pkg := &packages[i]
+		log := w.log().With(Fields{"package": pkg.Name})
+		result := w.start(pkg, -1)
+		repoDir, err := w.PackageDir(pkg)
+		if err != nil {
+			log.Errorf("%v", err)
+		} else if empty, emptyErr := isEmptyOrMissing(repoDir); emptyErr == nil && !empty {
+			log = log.With(Fields{"repo": repoDir})
+			err = w.CheckPackage(pkg)
+			if err != nil {
+				log.WithError(err).Errorf("Package failed verification")
+			}
+		} else {
+			result.Skip("Repository is not cloned")
+		}
+		if err != nil {
+			failed++
+		}
+		w.finish(result, -1, err)
+		results = append(results, result)
+
+		for j := range pkg.Patches {
+			if err := checkInterrupted(ctx); err != nil {
+				return results, err
+			}
+			result, err := w.verifyPatch(pkg, j, log)
+			if err != nil {
+				failed++
+			}
+			results = append(results, result)
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%v packages and patches failed verification", failed)
+	}
+	return results, nil
+}
+
+func (w *Workspace) verifyPatch(pkg *Package, i int, log *Logger) (*Result, error) {
+	result := w.start(pkg, i)
+	patch := &pkg.Patches[i]
+	patchName, err := w.PatchFilename(patch)
+	if err == nil {
+		result.File = patchName
+		err = w.CheckPatch(patch)
+	}
+	log = log.With(Fields{"patch": patchName})
+	if err != nil {
+		log.WithError(err).Errorf("Patch failed verification")
+		return w.finish(result, i, err)
+	}
+	log.Infof("Verified patch")
+	return w.finish(result, i, nil)
+}
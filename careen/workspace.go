@@ -0,0 +1,275 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package careen clones the packages of a manifest from git repositories,
+// archives or local directories and applies their patches. The careen command
+// is a thin wrapper around a Workspace.
+package careen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Default time applying a patch may take
+const DefaultApplyTimeout = 10 * time.Second
+
+// Where the packages of a manifest are cloned and the patches they are
+// patched with, together with what cloning and patching checks and runs and
+// how failures are retried
+type Workspace struct {
+	OutputDir string
+	PatchDir  string
+	// Manifests and overlays in use, whose signatures CheckManifests checks
+	ManifestFiles     []string
+	OverlayFiles      []string
+	Rewrites          []URLRewrite
+	Keys              TrustedKeys
+	RequireSignatures bool
+	Policy            *PatchPolicy // Nil for none
+	Retries           RetryPolicies
+	ApplyTimeout      time.Duration // 0 for no limit
+	Git               GitBackend    // Nil for the default backend
+	// Run for every package, before the package's own hooks. Nil for none.
+	Hooks       *Hooks
+	HookTimeout time.Duration // 0 for no limit
+	// Apply patches in memory only, checking that they apply without
+	// changing the packages
+	DryRun  bool
+	Log     *Logger     // Nil discards messages
+	Events  func(Event) // Nil ignores events
+	state   *RunState
+	dryRuns map[string]*PatchedTree // Packages as patched by dry runs
+	// Set once CheckManifests passes, so hooks check the manifests only once
+	manifestsChecked bool
+}
+
+// Returns a workspace with the default retry policies, apply and hook timeouts
+func NewWorkspace(outputDir string, patchDir string) *Workspace {
+	return &Workspace{
+		OutputDir: outputDir,
+		PatchDir:  patchDir,
+		Retries: RetryPolicies{
+			Clone:    DefaultRetryPolicy,
+			Fetch:    DefaultRetryPolicy,
+			Download: DefaultRetryPolicy,
+		},
+		ApplyTimeout: DefaultApplyTimeout,
+		HookTimeout:  DefaultHookTimeout,
+	}
+}
+
+// Kind of event sent to Workspace.Events
+type EventType int
+
+const (
+	PackageStarted EventType = iota
+	PackageFinished
+	PatchStarted
+	PatchFinished
+	// A download, such as a clone, archive or LFS objects, which may take a while
+	TransferStarted
+	TransferProgress
+	TransferFinished
+)
+
+// What a workspace is doing, sent to Workspace.Events as it happens, so
+// callers can show progress and collect results
+type Event struct {
+	Type    EventType
+	Package string
+	Patch   int     // Index of the patch, for patch events
+	Result  *Result // Result so far, final for finished events
+	Current uint64  // Objects received, for TransferProgress
+	Total   uint64  // Objects to receive, 0 until known
+}
+
+var discardLogger = NewLogger(ioutil.Discard)
+
+func (w *Workspace) log() *Logger {
+	if w.Log == nil {
+		return discardLogger
+	}
+	return w.Log
+}
+
+func (w *Workspace) git() GitBackend {
+	if w.Git == nil {
+		w.Git, _ = NewGitBackend("")
+	}
+	return w.Git
+}
+
+func (w *Workspace) emit(event Event) {
+	if w.Events != nil {
+		w.Events(event)
+	}
+}
+
+// Reports a transfer of the package as started, returning the progress
+// callback for it and the function to call when it is done
+func (w *Workspace) transfer(pkg *Package) (progress ProgressFunc, done func()) {
+	w.emit(Event{Type: TransferStarted, Package: pkg.Name})
+	progress = func(current uint64, total uint64) {
+		w.emit(Event{Type: TransferProgress, Package: pkg.Name, Current: current, Total: total})
+	}
+	return progress, func() {
+		w.emit(Event{Type: TransferFinished, Package: pkg.Name})
+	}
+}
+
+// Returns the state of runs in OutputDir, loading it the first time
+func (w *Workspace) runState() (*RunState, error) {
+	if w.state == nil {
+		state, err := LoadRunState(w.OutputDir)
+		if err != nil {
+			return nil, err
+		}
+		w.state = state
+	}
+	return w.state, nil
+}
+
+// Returns the package in repoDir as patched so far by dry runs
+func (w *Workspace) dryRun(pkg *Package, repoDir string) *PatchedTree {
+	if w.dryRuns == nil {
+		w.dryRuns = map[string]*PatchedTree{}
+	}
+	if w.dryRuns[pkg.Name] == nil {
+		w.dryRuns[pkg.Name] = NewPatchedTree(DirTree(repoDir))
+	}
+	return w.dryRuns[pkg.Name]
+}
+
+// Returns the directory the package is cloned into
+func (w *Workspace) PackageDir(pkg *Package) (string, error) {
+	return packageDir(w.OutputDir, pkg)
+}
+
+// Returns the path of the patch file
+func (w *Workspace) PatchFilename(patch *Patch) (string, error) {
+	return patchFilename(w.PatchDir, patch)
+}
+
+// Starts the result of the package, or of its i-th patch if i is not -1
+func (w *Workspace) start(pkg *Package, i int) *Result {
+	result := &Result{Package: pkg.Name, Hash: packageHash(pkg)}
+	eventType := PackageStarted
+	if i >= 0 {
+		patch := &pkg.Patches[i]
+		result = &Result{Package: pkg.Name, Patch: patch.Name, File: patch.Filename, Hash: patch.Hash}
+		eventType = PatchStarted
+	}
+	result.Start()
+	w.emit(Event{Type: eventType, Package: pkg.Name, Patch: i, Result: result})
+	return result
+}
+
+// Passes or fails the result as err says and reports it finished
+func (w *Workspace) finish(result *Result, i int, err error) (*Result, error) {
+	if err != nil {
+		result.Fail(err)
+	} else if result.Status == "" {
+		result.Pass()
+	}
+	eventType := PackageFinished
+	if i >= 0 {
+		eventType = PatchFinished
+	}
+	w.emit(Event{Type: eventType, Package: result.Package, Patch: i, Result: result})
+	return result, err
+}
+
+// Checks the signatures of the manifests and overlays in use. Hooks are not
+// run before this passes, as manifest hooks are shell commands.
+func (w *Workspace) CheckManifests() error {
+	if err := verifyManifestSignatures(w.ManifestFiles, w.OverlayFiles, w.Keys, w.RequireSignatures, w.log()); err != nil {
+		return err
+	}
+	w.manifestsChecked = true
+	return nil
+}
+
+// Checks that the submodules and LFS files of the package are as cloned.
+// Patches may change files inside submodules, which must be at the commits
+// the patches were written against. When the package asks for signatures,
+// its tag must be checked out and signed by a trusted key.
+func (w *Workspace) CheckPackage(pkg *Package) error {
+	repoDir, err := w.PackageDir(pkg)
+	if err != nil {
+		return err
+	}
+	if pkg.VerifySignature != "" && pkg.VerifySignature != VerifySignatureNone {
+		if err := w.checkTagCheckedOut(pkg, repoDir); err != nil {
+			return err
+		}
+		if err := VerifyRevisionSignature(repoDir, pkg.Tag, pkg.VerifySignature, w.Keys, w.log()); err != nil {
+			return err
+		}
+	}
+	if err := VerifySubmodules(w.git(), repoDir, pkg.Submodules); err != nil {
+		return err
+	}
+	if pkg.Lfs {
+		return VerifyLFSObjects(w.git(), repoDir)
+	}
+	return nil
+}
+
+// Checks that HEAD of the repository in repoDir is the commit of the package's tag
+func (w *Workspace) checkTagCheckedOut(pkg *Package, repoDir string) error {
+	head, err := w.git().ResolveRef(repoDir, "HEAD")
+	if err != nil {
+		return err
+	}
+	tagCommit, err := w.git().ResolveRef(repoDir, pkg.Tag)
+	if err != nil {
+		return err
+	}
+	if head != tagCommit {
+		return fmt.Errorf("Repository directory %v has commit %v checked out, not tag %v at %v", repoDir, head, pkg.Tag, tagCommit)
+	}
+	return nil
+}
+
+// Checks the hash, signature and contents of the patch file
+func (w *Workspace) CheckPatch(patch *Patch) error {
+	patchName, err := w.PatchFilename(patch)
+	if err != nil {
+		return err
+	}
+	if _, err := VerifyPatch(patchName, patch.Hash); err != nil {
+		return err
+	}
+	if err := VerifyDetachedSignature(patchName, w.Keys, w.RequireSignatures, w.log()); err != nil {
+		return err
+	}
+	if w.Policy != nil {
+		return CheckPatchPolicy(patchName, w.Policy)
+	}
+	return nil
+}
+
+// Returns the index of patch among the patches of pkg, which may be a pointer
+// to one of them or a copy
+func patchIndex(pkg *Package, patch *Patch) (int, error) {
+	for i := range pkg.Patches {
+		p := &pkg.Patches[i]
+		if p == patch || (p.Name == patch.Name && p.Filename == patch.Filename && p.Hash == patch.Hash) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("Patch %v is not a patch of package %v", patch.Name, pkg.Name)
+}
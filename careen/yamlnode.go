@@ -0,0 +1,663 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package careen
+
+// A minimal reader for the block style YAML used by manifests. Unlike
+// go-yaml it keeps comments and the exact text of scalars, which the
+// formatter needs. Block scalars, anchors, aliases, tags and flow collections
+// written on one line are understood. Constructs that manifests have no use
+// for, such as multi-line plain or quoted scalars and complex keys, are
+// rejected rather than guessed at.
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type yamlNodeKind int
+
+const (
+	yamlScalar yamlNodeKind = iota
+	yamlMapping
+	yamlSequence
+)
+
+type yamlNode struct {
+	Kind yamlNodeKind
+	// Source text of a scalar, including any quotes. For a block scalar it is
+	// the header, e.g. "|-", and Block holds its lines.
+	Value string
+	// Lines of a block scalar without their indentation, "" for empty lines
+	Block []string
+	// Anchor and tag written before the node, e.g. "&base"
+	Props string
+	// Entries of a mapping, or items of a sequence (with an empty Key)
+	Entries []*yamlEntry
+}
+
+type yamlEntry struct {
+	Key   string
+	Value *yamlNode
+	Line  int
+	// Whole line comments before the entry and a comment at the end of its line
+	Comments []string
+	Trailing string
+}
+
+type yamlDocument struct {
+	Root *yamlNode
+	// Comments before and after the "---" which starts the document, and
+	// after the last entry
+	Preamble []string
+	Header   []string
+	Footer   []string
+}
+
+type yamlLine struct {
+	num      int
+	indent   int
+	text     string
+	comments []string
+	// Lines of the block scalar the line's value starts, if any
+	block []string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func ParseYAMLDocument(data []byte) (*yamlDocument, error) {
+	p := &yamlParser{}
+	doc := &yamlDocument{}
+	comments := []string{}
+
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		text := strings.TrimRight(lines[i], " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "#"):
+			comments = append(comments, trimmed)
+			continue
+		case text == "---":
+			if len(p.lines) > 0 || doc.Preamble != nil {
+				return nil, fmt.Errorf("line %v: only one YAML document is supported", i+1)
+			}
+			doc.Preamble = comments
+			comments = []string{}
+			continue
+		case strings.HasPrefix(trimmed, "\t"):
+			return nil, fmt.Errorf("line %v: tabs are not allowed in indentation", i+1)
+		}
+		line := yamlLine{
+			num:      i + 1,
+			indent:   len(text) - len(trimmed),
+			text:     trimmed,
+			comments: comments,
+		}
+		// The lines of block scalars are read here, as they may look like
+		// comments or be empty
+		if parent, header, ok := blockScalarStart(line.indent, trimmed); ok {
+			var err error
+			line.block, i, err = readBlockScalar(lines, i, parent, header)
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.lines = append(p.lines, line)
+		comments = []string{}
+	}
+	doc.Footer = comments
+
+	// Comments at the top describe the document rather than its first key
+	if len(p.lines) > 0 {
+		doc.Header = p.lines[0].comments
+		p.lines[0].comments = nil
+	}
+
+	if len(p.lines) == 0 {
+		doc.Root = &yamlNode{Kind: yamlMapping}
+		return doc, nil
+	}
+
+	root, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %v: unexpected indentation", p.lines[p.pos].num)
+	}
+	doc.Root = root
+	return doc, nil
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+var blockScalarHeader = regexp.MustCompile(`^([|>]([1-9][-+]?|[-+][1-9]?)?)( +#.*)?$`)
+
+// Returns whether the value of the line is a block scalar, with its header and
+// the indentation its lines must exceed: that of the key or "-" it belongs to
+func blockScalarStart(indent int, text string) (int, string, bool) {
+	parent := indent
+	for isSequenceItem(text) {
+		rest := strings.TrimLeft(text[1:], " ")
+		parent = indent
+		indent += len(text) - len(rest)
+		text = rest
+	}
+	if text == "" {
+		return 0, "", false
+	}
+	if _, rest, err := splitMappingEntry(text, 0); err == nil {
+		parent = indent
+		text = rest
+	}
+	_, text = splitNodeProperties(text)
+	match := blockScalarHeader.FindStringSubmatch(text)
+	if match == nil {
+		return 0, "", false
+	}
+	return parent, match[1], true
+}
+
+// Reads the lines of the block scalar whose header is on line i, returning
+// them without their indentation and the index of the last line read
+func readBlockScalar(lines []string, i int, parent int, header string) ([]string, int, error) {
+	indent := -1
+	if digit := strings.IndexAny(header, "123456789"); digit >= 0 {
+		indent = parent + int(header[digit]-'0')
+	}
+
+	block := []string{}
+	content, last, end := 0, i, len(lines)
+	for j := i + 1; j < len(lines); j++ {
+		text := strings.TrimSuffix(lines[j], "\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" {
+			if indent >= 0 && len(text) > indent {
+				block = append(block, text[indent:])
+			} else {
+				block = append(block, "")
+			}
+			continue
+		}
+		lineIndent := len(text) - len(trimmed)
+		if lineIndent <= parent {
+			end = j
+			break
+		}
+		if indent < 0 {
+			indent = lineIndent
+		}
+		if lineIndent < indent {
+			return nil, 0, fmt.Errorf("line %v: block scalar line is less indented than the first", j+1)
+		}
+		block = append(block, text[indent:])
+		content, last = len(block), j
+	}
+
+	// Empty lines after the last one only belong to the value when kept
+	if !strings.Contains(header, "+") {
+		return block[:content], last, nil
+	}
+	if end == len(lines) && lines[end-1] == "" && len(block) > content {
+		// The newline ending the file does not start another line
+		block = block[:len(block)-1]
+	}
+	return block, i + len(block), nil
+}
+
+// Splits the anchor and tag at the start of a node from the rest of its text
+func splitNodeProperties(text string) (string, string) {
+	props := []string{}
+	for text != "" && (text[0] == '&' || text[0] == '!') {
+		end := strings.Index(text, " ")
+		if end < 0 {
+			end = len(text)
+		}
+		props = append(props, text[:end])
+		text = strings.TrimLeft(text[end:], " ")
+	}
+	return strings.Join(props, " "), text
+}
+
+// Parses the block node starting at the current line
+func (p *yamlParser) parseBlock(indent int) (*yamlNode, error) {
+	if isSequenceItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+// Parses the value of a mapping key or sequence item which has nothing after
+// it on its own line. The value is either a more indented block, a sequence at
+// the same indentation as a mapping key, or null.
+func (p *yamlParser) parseChild(indent int, inMapping bool) (*yamlNode, error) {
+	if p.pos < len(p.lines) {
+		next := p.lines[p.pos]
+		if next.indent > indent {
+			return p.parseBlock(next.indent)
+		}
+		if inMapping && next.indent == indent && isSequenceItem(next.text) {
+			return p.parseSequence(indent)
+		}
+	}
+	return &yamlNode{Kind: yamlScalar}, nil
+}
+
+func (p *yamlParser) parseSequence(indent int) (*yamlNode, error) {
+	node := &yamlNode{Kind: yamlSequence}
+
+	for p.pos < len(p.lines) {
+		line := &p.lines[p.pos]
+		if line.indent < indent || (line.indent == indent && !isSequenceItem(line.text)) {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %v: unexpected indentation", line.num)
+		}
+
+		entry := &yamlEntry{Line: line.num, Comments: line.comments}
+		props, rest := splitNodeProperties(strings.TrimLeft(line.text[1:], " "))
+
+		var err error
+		switch {
+		case rest == "" || strings.HasPrefix(rest, "#"):
+			entry.Trailing = rest
+			p.pos++
+			entry.Value, err = p.parseChild(indent, false)
+		case isSequenceItem(rest) || isMappingEntry(rest):
+			if props != "" {
+				return nil, fmt.Errorf("line %v: anchors and tags must be on their own line before a collection", line.num)
+			}
+			// The item's block starts on the same line, e.g. "- name: docker"
+			line.indent += len(line.text) - len(rest)
+			line.text = rest
+			line.comments = nil
+			entry.Value, err = p.parseBlock(line.indent)
+		default:
+			entry.Value, entry.Trailing, err = parseFlowValue(rest, line.num, line.block)
+			p.pos++
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry.Value.Props = props
+
+		node.Entries = append(node.Entries, entry)
+	}
+
+	return node, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (*yamlNode, error) {
+	node := &yamlNode{Kind: yamlMapping}
+
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %v: unexpected indentation", line.num)
+		}
+		if isSequenceItem(line.text) {
+			return nil, fmt.Errorf("line %v: unexpected sequence item", line.num)
+		}
+
+		key, rest, err := splitMappingEntry(line.text, line.num)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range node.Entries {
+			if other.Key == key {
+				return nil, fmt.Errorf("line %v: duplicate key %q", line.num, key)
+			}
+		}
+
+		entry := &yamlEntry{Key: key, Line: line.num, Comments: line.comments}
+		p.pos++
+		props, rest := splitNodeProperties(rest)
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			entry.Trailing = rest
+			entry.Value, err = p.parseChild(indent, true)
+		} else {
+			entry.Value, entry.Trailing, err = parseFlowValue(rest, line.num, line.block)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry.Value.Props = props
+
+		node.Entries = append(node.Entries, entry)
+	}
+
+	return node, nil
+}
+
+func isMappingEntry(text string) bool {
+	_, _, err := splitMappingEntry(text, 0)
+	return err == nil
+}
+
+// Splits "key: rest" into the decoded key and the text after the colon
+func splitMappingEntry(text string, num int) (string, string, error) {
+	var raw, rest string
+	if text[0] == '"' || text[0] == '\'' {
+		end, err := quotedScalarEnd(text, num)
+		if err != nil {
+			return "", "", err
+		}
+		raw, rest = text[:end], text[end:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("line %v: expected ':' after key", num)
+		}
+		rest = rest[1:]
+	} else {
+		colon := strings.Index(text, ": ")
+		if colon < 0 && strings.HasSuffix(text, ":") {
+			colon = len(text) - 1
+		}
+		if colon <= 0 || strings.Contains(text[:colon], " #") {
+			return "", "", fmt.Errorf("line %v: expected 'key: value'", num)
+		}
+		raw, rest = text[:colon], text[colon+1:]
+	}
+	if rest != "" && rest[0] != ' ' {
+		return "", "", fmt.Errorf("line %v: expected space after ':'", num)
+	}
+	if strings.ContainsAny(raw[:1], "&!*[{") {
+		return "", "", fmt.Errorf("line %v: keys must be scalars without anchors or tags", num)
+	}
+
+	key, err := decodeScalar(raw, num)
+	if err != nil {
+		return "", "", err
+	}
+	return key, strings.TrimLeft(rest, " "), nil
+}
+
+// Returns the index just past the closing quote of the scalar starting text
+func quotedScalarEnd(text string, num int) (int, error) {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("line %v: unterminated quoted scalar", num)
+}
+
+// Parses a value written on the same line as its key: a scalar, the header
+// of a block scalar whose lines are block, or a flow collection. Returns the
+// value and any trailing comment.
+func parseFlowValue(text string, num int, block []string) (*yamlNode, string, error) {
+	var node *yamlNode
+	var rest string
+
+	if text[0] == '|' || text[0] == '>' {
+		if block == nil {
+			return nil, "", fmt.Errorf("line %v: invalid block scalar header %q", num, text)
+		}
+		end := strings.Index(text, " ")
+		if end < 0 {
+			end = len(text)
+		}
+		node, rest = &yamlNode{Kind: yamlScalar, Value: text[:end], Block: block}, text[end:]
+	} else {
+		var err error
+		node, rest, err = parseFlowNode(text, num, false)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	rest = strings.TrimLeft(rest, " ")
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, "", fmt.Errorf("line %v: unexpected %q after value", num, rest)
+	}
+	return node, rest, nil
+}
+
+// Parses the node at the start of text, which is inside a flow collection if
+// inFlow is set, and returns the text after it
+func parseFlowNode(text string, num int, inFlow bool) (*yamlNode, string, error) {
+	props, text := splitNodeProperties(text)
+	node := &yamlNode{Kind: yamlScalar, Props: props}
+	var rest string
+
+	switch {
+	case text == "":
+	case text[0] == '"' || text[0] == '\'':
+		end, err := quotedScalarEnd(text, num)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := decodeScalar(text[:end], num); err != nil {
+			return nil, "", err
+		}
+		node.Value, rest = text[:end], text[end:]
+	case text[0] == '[' || text[0] == '{':
+		collection, after, err := parseFlowCollection(text, num)
+		if err != nil {
+			return nil, "", err
+		}
+		collection.Props = props
+		node, rest = collection, after
+	case text[0] == '|' || text[0] == '>':
+		return nil, "", fmt.Errorf("line %v: block scalars must follow a key or '-'", num)
+	default:
+		// Aliases and plain scalars end at a comment, and inside a flow
+		// collection at the next item
+		end := strings.Index(text, " #")
+		if end < 0 {
+			end = len(text)
+		}
+		if inFlow {
+			if stop := strings.IndexAny(text, ",]}"); stop >= 0 && stop < end {
+				end = stop
+			}
+		} else if text[0] == '*' {
+			if stop := strings.Index(text, " "); stop >= 0 && stop < end {
+				end = stop
+			}
+		}
+		node.Value, rest = strings.TrimRight(text[:end], " "), text[end:]
+	}
+	return node, rest, nil
+}
+
+// Parses the flow sequence or mapping at the start of text, which must end on
+// the same line, and returns the text after it
+func parseFlowCollection(text string, num int) (*yamlNode, string, error) {
+	node, closing := &yamlNode{Kind: yamlSequence}, byte(']')
+	if text[0] == '{' {
+		node, closing = &yamlNode{Kind: yamlMapping}, '}'
+	}
+
+	for text = strings.TrimLeft(text[1:], " "); ; {
+		if text == "" || text[0] == '#' {
+			return nil, "", fmt.Errorf("line %v: flow collections must be on one line", num)
+		}
+		if text[0] == closing {
+			return node, text[1:], nil
+		}
+
+		entry := &yamlEntry{Line: num}
+		if node.Kind == yamlMapping {
+			key, rest, err := splitFlowKey(text, num)
+			if err != nil {
+				return nil, "", err
+			}
+			for _, other := range node.Entries {
+				if other.Key == key {
+					return nil, "", fmt.Errorf("line %v: duplicate key %q", num, key)
+				}
+			}
+			entry.Key, text = key, rest
+		}
+		value, rest, err := parseFlowNode(text, num, true)
+		if err != nil {
+			return nil, "", err
+		}
+		entry.Value = value
+		node.Entries = append(node.Entries, entry)
+
+		text = strings.TrimLeft(rest, " ")
+		switch {
+		case strings.HasPrefix(text, ","):
+			text = strings.TrimLeft(text[1:], " ")
+		case text != "" && text[0] == closing:
+		default:
+			return nil, "", fmt.Errorf("line %v: expected ',' or '%c' in flow collection", num, closing)
+		}
+	}
+}
+
+// Splits "key: rest" inside a flow mapping into the decoded key and the text
+// after the colon
+func splitFlowKey(text string, num int) (string, string, error) {
+	var raw, rest string
+	if text[0] == '"' || text[0] == '\'' {
+		end, err := quotedScalarEnd(text, num)
+		if err != nil {
+			return "", "", err
+		}
+		raw, rest = text[:end], strings.TrimLeft(text[end:], " ")
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("line %v: expected ':' after key", num)
+		}
+		rest = rest[1:]
+	} else {
+		colon := -1
+		for i := 0; i < len(text) && colon < 0; i++ {
+			switch {
+			case text[i] == ',' || text[i] == '}':
+				return "", "", fmt.Errorf("line %v: expected 'key: value' in flow mapping", num)
+			case text[i] == ':' && (i+1 == len(text) || strings.IndexByte(" ,}", text[i+1]) >= 0):
+				colon = i
+			}
+		}
+		if colon <= 0 {
+			return "", "", fmt.Errorf("line %v: expected 'key: value' in flow mapping", num)
+		}
+		raw, rest = strings.TrimRight(text[:colon], " "), text[colon+1:]
+	}
+	if strings.ContainsAny(raw[:1], "&!*[{") {
+		return "", "", fmt.Errorf("line %v: keys must be scalars without anchors or tags", num)
+	}
+
+	key, err := decodeScalar(raw, num)
+	if err != nil {
+		return "", "", err
+	}
+	return key, strings.TrimLeft(rest, " "), nil
+}
+
+// Returns the string value of a scalar's source text
+func decodeScalar(raw string, num int) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	switch raw[0] {
+	case '\'':
+		return strings.Replace(raw[1:len(raw)-1], "''", "'", -1), nil
+	case '"':
+		return decodeDoubleQuoted(raw[1:len(raw)-1], num)
+	default:
+		return raw, nil
+	}
+}
+
+func decodeDoubleQuoted(text string, num int) (string, error) {
+	escapes := map[byte]string{
+		'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", 'n': "\n", 'v': "\v", 'f': "\f",
+		'r': "\r", 'e': "\x1b", ' ': " ", '"': "\"", '/': "/", '\\': "\\",
+		'N': "\u0085", '_': "\u00a0", 'L': "\u2028", 'P': "\u2029",
+	}
+	hexLengths := map[byte]int{'x': 2, 'u': 4, 'U': 8}
+
+	var out []byte
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			out = append(out, text[i])
+			continue
+		}
+		i++
+		if i >= len(text) {
+			return "", fmt.Errorf("line %v: invalid escape in quoted scalar", num)
+		}
+		if s, ok := escapes[text[i]]; ok {
+			out = append(out, s...)
+			continue
+		}
+		length, ok := hexLengths[text[i]]
+		if !ok || i+length >= len(text) {
+			return "", fmt.Errorf("line %v: invalid escape \\%c in quoted scalar", num, text[i])
+		}
+		code, err := strconv.ParseUint(text[i+1:i+1+length], 16, 32)
+		if err != nil {
+			return "", fmt.Errorf("line %v: invalid escape in quoted scalar", num)
+		}
+		if length == 2 {
+			out = append(out, byte(code))
+		} else {
+			buf := make([]byte, utf8.UTFMax)
+			out = append(out, buf[:utf8.EncodeRune(buf, rune(code))]...)
+		}
+		i += length
+	}
+	return string(out), nil
+}
+
+// Quotes s as a YAML double quoted scalar
+func encodeDoubleQuoted(s string) string {
+	var out []byte
+	out = append(out, '"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			out = append(out, `\"`...)
+		case '\\':
+			out = append(out, `\\`...)
+		case '\n':
+			out = append(out, `\n`...)
+		case '\t':
+			out = append(out, `\t`...)
+		case '\r':
+			out = append(out, `\r`...)
+		default:
+			if r < 0x20 || r == 0x7f {
+				out = append(out, fmt.Sprintf(`\x%02x`, r)...)
+			} else {
+				out = append(out, string(r)...)
+			}
+		}
+	}
+	return string(append(out, '"'))
+}
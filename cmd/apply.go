@@ -15,159 +15,88 @@
 package cmd
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
-	"fmt"
+	"github.com/samsung-cnct/careen/careen"
 	"github.com/spf13/cobra"
-	"io"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
-	"time"
 )
 
-const maxApplyTimeout = 10 // Seconds
-
-// Computes the hash of file named patchPath and compares it with the expected hash
-func VerifyPatch(patch string, expectedHash string) (valid bool, err error) {
-	fileData, err := ioutil.ReadFile(patch)
-	if err != nil {
-		return false, err
-	}
-	fileLen := len(fileData)
-
-	fileHash := sha1.New()
-	io.WriteString(fileHash, string(fileData[:fileLen]))
-	computedHash := hex.EncodeToString(fileHash.Sum(nil))
-	if computedHash != expectedHash {
-		return false, fmt.Errorf("Computed hash %v does not equal expected hash %v", computedHash, expectedHash)
-	}
-
-	return true, nil
-}
-
-// Run command with args and kill if timeout is reached
-func RunCommand(name string, args []string, timeout time.Duration) error {
-	fmt.Printf("Running command \"%v %v\"\n", name, strings.Join(args, " "))
-	cmd := exec.Command(name, args...)
-
-	err := cmd.Start()
-	if err != nil {
-		return err
-	}
-
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Wait()
-	}()
-
-	select {
-	case <-time.After(timeout):
-		if err := cmd.Process.Kill(); err != nil {
-			panic(fmt.Sprintf("Failed to kill command %v, err %v", name, err))
-		}
-		err = fmt.Errorf("Command %v timed out\n", name)
-		break
-	case err := <-done:
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Command %v returned err %v\n", name, err)
-		}
-		break
-	}
-	if err != nil {
-		output, e := cmd.CombinedOutput()
-		if e != nil {
-			return e
-		}
-		fmt.Fprintf(os.Stderr, "%v", output)
-		return err
-	}
-	fmt.Printf("Command %v completed successfully\n", name)
-
-	return nil
-}
-
-// Apply patch to repo in repoDir
-func Apply(repoDir string, patchPath string) (err error) {
-	absRepoDir, err := filepath.Abs(repoDir)
-	if err != nil {
-		return err
-	}
-
-	absPatchPath, err := filepath.Abs(patchPath)
-	if err != nil {
-		return err
-	}
-
-	oldPwd, err := os.Getwd()
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		err = os.Chdir(oldPwd)
-	}()
-
-	err = os.Chdir(absRepoDir)
-	if err != nil {
-		return err
-	}
-
-	cmdName := "git"
-	cmdArgs := []string{"apply", absPatchPath}
-	cmdTimeout := time.Duration(maxApplyTimeout) * time.Second
-	err = RunCommand(cmdName, cmdArgs, cmdTimeout)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
+var applyDryRun bool
 
 // applyCmd represents the apply command
 var applyCmd = &cobra.Command{
-	Use:          "apply [config filename] (default ) " + careenConfig.GetString("config"),
+	Use:          "apply [package]...",
 	Short:        "Applies patches to repositories",
 	SilenceUsage: true,
-	Long:         `Applies patches to the repositories after verifying that the patch file matches the specified hash`,
+	Long: `Applies patches to the repositories after verifying that the patch file matches the specified hash.
+Packages are patched after the packages they depend on. Naming packages, or using
+--only, patches just those packages and their dependencies.
+Patches and manifests with a detached signature, a .sig file alongside, must be signed
+by a trusted key. With trust.require_signatures every one of them must be signed.
+Patches must also follow the policy in patches.policy, if any.
+With --dry-run, patches are applied in memory only, checking that every one of them
+applies, in order, without changing the repositories.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		manifestFilename := careenConfig.GetString("manifest")
-		fmt.Printf("INFO: Using manifest %v\n", manifestFilename)
+		if err := validateReportFormat(reportFormat); err != nil {
+			logger.Errorf("%v", err)
+			ExitCode = 1
+			return
+		}
+		report := careen.NewReport("apply")
+		defer writeReport(report)
+		ctx, stop := signalContext()
+		defer stop()
 
-		manifest, err := GetManifestFromFile(manifestFilename)
+		manifestFilenames := getStringSliceConfig("manifest")
+		manifestLog := logger.With(careen.Fields{"manifest": strings.Join(manifestFilenames, ", ")})
+		manifestLog.Infof("Using manifest")
+
+		manifest, err := getEffectiveManifest()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-			fmt.Fprintf(os.Stderr, "ERROR: Failed to get manifest %v\n", manifestFilename)
+			manifestLog.WithError(err).Errorf("Failed to get manifest")
+			report.Fail(err)
 			ExitCode = 1
 			return
 		}
 
-		patchDir := careenConfig.GetString("patches.directory")
-		outputDir := careenConfig.GetString("output.directory")
+		ws, err := newWorkspace()
+		if err != nil {
+			logger.Errorf("%v", err)
+			report.Fail(err)
+			ExitCode = 1
+			return
+		}
+		ws.Events = workspaceEvents(report)
+		ws.Hooks = careen.MergeHooks(ws.Hooks, manifest.Hooks)
+		ws.DryRun = applyDryRun
 
-		for _, pkg := range manifest.Packages {
-			fmt.Printf("INFO: Applying patches to package: %v\n", pkg.Name)
-			repoDir := outputDir + pkg.Name
-			for _, patch := range pkg.Patches {
-				patchName := patchDir + patch.Filename
-				fmt.Printf("INFO: Applying patch %v to repo %v\n", patchName, repoDir)
-				valid, err := VerifyPatch(patchName, patch.Hash)
-				if !valid || err != nil {
-					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-					fmt.Fprintf(os.Stderr, "ERROR: Refusing to apply patch %v\n", patchName)
-					ExitCode = 1
-					return
-				}
-				err = Apply(repoDir, patchName)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-					fmt.Fprintf(os.Stderr, "ERROR: Failed to apply patch %v\n", patchName)
-					ExitCode = 1
-					return
+		err = ws.CheckManifests()
+		if err != nil {
+			manifestLog.WithError(err).Errorf("Refusing to apply patches of manifest")
+			report.Fail(err)
+			ExitCode = 1
+			return
+		}
+
+		packages, err := selectPackages(manifest, args)
+		if err != nil {
+			logger.Errorf("%v", err)
+			report.Fail(err)
+			ExitCode = 1
+			return
+		}
+		report.AddPackages(packages, true)
+
+		for i := range packages {
+			if ctx.Err() != nil {
+				interrupted(report)
+				return
+			}
+			if _, err := ws.ApplyPackage(ctx, &packages[i]); err != nil {
+				ExitCode = 1
+				if ctx.Err() != nil {
+					interrupted(report)
 				}
-				fmt.Printf("INFO: Applied patch %v to repo %v\n", patchName, repoDir)
+				return
 			}
 		}
 
@@ -177,4 +106,10 @@ var applyCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(applyCmd)
+
+	addPackageSelectionFlags(applyCmd)
+	addReportFlags(applyCmd)
+	applyCmd.Flags().String("timeout", careen.DefaultApplyTimeout.String(), "time applying a patch may take, 0 for no limit")
+	applyCmd.Flags().BoolVar(&applyDryRun, "dry-run", false, "apply patches in memory only, leaving the repositories unchanged")
+	careenConfig.BindPFlag("apply.timeout", applyCmd.Flags().Lookup("timeout"))
 }
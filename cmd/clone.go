@@ -15,98 +15,80 @@
 package cmd
 
 import (
-	"fmt"
+	"github.com/samsung-cnct/careen/careen"
 	"github.com/spf13/cobra"
-	"io"
-	"os"
+	"strings"
 )
 
-func IsEmpty(name string) (bool, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return false, err
-	}
-	defer f.Close()
-
-	_, err = f.Readdirnames(1)
-	if err == io.EOF {
-		return true, nil
-	}
-	return false, err
-}
-
-func Clone(repoUrl string, revision string, destDir string) error {
-	terminalSpinner.Start()
-	defer func() {
-		terminalSpinner.Stop()
-	}()
-
-	err := GitClone(repoUrl, revision, destDir)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func CheckoutByTag(repoDir string, tag string) error {
-	repo, err := GitOpenRepository(repoDir)
-	if err != nil {
-		return err
-	}
-
-	err = GitCheckoutByTag(repo, tag)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 // cloneCmd represents the clone command
 var cloneCmd = &cobra.Command{
-	Use:          "clone [config filename] (default ) " + careenConfig.GetString("config"),
+	Use:          "clone [package]...",
 	Short:        "Clones repositories",
 	SilenceUsage: true,
-	Long:         `Clones repositories at a specific commit specified by configuration.`,
+	Long: `Clones repositories at a specific commit specified by configuration.
+Packages are cloned after the packages they depend on. Naming packages, or using
+--only, clones just those packages and their dependencies.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		manifestFilename = careenConfig.GetString("manifest")
-		fmt.Printf("INFO: Cloning packages from manifest %v\n", manifestFilename)
+		if err := validateReportFormat(reportFormat); err != nil {
+			logger.Errorf("%v", err)
+			ExitCode = 1
+			return
+		}
+		report := careen.NewReport("clone")
+		defer writeReport(report)
+		ctx, stop := signalContext()
+		defer stop()
+
+		manifestFilenames := getStringSliceConfig("manifest")
+		logger.With(careen.Fields{"manifest": strings.Join(manifestFilenames, ", ")}).Infof("Cloning packages from manifest")
 
-		manifest, err := GetManifestFromFile(manifestFilename)
+		manifest, err := getEffectiveManifest()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			logger.Errorf("%v", err)
+			report.Fail(err)
 			ExitCode = 1
 			return
 		}
 
-		outputDir := careenConfig.GetString("output.directory")
+		ws, err := newWorkspace()
+		if err != nil {
+			logger.Errorf("%v", err)
+			report.Fail(err)
+			ExitCode = 1
+			return
+		}
+		ws.Events = workspaceEvents(report)
+		ws.Hooks = careen.MergeHooks(ws.Hooks, manifest.Hooks)
 
-		for _, pkg := range manifest.Packages {
-			repoDir := outputDir + pkg.Name
-			fmt.Printf("INFO: Checking if repository directory %v is empty\n", repoDir)
-			empty, err := IsEmpty(repoDir)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-				ExitCode = 1
+		err = ws.CheckManifests()
+		if err != nil {
+			logger.WithError(err).Errorf("Refusing to clone packages of manifest")
+			report.Fail(err)
+			ExitCode = 1
+			return
+		}
+
+		packages, err := selectPackages(manifest, args)
+		if err != nil {
+			logger.Errorf("%v", err)
+			report.Fail(err)
+			ExitCode = 1
+			return
+		}
+		report.AddPackages(packages, false)
+
+		for i := range packages {
+			if ctx.Err() != nil {
+				interrupted(report)
 				return
-			} else if empty {
-				fmt.Printf("INFO: Attempting to clone repository %v to directory %v\n", pkg.Repo, repoDir)
-				err = Clone(pkg.Repo, pkg.Revision, repoDir)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-					ExitCode = 1
-					return
-				}
 			}
-			fmt.Printf("INFO: Attempting to checkout tag %v from repository directory %v\n", pkg.Tag, repoDir)
-			err = CheckoutByTag(repoDir, pkg.Tag)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			if _, err := ws.Clone(ctx, &packages[i]); err != nil {
 				ExitCode = 1
+				if ctx.Err() != nil {
+					interrupted(report)
+				}
 				return
 			}
-			fmt.Printf("INFO: Checked out tag %v from repository directory %v\n", pkg.Tag, repoDir)
 		}
 
 		ExitCode = 0
@@ -115,4 +97,7 @@ var cloneCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(cloneCmd)
+
+	addPackageSelectionFlags(cloneCmd)
+	addReportFlags(cloneCmd)
 }
@@ -0,0 +1,79 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+)
+
+var convertFormat string
+
+// convertCmd represents the manifest convert command
+var convertCmd = &cobra.Command{
+	Use:          "convert <input filename> [output filename]",
+	Short:        "Converts a manifest between YAML, JSON and TOML",
+	SilenceUsage: true,
+	Long: `Converts a manifest between YAML, JSON and TOML. Formats are chosen by file
+extension. Without an output filename the result is printed in the format given by --to.
+Includes and variables are copied as they are rather than resolved.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 || len(args) > 2 {
+			cmd.Usage()
+			ExitCode = 1
+			return
+		}
+
+		manifest, err := careen.ReadManifestFile(args[0])
+		if err != nil {
+			logger.Errorf("%v", err)
+			ExitCode = 1
+			return
+		}
+
+		format := convertFormat
+		if len(args) == 2 && !cmd.Flags().Changed("to") {
+			format = careen.ManifestFormatFromFilename(args[1])
+		}
+
+		out, err := careen.EncodeManifest(manifest, format)
+		if err != nil {
+			logger.Errorf("%v", err)
+			ExitCode = 1
+			return
+		}
+
+		if len(args) == 1 {
+			fmt.Printf("%s", out)
+		} else {
+			if err := ioutil.WriteFile(args[1], out, 0644); err != nil {
+				logger.Errorf("%v", err)
+				ExitCode = 1
+				return
+			}
+			logger.With(careen.Fields{"manifest": args[0], "output": args[1]}).Infof("Converted manifest")
+		}
+
+		ExitCode = 0
+	},
+}
+
+func init() {
+	manifestCmd.AddCommand(convertCmd)
+
+	convertCmd.Flags().StringVarP(&convertFormat, "to", "t", careen.FormatYAML, "output format (yaml, json or toml)")
+}
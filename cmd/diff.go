@@ -0,0 +1,81 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+)
+
+var diffFormat string
+
+// diffCmd represents the manifest diff command
+var diffCmd = &cobra.Command{
+	Use:          "diff <old manifest> <new manifest>",
+	Short:        "Reports the changes between two manifests",
+	SilenceUsage: true,
+	Long: `Reports which packages were added, removed or changed between two manifests,
+including changes of repository, revision and tag and patches which were added,
+removed, reordered or rehashed. Overlays and variables are applied to both manifests.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			cmd.Usage()
+			ExitCode = 1
+			return
+		}
+
+		overlays := getStringSliceConfig("overlays")
+		manifests := []*careen.Manifest{}
+		for _, filename := range args {
+			manifest, err := careen.GetEffectiveManifest([]string{filename}, overlays, lookupConfigVar)
+			if err != nil {
+				logger.Errorf("%v", err)
+				ExitCode = 1
+				return
+			}
+			manifests = append(manifests, manifest)
+		}
+
+		diff := careen.DiffManifests(manifests[0], manifests[1])
+		switch diffFormat {
+		case "text":
+			fmt.Print(diff.Text())
+		case "markdown":
+			fmt.Print(diff.Markdown())
+		case "json":
+			out, err := json.MarshalIndent(diff, "", "  ")
+			if err != nil {
+				logger.Errorf("%v", err)
+				ExitCode = 1
+				return
+			}
+			fmt.Printf("%s\n", out)
+		default:
+			logger.Errorf("Unknown diff format %v", diffFormat)
+			ExitCode = 1
+			return
+		}
+
+		ExitCode = 0
+	},
+}
+
+func init() {
+	manifestCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().StringVarP(&diffFormat, "format", "f", "text", "report format (text, markdown or json)")
+}
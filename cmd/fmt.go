@@ -0,0 +1,94 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+)
+
+var fmtWrite bool
+var fmtCheck bool
+var fmtSortPackages bool
+
+// fmtCmd represents the manifest fmt command
+var fmtCmd = &cobra.Command{
+	Use:          "fmt [manifest filename]...",
+	Short:        "Formats manifests canonically",
+	SilenceUsage: true,
+	Long: `Rewrites YAML manifests in a canonical form, keeping comments. The result is
+printed unless -w is given. With --check, the names of manifests which are not formatted
+are printed and the command fails if there are any.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		filenames := args
+		if len(filenames) == 0 {
+			filenames = getStringSliceConfig("manifest")
+		}
+
+		ExitCode = 0
+		for _, filename := range filenames {
+			if careen.ManifestFormatFromFilename(filename) != careen.FormatYAML {
+				logger.With(careen.Fields{"manifest": filename}).Errorf("Only YAML manifests can be formatted")
+				ExitCode = 1
+				return
+			}
+
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				logger.Errorf("%v", err)
+				ExitCode = 1
+				return
+			}
+
+			formatted, err := careen.FormatManifest(data, fmtSortPackages)
+			if err != nil {
+				logger.With(careen.Fields{"manifest": filename}).WithError(err).Errorf("Failed to format manifest")
+				ExitCode = 1
+				return
+			}
+
+			switch {
+			case fmtCheck:
+				if !bytes.Equal(data, formatted) {
+					fmt.Println(filename)
+					ExitCode = 1
+				}
+			case fmtWrite:
+				if bytes.Equal(data, formatted) {
+					continue
+				}
+				if err := ioutil.WriteFile(filename, formatted, 0644); err != nil {
+					logger.Errorf("%v", err)
+					ExitCode = 1
+					return
+				}
+				logger.With(careen.Fields{"manifest": filename}).Infof("Formatted manifest")
+			default:
+				fmt.Printf("%s", formatted)
+			}
+		}
+	},
+}
+
+func init() {
+	manifestCmd.AddCommand(fmtCmd)
+
+	fmtCmd.Flags().BoolVarP(&fmtWrite, "write", "w", false, "rewrite the manifest files in place")
+	fmtCmd.Flags().BoolVar(&fmtCheck, "check", false, "fail if any manifest is not formatted")
+	fmtCmd.Flags().BoolVar(&fmtSortPackages, "sort-packages", false, "order packages by name")
+}
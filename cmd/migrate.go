@@ -0,0 +1,78 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+)
+
+var migrateWrite bool
+
+// migrateCmd represents the manifest migrate command
+var migrateCmd = &cobra.Command{
+	Use:          "migrate [manifest filename]...",
+	Short:        "Upgrades manifests to the current format",
+	SilenceUsage: true,
+	Long: `Upgrades manifests written for older versions of careen to the current
+manifest format version ` + careen.CurrentManifestVersion + `. The result is printed unless -w is given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		filenames := args
+		if len(filenames) == 0 {
+			filenames = getStringSliceConfig("manifest")
+		}
+
+		for _, filename := range filenames {
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				logger.Errorf("%v", err)
+				ExitCode = 1
+				return
+			}
+
+			migrated, version, err := careen.MigrateManifestFile(filename, data)
+			if err != nil {
+				logger.With(careen.Fields{"manifest": filename}).WithError(err).Errorf("Failed to migrate manifest")
+				ExitCode = 1
+				return
+			}
+
+			if !migrateWrite {
+				fmt.Printf("%s", migrated)
+				continue
+			}
+			if string(migrated) == string(data) {
+				logger.With(careen.Fields{"manifest": filename, "version": version}).Infof("Manifest is already at the current version")
+				continue
+			}
+			if err := ioutil.WriteFile(filename, migrated, 0644); err != nil {
+				logger.Errorf("%v", err)
+				ExitCode = 1
+				return
+			}
+			logger.With(careen.Fields{"manifest": filename, "version": version}).Infof("Migrated manifest")
+		}
+
+		ExitCode = 0
+	},
+}
+
+func init() {
+	manifestCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().BoolVarP(&migrateWrite, "write", "w", false, "rewrite the manifest files in place")
+}
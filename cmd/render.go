@@ -0,0 +1,59 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+)
+
+var renderFormat string
+
+// renderCmd represents the manifest render command
+var renderCmd = &cobra.Command{
+	Use:          "render",
+	Short:        "Prints the effective manifest",
+	SilenceUsage: true,
+	Long: `Prints the manifest which clone and apply would use, after merging all
+manifests, resolving includes and applying overlays`,
+	Run: func(cmd *cobra.Command, args []string) {
+		manifest, err := getEffectiveManifest()
+		if err != nil {
+			logger.Errorf("%v", err)
+			ExitCode = 1
+			return
+		}
+
+		// Variables have already been substituted into the packages
+		manifest.Vars = nil
+
+		out, err := careen.EncodeManifest(manifest, renderFormat)
+		if err != nil {
+			logger.Errorf("%v", err)
+			ExitCode = 1
+			return
+		}
+		fmt.Printf("%s", out)
+
+		ExitCode = 0
+	},
+}
+
+func init() {
+	manifestCmd.AddCommand(renderCmd)
+
+	renderCmd.Flags().StringVarP(&renderFormat, "format", "f", careen.FormatYAML, "output format (yaml, json or toml)")
+}
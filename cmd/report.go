@@ -0,0 +1,53 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+var reportFile string
+var reportFormat string
+
+// Adds the flags which write a report of the packages and patches processed
+func addReportFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&reportFile, "report", "", "write a report of every package and patch to this file")
+	cmd.Flags().StringVar(&reportFormat, "report-format", careen.ReportFormatJSON, "format of the report, json or junit")
+}
+
+func validateReportFormat(format string) error {
+	switch format {
+	case careen.ReportFormatJSON, careen.ReportFormatJUnit:
+		return nil
+	}
+	return fmt.Errorf("Unknown report format %q, expected %v or %v", format, careen.ReportFormatJSON, careen.ReportFormatJUnit)
+}
+
+// Writes the report to the file given with --report, if any. Commands defer
+// this so the report is written however they finish.
+func writeReport(report *careen.Report) {
+	if reportFile == "" {
+		return
+	}
+	report.Duration = time.Since(report.Started)
+	err := report.WriteFile(reportFile, reportFormat)
+	if err != nil {
+		logger.With(careen.Fields{"report": reportFile}).WithError(err).Errorf("Failed to write report")
+		ExitCode = 1
+	}
+}
@@ -17,6 +17,8 @@ package cmd
 import (
 	"fmt"
 	"github.com/briandowns/spinner"
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cast"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh/terminal"
@@ -27,11 +29,19 @@ import (
 )
 
 var configFilename string
-var manifestFilename string
+var manifestFilenames []string
+var overlayFilenames []string
+var setVars []string
 var outputDirectory string
 var patchDirectory string
+var logLevel string
+var logFormat string
+var quiet bool
 var ExitCode int
 
+// Logs go to stderr, leaving stdout to the output of commands such as manifest render
+var logger = careen.NewLogger(os.Stderr)
+
 // progress spinner
 var terminalSpinner = spinner.New(spinner.CharSets[35], 200*time.Millisecond)
 
@@ -71,12 +81,22 @@ func init() {
 		"c",
 		"",
 		"config file")
-	RootCmd.PersistentFlags().StringVarP(
-		&manifestFilename,
+	RootCmd.PersistentFlags().StringSliceVarP(
+		&manifestFilenames,
 		"manifest",
 		"m",
-		"",
-		"manifest filename")
+		[]string{},
+		"manifest filename (may be given multiple times)")
+	RootCmd.PersistentFlags().StringSliceVar(
+		&overlayFilenames,
+		"overlay",
+		[]string{},
+		"overlay filename applied to the manifest (may be given multiple times)")
+	RootCmd.PersistentFlags().StringArrayVar(
+		&setVars,
+		"set",
+		[]string{},
+		"set a manifest variable as key=value (may be given multiple times)")
 	RootCmd.PersistentFlags().StringVarP(
 		&outputDirectory,
 		"output",
@@ -89,6 +109,22 @@ func init() {
 		"p",
 		"",
 		"patch directory")
+	RootCmd.PersistentFlags().StringVar(
+		&logLevel,
+		"log-level",
+		"info",
+		"log messages at this level and above: debug, info, warn or error")
+	RootCmd.PersistentFlags().StringVar(
+		&logFormat,
+		"log-format",
+		careen.LogFormatText,
+		"log format: text or json")
+	RootCmd.PersistentFlags().BoolVarP(
+		&quiet,
+		"quiet",
+		"q",
+		false,
+		"log errors only, same as --log-level error")
 
 	configureSpinner(terminalSpinner)
 
@@ -98,8 +134,21 @@ func init() {
 func initCareenConfig() {
 	careenConfig.BindPFlag("config", RootCmd.Flags().Lookup("config"))
 	careenConfig.BindPFlag("manifest", RootCmd.Flags().Lookup("manifest"))
+	careenConfig.BindPFlag("overlays", RootCmd.Flags().Lookup("overlay"))
 	careenConfig.BindPFlag("output.directory", RootCmd.Flags().Lookup("output"))
 	careenConfig.BindPFlag("patches.directory", RootCmd.Flags().Lookup("patches"))
+	careenConfig.BindPFlag("log.level", RootCmd.Flags().Lookup("log-level"))
+	careenConfig.BindPFlag("log.format", RootCmd.Flags().Lookup("log-format"))
+
+	// Variables given with --set override ENV variables (CAREEN_VAR_*) and the var section of the config file
+	for _, setVar := range setVars {
+		kv := strings.SplitN(setVar, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			logger.Errorf("Invalid --set %q, expected key=value", setVar)
+			os.Exit(1)
+		}
+		careenConfig.Set("var."+kv[0], kv[1])
+	}
 
 	careenConfig.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	careenConfig.SetEnvPrefix("CAREEN") // prefix for env vars to configure cluster
@@ -115,14 +164,20 @@ func initCareenConfig() {
 	}
 
 	// If a config file is found, read it in.
-	if err := careenConfig.ReadInConfig(); err == nil {
-		fmt.Println("INFO: Using careen config file:", careenConfig.ConfigFileUsed())
+	configErr := careenConfig.ReadInConfig()
+
+	if err := configureLogger(); err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if configErr == nil {
+		logger.With(careen.Fields{"config": careenConfig.ConfigFileUsed()}).Infof("Using careen config file")
 	}
 
 	// Set defaults
 	workingDir, err := os.Getwd()
 	if err != nil {
-		fmt.Println(err)
+		logger.Errorf("%v", err)
 		os.Exit(1)
 	}
 	// No default for config
@@ -131,6 +186,55 @@ func initCareenConfig() {
 	careenConfig.SetDefault("patches.directory", workingDir+"/patches/")
 }
 
+// Applies log.level and log.format from flags, ENV variables or the config file
+func configureLogger() error {
+	level, err := careen.ParseLogLevel(careenConfig.GetString("log.level"))
+	if err != nil {
+		return err
+	}
+	if quiet {
+		level = careen.LogError
+	}
+	logger.SetLevel(level)
+
+	if err := logger.SetFormat(careenConfig.GetString("log.format")); err != nil {
+		return err
+	}
+	if logger.Format() == careen.LogFormatJSON {
+		// The spinner would break up the JSON lines
+		terminalSpinner.Writer = ioutil.Discard
+	}
+	return nil
+}
+
+// Returns a list of strings from flags, ENV variables or the config file. Viper
+// hands back repeated flags and ENV variables as a single comma separated string.
+func getStringSliceConfig(key string) []string {
+	switch values := careenConfig.Get(key).(type) {
+	case string:
+		if values == "" {
+			return []string{}
+		}
+		return strings.Split(values, ",")
+	default:
+		return cast.ToStringSlice(values)
+	}
+}
+
+// Loads the manifests and overlays selected by flags, ENV variables or the config file
+func getEffectiveManifest() (*careen.Manifest, error) {
+	return careen.GetEffectiveManifest(getStringSliceConfig("manifest"), getStringSliceConfig("overlays"), lookupConfigVar)
+}
+
+// Looks up a manifest variable given by --set, CAREEN_VAR_<NAME> or the var section of the config file
+func lookupConfigVar(name string) (string, bool) {
+	key := "var." + name
+	if !careenConfig.IsSet(key) {
+		return "", false
+	}
+	return careenConfig.GetString(key), true
+}
+
 func configureSpinner(s *spinner.Spinner) {
 	if terminal.IsTerminal(int(os.Stdout.Fd())) {
 		// Directing the spinner to stderr makes the command compatible with pipe, et al.
@@ -0,0 +1,46 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+)
+
+// schemaCmd represents the manifest schema command
+var schemaCmd = &cobra.Command{
+	Use:          "schema",
+	Short:        "Prints a JSON Schema for manifests",
+	SilenceUsage: true,
+	Long: `Prints a JSON Schema describing manifests, which editors can use to validate
+and autocomplete manifests written in YAML or JSON`,
+	Run: func(cmd *cobra.Command, args []string) {
+		out, err := json.MarshalIndent(careen.ManifestSchema(), "", "  ")
+		if err != nil {
+			logger.Errorf("%v", err)
+			ExitCode = 1
+			return
+		}
+		fmt.Printf("%s\n", out)
+
+		ExitCode = 0
+	},
+}
+
+func init() {
+	manifestCmd.AddCommand(schemaCmd)
+}
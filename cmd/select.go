@@ -0,0 +1,36 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+)
+
+var onlyPackages []string
+var skipPackages []string
+
+// Adds the flags which select the packages a command operates on
+func addPackageSelectionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&onlyPackages, "only", []string{}, "only operate on these packages and their dependencies")
+	cmd.Flags().StringSliceVar(&skipPackages, "skip", []string{}, "do not operate on these packages, even as dependencies")
+}
+
+// Returns the packages named by args and --only, or all packages if none are
+// named, together with their dependencies and without those given by --skip,
+// in dependency order
+func selectPackages(manifest *careen.Manifest, args []string) ([]careen.Package, error) {
+	return careen.SelectPackages(manifest, append(append([]string{}, args...), onlyPackages...), skipPackages)
+}
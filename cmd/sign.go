@@ -0,0 +1,101 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var signKey string
+var signFormat string
+
+// Returns the manifests, their includes, the overlays and the patches of the
+// effective manifest, which are the files apply checks signatures of
+func signedFilenames() ([]string, error) {
+	manifest, err := getEffectiveManifest()
+	if err != nil {
+		return nil, err
+	}
+	filenames, err := careen.ManifestSources(getStringSliceConfig("manifest"))
+	if err != nil {
+		return nil, err
+	}
+	filenames = append(filenames, getStringSliceConfig("overlays")...)
+
+	ws := careen.NewWorkspace(careenConfig.GetString("output.directory"), careenConfig.GetString("patches.directory"))
+	for _, pkg := range manifest.Packages {
+		for _, patch := range pkg.Patches {
+			patchName, err := ws.PatchFilename(&patch)
+			if err != nil {
+				return nil, err
+			}
+			filenames = append(filenames, patchName)
+		}
+	}
+	return filenames, nil
+}
+
+// signCmd represents the sign command
+var signCmd = &cobra.Command{
+	Use:          "sign [filename]...",
+	Short:        "Signs patches and manifests",
+	SilenceUsage: true,
+	Long: `Writes a detached signature alongside each file, in a file named after it with
+.sig appended, which apply checks against the trusted keys. Without filenames the
+manifests, the manifests they include, the overlays and every patch are signed.
+
+Signatures are made with gpg, as --key if given, or with ssh-keygen using the
+private key file --key. The format defaults to ssh when --key names a file.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		format := signFormat
+		if format == "" {
+			format = careen.SignatureGPG
+			if info, err := os.Stat(signKey); signKey != "" && err == nil && !info.IsDir() {
+				format = careen.SignatureSSH
+			}
+		}
+
+		filenames := args
+		if len(filenames) == 0 {
+			var err error
+			filenames, err = signedFilenames()
+			if err != nil {
+				logger.Errorf("%v", err)
+				ExitCode = 1
+				return
+			}
+		}
+
+		for _, filename := range filenames {
+			if err := careen.SignFile(filename, format, signKey); err != nil {
+				logger.With(careen.Fields{"file": filename}).WithError(err).Errorf("Failed to sign file")
+				ExitCode = 1
+				return
+			}
+			logger.With(careen.Fields{"file": filename, "signature": careen.SignatureFilename(filename)}).Infof("Signed file")
+		}
+
+		ExitCode = 0
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(signCmd)
+
+	signCmd.Flags().StringVarP(&signKey, "key", "k", "", "gpg key to sign as, or ssh private key file")
+	signCmd.Flags().StringVar(&signFormat, "format", "", "signature format, gpg or ssh")
+}
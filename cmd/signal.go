@@ -0,0 +1,66 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"github.com/samsung-cnct/careen/careen"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Exit code of a run stopped by SIGINT or SIGTERM, as shells report it
+const interruptedExitCode = 130
+
+// Records in the report that the run was interrupted, so that it does not
+// pass, and sets the exit code to say so
+func interrupted(report *careen.Report) {
+	report.Fail(careen.ErrInterrupted)
+	ExitCode = interruptedExitCode
+}
+
+// Returns a context cancelled when careen receives SIGINT or SIGTERM, so
+// commands can stop what they are doing and clean up. A second signal exits
+// at once. Call stop when done to restore the default handling.
+func signalContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			terminalSpinner.Stop()
+			logger.With(careen.Fields{"signal": sig.String()}).Warnf("Interrupted, stopping and cleaning up")
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			logger.Errorf("Interrupted again, exiting without cleaning up")
+			os.Exit(interruptedExitCode)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
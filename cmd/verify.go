@@ -0,0 +1,102 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:          "verify [package]...",
+	Short:        "Checks patches and repositories without applying patches",
+	SilenceUsage: true,
+	Long: `Runs the checks apply makes before patching: the hash, signature and patch policy
+of every patch, the signatures of the manifests, and the submodules and LFS files of
+cloned repositories. Every problem is reported, not just the first.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := validateReportFormat(reportFormat); err != nil {
+			logger.Errorf("%v", err)
+			ExitCode = 1
+			return
+		}
+		report := careen.NewReport("verify")
+		defer writeReport(report)
+		ctx, stop := signalContext()
+		defer stop()
+
+		manifestFilenames := getStringSliceConfig("manifest")
+		logger.With(careen.Fields{"manifest": strings.Join(manifestFilenames, ", ")}).Infof("Using manifest")
+
+		manifest, err := getEffectiveManifest()
+		if err != nil {
+			logger.Errorf("%v", err)
+			report.Fail(err)
+			ExitCode = 1
+			return
+		}
+
+		ws, err := newWorkspace()
+		if err != nil {
+			logger.Errorf("%v", err)
+			report.Fail(err)
+			ExitCode = 1
+			return
+		}
+		ws.Events = workspaceEvents(report)
+
+		packages, err := selectPackages(manifest, args)
+		if err != nil {
+			logger.Errorf("%v", err)
+			report.Fail(err)
+			ExitCode = 1
+			return
+		}
+		report.AddPackages(packages, true)
+
+		failed := 0
+		if err := ws.CheckManifests(); err != nil {
+			logger.Errorf("%v", err)
+			report.Fail(err)
+			failed++
+		}
+		results, _ := ws.Verify(ctx, packages...)
+		if ctx.Err() != nil {
+			interrupted(report)
+			return
+		}
+		for _, result := range results {
+			if result.Status == careen.ReportFailed {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			logger.With(careen.Fields{"failed": failed}).Errorf("Verification failed")
+			ExitCode = 1
+			return
+		}
+		ExitCode = 0
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+
+	addPackageSelectionFlags(verifyCmd)
+	addReportFlags(verifyCmd)
+}
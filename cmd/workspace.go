@@ -0,0 +1,227 @@
+// Copyright © 2016 Samsung CNCT
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/samsung-cnct/careen/careen"
+	"github.com/spf13/cast"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Returns a workspace for the output and patch directories, manifests and
+// overlays, trusted keys, patch policy, URL rewrites, retries, apply timeout,
+// git backend and hooks configured by flags, ENV variables or the config file
+func newWorkspace() (*careen.Workspace, error) {
+	ws := careen.NewWorkspace(careenConfig.GetString("output.directory"), careenConfig.GetString("patches.directory"))
+	ws.ManifestFiles = getStringSliceConfig("manifest")
+	ws.OverlayFiles = getStringSliceConfig("overlays")
+	ws.RequireSignatures = careenConfig.GetBool("trust.require_signatures")
+	ws.Log = logger
+
+	var err error
+	if ws.Rewrites, err = getURLRewrites(); err != nil {
+		return nil, err
+	}
+	if ws.Keys, err = getTrustedKeys(); err != nil {
+		return nil, err
+	}
+	if ws.Policy, err = getPatchPolicy(); err != nil {
+		return nil, err
+	}
+	if ws.Retries, err = getRetryPolicies(); err != nil {
+		return nil, err
+	}
+	if ws.ApplyTimeout, err = getApplyTimeout(); err != nil {
+		return nil, err
+	}
+	if ws.Git, err = getGitBackend(); err != nil {
+		return nil, err
+	}
+	ws.Hooks = getHooks()
+	if ws.HookTimeout, err = getHookTimeout(); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Returns the handler of workspace events, which records results in the report
+// and spins the progress spinner during downloads
+func workspaceEvents(report *careen.Report) func(careen.Event) {
+	return func(event careen.Event) {
+		switch event.Type {
+		case careen.TransferStarted:
+			terminalSpinner.Start()
+		case careen.TransferFinished:
+			terminalSpinner.Stop()
+		}
+		report.HandleEvent(event)
+	}
+}
+
+// Returns the backend named by git.backend, or the default one
+func getGitBackend() (careen.GitBackend, error) {
+	name := careenConfig.GetString("git.backend")
+	backend, err := careen.NewGitBackend(name)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid git.backend %q, expected %v", name, strings.Join(careen.GitBackendNames(), " or "))
+	}
+	return backend, nil
+}
+
+// Returns apply.timeout, how long applying a patch may take
+func getApplyTimeout() (time.Duration, error) {
+	timeout, err := time.ParseDuration(careenConfig.GetString("apply.timeout"))
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("Invalid apply.timeout %q, expected a duration such as 30s or 2m, or 0 for none", careenConfig.GetString("apply.timeout"))
+	}
+	return timeout, nil
+}
+
+// Returns the hooks configured under hooks.<name>, each a command or a list
+// of commands, or nil if there are none
+func getHooks() *careen.Hooks {
+	hooks := &careen.Hooks{}
+	for _, setting := range []struct {
+		name     string
+		commands *[]string
+	}{
+		{careen.HookPreClone, &hooks.PreClone},
+		{careen.HookPostClone, &hooks.PostClone},
+		{careen.HookPreApply, &hooks.PreApply},
+		{careen.HookPostApply, &hooks.PostApply},
+	} {
+		// Unlike other lists, a command is not split at commas
+		switch value := careenConfig.Get("hooks." + setting.name).(type) {
+		case string:
+			if value != "" {
+				*setting.commands = []string{value}
+			}
+		default:
+			*setting.commands = cast.ToStringSlice(value)
+		}
+	}
+	return careen.MergeHooks(hooks, nil)
+}
+
+// Returns hooks.timeout, how long a hook may take
+func getHookTimeout() (time.Duration, error) {
+	if !careenConfig.IsSet("hooks.timeout") {
+		return careen.DefaultHookTimeout, nil
+	}
+	timeout, err := time.ParseDuration(careenConfig.GetString("hooks.timeout"))
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("Invalid hooks.timeout %q, expected a duration such as 30s or 2m, or 0 for none", careenConfig.GetString("hooks.timeout"))
+	}
+	return timeout, nil
+}
+
+// Returns the configured patch policy, or nil if there is none
+func getPatchPolicy() (*careen.PatchPolicy, error) {
+	filename := careenConfig.GetString("patches.policy")
+	if filename == "" {
+		return nil, nil
+	}
+	return careen.GetPatchPolicyFromFile(filename)
+}
+
+func getTrustedKeys() (careen.TrustedKeys, error) {
+	keys := careen.TrustedKeys{
+		GPGKeyring:        careenConfig.GetString("trust.gpg_keyring"),
+		SSHAllowedSigners: careenConfig.GetString("trust.ssh_allowed_signers"),
+	}
+	for _, path := range []*string{&keys.GPGKeyring, &keys.SSHAllowedSigners} {
+		if *path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			return keys, err
+		}
+		*path = abs
+	}
+	return keys, nil
+}
+
+func getRetryPolicies() (careen.RetryPolicies, error) {
+	policies := careen.RetryPolicies{}
+	var err error
+	if policies.Clone, err = getRetryPolicy(careen.RetryClone); err != nil {
+		return policies, err
+	}
+	if policies.Fetch, err = getRetryPolicy(careen.RetryFetch); err != nil {
+		return policies, err
+	}
+	policies.Download, err = getRetryPolicy(careen.RetryDownload)
+	return policies, err
+}
+
+// Returns the key of a retry setting of operation: retry.<operation>.<name>
+// if set, else retry.<name>, or "" for the default
+func retrySettingKey(operation string, name string) string {
+	for _, key := range []string{"retry." + operation + "." + name, "retry." + name} {
+		if careenConfig.IsSet(key) {
+			return key
+		}
+	}
+	return ""
+}
+
+// Returns the retry policy of operation, see retrySettingKey
+func getRetryPolicy(operation string) (careen.RetryPolicy, error) {
+	policy := careen.DefaultRetryPolicy
+
+	if key := retrySettingKey(operation, "attempts"); key != "" {
+		policy.Attempts = careenConfig.GetInt(key)
+		if policy.Attempts < 1 {
+			return policy, fmt.Errorf("Invalid %v %q, expected at least 1", key, careenConfig.GetString(key))
+		}
+	}
+	for name, delay := range map[string]*time.Duration{"initial_delay": &policy.InitialDelay, "max_delay": &policy.MaxDelay} {
+		if key := retrySettingKey(operation, name); key != "" {
+			d, err := time.ParseDuration(careenConfig.GetString(key))
+			if err != nil || d < 0 {
+				return policy, fmt.Errorf("Invalid %v %q, expected a duration such as 2s or 1m", key, careenConfig.GetString(key))
+			}
+			*delay = d
+		}
+	}
+	if key := retrySettingKey(operation, "multiplier"); key != "" {
+		policy.Multiplier = careenConfig.GetFloat64(key)
+		if policy.Multiplier < 1 {
+			return policy, fmt.Errorf("Invalid %v %q, expected at least 1", key, careenConfig.GetString(key))
+		}
+	}
+	if key := retrySettingKey(operation, "errors"); key != "" {
+		policy.Errors = getStringSliceConfig(key)
+		for _, class := range policy.Errors {
+			if !careen.ContainsString(careen.RetryErrorClasses, class) {
+				return policy, fmt.Errorf("Unknown error class %q in %v, expected %v", class, key, strings.Join(careen.RetryErrorClasses, ", "))
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Reads and compiles the url.rewrites rules from the careen config
+func getURLRewrites() ([]careen.URLRewrite, error) {
+	rewrites := []careen.URLRewrite{}
+	if err := careenConfig.UnmarshalKey("url.rewrites", &rewrites); err != nil {
+		return nil, fmt.Errorf("Error reading url.rewrites: %v", err)
+	}
+	return careen.CompileURLRewrites(rewrites)
+}